@@ -0,0 +1,234 @@
+package peg
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+var (
+	abnfParser     *Parser
+	abnfParserOnce sync.Once
+	abnfParserLock sync.Mutex
+)
+
+func setupABNFParser() {
+	abnfParser, _ = NewParser(`
+		RULELIST      <- BLANK* (RULE BLANK*)*
+		RULE          <- RULENAME DEFINEDAS ALTERNATION ENDRULE
+		ALTERNATION   <- CONCATENATION ('/' CONCATENATION)*
+		CONCATENATION <- REPETITION+
+		REPETITION    <- REPEAT? ELEMENT
+		REPEAT        <- < [0-9]* '*' [0-9]* / [0-9]+ >
+		ELEMENT       <- RULENAME !DEFINEDAS / '(' ALTERNATION ')' / '[' ALTERNATION ']' / CHARVAL / NUMVAL / PROSEVAL
+		RULENAME      <- < [a-zA-Z] [a-zA-Z0-9-]* >
+		DEFINEDAS     <- < '=/' / '=' >
+		CHARVAL       <- < ('%' [sSiI])? '"' [\x20-\x21\x23-\x7e]* '"' >
+		NUMVAL        <- < '%' ([bB] [01]+ ('-' [01]+ / ('.' [01]+)*) / [dD] [0-9]+ ('-' [0-9]+ / ('.' [0-9]+)*) / [xX] [0-9a-fA-F]+ ('-' [0-9a-fA-F]+ / ('.' [0-9a-fA-F]+)*)) >
+		PROSEVAL      <- < '<' [\x20-\x3d\x3f-\x7e]* '>' >
+		~BLANK        <- [ \t]* COMMENT? NL
+		~ENDRULE      <- COMMENT? NL / !.
+		~COMMENT      <- ';' (![\r\n] .)*
+		~NL           <- '\r\n' / '\n' / '\r'
+		%whitespace   <- ([ \t] / COMMENT? NL [ \t])*
+	`)
+
+	g := abnfParser.Grammar
+	g["RULE"].Action = func(v *Values, d Any) (Any, error) {
+		d.(*importer).define(v.ToStr(0), v.ToOpe(2), v.Pos, v.SS, v.ToStr(1) == "=/")
+		return nil, nil
+	}
+	g["ALTERNATION"].Action = func(v *Values, d Any) (Any, error) {
+		if len(v.Vs) == 1 {
+			return v.ToOpe(0), nil
+		}
+		var opes []operator
+		for i := range v.Vs {
+			opes = append(opes, v.ToOpe(i))
+		}
+		return ChoCore(opes), nil
+	}
+	g["CONCATENATION"].Action = func(v *Values, d Any) (Any, error) {
+		if len(v.Vs) == 1 {
+			return v.ToOpe(0), nil
+		}
+		var opes []operator
+		for i := range v.Vs {
+			opes = append(opes, v.ToOpe(i))
+		}
+		return SeqCore(opes), nil
+	}
+	g["REPETITION"].Action = func(v *Values, d Any) (Any, error) {
+		if len(v.Vs) == 1 {
+			return v.ToOpe(0), nil
+		}
+		min, max := 0, -1
+		rep := v.ToStr(0)
+		if i := strings.IndexByte(rep, '*'); i == -1 {
+			min, _ = strconv.Atoi(rep)
+			max = min
+		} else {
+			if i > 0 {
+				min, _ = strconv.Atoi(rep[:i])
+			}
+			if i+1 < len(rep) {
+				max, _ = strconv.Atoi(rep[i+1:])
+			}
+		}
+		if max != -1 && max < min {
+			d.(*importer).diag(v.Pos, "'"+rep+"' has the maximum less than the minimum.")
+		}
+		return repeatOpe(v.ToOpe(1), min, max), nil
+	}
+	g["ELEMENT"].Action = func(v *Values, d Any) (Any, error) {
+		switch v.Choice {
+		case 0: // Rule name
+			return Ref(v.ToStr(0), nil, v.Pos), nil
+		case 2: // Option
+			return Opt(v.ToOpe(0)), nil
+		}
+		return v.ToOpe(0), nil
+	}
+	g["RULENAME"].Action = func(v *Values, d Any) (Any, error) {
+		return v.Token(), nil
+	}
+	g["DEFINEDAS"].Action = func(v *Values, d Any) (Any, error) {
+		return v.Token(), nil
+	}
+	g["REPEAT"].Action = func(v *Values, d Any) (Any, error) {
+		return v.Token(), nil
+	}
+	g["CHARVAL"].Action = func(v *Values, d Any) (Any, error) {
+		tok := v.Token()
+		if tok[0] == '%' {
+			lit := tok[3 : len(tok)-1]
+			if tok[1] == 's' || tok[1] == 'S' {
+				return Lit(lit), nil
+			}
+			return foldLit(lit), nil
+		}
+		return foldLit(tok[1 : len(tok)-1]), nil
+	}
+	g["NUMVAL"].Action = func(v *Values, d Any) (Any, error) {
+		return abnfNumVal(v.Token(), v.Pos, d.(*importer)), nil
+	}
+	g["PROSEVAL"].Action = func(v *Values, d Any) (Any, error) {
+		d.(*importer).diag(v.Pos, "prose value '"+v.Token()+"' has no equivalent in PEG.")
+		return Lit(""), nil
+	}
+}
+
+// NewParserFromABNF makes a parser from a grammar in ABNF (RFC 5234 and
+// RFC 7405). Rule names are case-insensitive, and the core rules such as
+// ALPHA and DIGIT are available without definitions. Alternatives are tried
+// in order as in PEG, so a grammar may need to be reordered, e.g. to try
+// longer alternatives first. Quoted strings match ignoring the case unless
+// they have the '%s' prefix. Numeric values up to %xFF match bytes, and
+// larger ones match characters in UTF-8. Prose values are reported as
+// errors.
+func NewParserFromABNF(s string) (*Parser, error) {
+	abnfParserOnce.Do(setupABNFParser)
+
+	im := newImporter(true)
+	abnfParserLock.Lock()
+	_, err := abnfParser.ParseAndGetValue(s, im)
+	abnfParserLock.Unlock()
+
+	if err != nil {
+		return nil, err
+	}
+	return im.parser(s, abnfCoreRule)
+}
+
+// abnfNumVal makes an operator for a numeric value such as '%x41-5A' or
+// '%d13.10'.
+func abnfNumVal(tok string, pos int, im *importer) operator {
+	base := 10
+	switch tok[1] {
+	case 'b', 'B':
+		base = 2
+	case 'x', 'X':
+		base = 16
+	}
+
+	var vals []rune
+	ok := true
+	for _, s := range strings.FieldsFunc(tok[2:], func(r rune) bool { return r == '-' || r == '.' }) {
+		n, err := strconv.ParseUint(s, base, 32)
+		if err != nil || n > unicode.MaxRune {
+			ok = false
+			break
+		}
+		vals = append(vals, rune(n))
+	}
+	if !ok {
+		im.diag(pos, "'"+tok+"' is out of the range of characters.")
+		return Lit("")
+	}
+
+	if strings.IndexByte(tok, '-') != -1 {
+		lo, hi := vals[0], vals[1]
+		switch {
+		case lo > hi:
+			im.diag(pos, "'"+tok+"' has the upper bound less than the lower bound.")
+		case hi <= 0xff:
+			return byteRange(byte(lo), byte(hi))
+		case lo > 0xff:
+			return runeRange(lo, hi)
+		default:
+			im.diag(pos, "'"+tok+"' mixes bytes up to %xFF with characters.")
+		}
+		return Lit("")
+	}
+
+	var b []byte
+	for _, r := range vals {
+		if r <= 0xff {
+			b = append(b, byte(r))
+		} else {
+			b = utf8.AppendRune(b, r)
+		}
+	}
+	return Lit(string(b))
+}
+
+// abnfCoreRule returns the core rule in RFC 5234 Appendix B.1.
+func abnfCoreRule(name string) operator {
+	switch strings.ToUpper(name) {
+	case "ALPHA":
+		return Cls("A-Za-z")
+	case "BIT":
+		return Cls("01")
+	case "CHAR":
+		return Cls("\x01-\x7f")
+	case "CR":
+		return Lit("\r")
+	case "CRLF":
+		return Lit("\r\n")
+	case "CTL":
+		return Cls("\x00-\x1f\x7f")
+	case "DIGIT":
+		return Cls("0-9")
+	case "DQUOTE":
+		return Lit("\"")
+	case "HEXDIG":
+		return Cls("0-9A-Fa-f")
+	case "HTAB":
+		return Lit("\t")
+	case "LF":
+		return Lit("\n")
+	case "LWSP":
+		return Zom(Cho(Cls(" \t"), Seq(Lit("\r\n"), Cls(" \t"))))
+	case "OCTET":
+		return Cls("\x00-\xff")
+	case "SP":
+		return Lit(" ")
+	case "VCHAR":
+		return Cls("\x21-\x7e")
+	case "WSP":
+		return Cls(" \t")
+	}
+	return nil
+}
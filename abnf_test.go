@@ -0,0 +1,80 @@
+package peg
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestABNF(t *testing.T) {
+	parser, err := NewParserFromABNF(`; RFC 3986, simplified
+URI         = scheme ":" hier-part [ "?" query ]
+scheme      = ALPHA *( ALPHA / DIGIT / "+" / "-" / "." )
+hier-part   = "//" authority path
+hier-part   =/ path
+authority   = 1*( unreserved / pct-encoded )
+path        = *( "/" *pchar )
+query       = *( pchar / "/" / "?" )
+pchar       = unreserved / pct-encoded / ":" / "@"
+unreserved  = ALPHA / DIGIT / %x2D / %x2E / %x5F / %x7E
+pct-encoded = "%" 2HEXDIG
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert(t, parser.Parse("http://example.com/a%20b?x", nil) == nil)
+	assert(t, parser.Parse("HTTP://example.com", nil) == nil)
+	assert(t, parser.Parse("file:/etc/hosts", nil) == nil)
+	assert(t, parser.Parse("1http://example.com", nil) != nil)
+	assert(t, parser.Parse("http://a%2", nil) != nil)
+	assert(t, parser.Grammar["hier-part"] != nil)
+	assert(t, parser.Grammar["ALPHA"] != nil)
+}
+
+func TestABNFCaseSensitivity(t *testing.T) {
+	parser, err := NewParserFromABNF(`
+Greeting = Word SP name
+word     = %s"Hi" / "hello"
+NAME     = 2*4%x61-7A
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert(t, parser.Parse("Hi bob", nil) == nil)
+	assert(t, parser.Parse("HeLLo bob", nil) == nil)
+	assert(t, parser.Parse("hi bob", nil) != nil)
+	assert(t, parser.Parse("Hi b", nil) != nil)
+	assert(t, parser.Parse("Hi bobby", nil) != nil)
+}
+
+func TestABNFUnicode(t *testing.T) {
+	parser, err := NewParserFromABNF(`
+text = 1*(%x20-7E / %x3B1-3C9 / %x1F600)
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert(t, parser.Parse("abc αβω 😀", nil) == nil)
+	assert(t, parser.Parse("Ω", nil) != nil)
+}
+
+func TestABNFDiagnostics(t *testing.T) {
+	_, err := NewParserFromABNF(`
+rule  = <anything> / other
+other = %x00-100
+more  =/ "x"
+`)
+	pe, ok := err.(*Error)
+	if !ok {
+		t.Fatal(err)
+	}
+	assert(t, len(pe.Details) == 3)
+	assert(t, pe.Details[0].Ln == 2 && strings.Contains(pe.Details[0].Msg, "prose value '<anything>'"))
+	assert(t, pe.Details[1].Ln == 3 && strings.Contains(pe.Details[1].Msg, "'%x00-100' mixes bytes"))
+	assert(t, pe.Details[2].Ln == 4 && pe.Details[2].Msg == "'more' is not defined before '=/'.")
+
+	_, err = NewParserFromABNF("rule = undefined\n")
+	assert(t, err != nil && err.Error() == "1:8 'undefined' is not defined.")
+}
@@ -1,8 +1,11 @@
 package peg
 
 import (
+	"encoding/json"
 	"fmt"
 	"strconv"
+	"strings"
+	"unicode"
 )
 
 type Ast struct {
@@ -15,6 +18,12 @@ type Ast struct {
 	Nodes  []*Ast
 	Parent *Ast
 	Data   interface{}
+
+	// Trivia skipped by %whitespace around a leaf (CST only)
+	Leading  string
+	Trailing string
+
+	pos int
 }
 
 func (ast *Ast) String() string {
@@ -44,6 +53,93 @@ func astToS(ast *Ast, s string, level int) string {
 	return s
 }
 
+func astLabel(ast *Ast, pos bool) []string {
+	lines := []string{ast.Name}
+	if len(ast.Token) > 0 {
+		lines = append(lines, strconv.Quote(ast.Token))
+	}
+	if pos {
+		lines = append(lines, fmt.Sprintf("%d:%d", ast.Ln, ast.Col))
+	}
+	return lines
+}
+
+// Dot returns the tree in Graphviz DOT. pos adds line and column to labels.
+func (ast *Ast) Dot(pos bool) string {
+	esc := strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+	var b strings.Builder
+	b.WriteString("digraph AST {\n  node [shape=box];\n")
+	id := 0
+	var write func(ast *Ast) int
+	write = func(ast *Ast) int {
+		n := id
+		id++
+		lines := astLabel(ast, pos)
+		for i, line := range lines {
+			lines[i] = esc.Replace(line)
+		}
+		fmt.Fprintf(&b, "  n%d [label=\"%s\"];\n", n, strings.Join(lines, `\n`))
+		for _, node := range ast.Nodes {
+			fmt.Fprintf(&b, "  n%d -> n%d;\n", n, write(node))
+		}
+		return n
+	}
+	write(ast)
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// Mermaid returns the tree as a Mermaid flowchart. pos adds line and column
+// to labels.
+func (ast *Ast) Mermaid(pos bool) string {
+	esc := strings.NewReplacer("#", "#35;", `"`, "#quot;", "<", "#lt;", ">", "#gt;")
+	var b strings.Builder
+	b.WriteString("flowchart TD\n")
+	id := 0
+	var write func(ast *Ast) int
+	write = func(ast *Ast) int {
+		n := id
+		id++
+		lines := astLabel(ast, pos)
+		for i, line := range lines {
+			lines[i] = esc.Replace(line)
+		}
+		fmt.Fprintf(&b, "  n%d[\"%s\"]\n", n, strings.Join(lines, "<br>"))
+		for _, node := range ast.Nodes {
+			fmt.Fprintf(&b, "  n%d --> n%d\n", n, write(node))
+		}
+		return n
+	}
+	write(ast)
+	return b.String()
+}
+
+type astJSON struct {
+	Name  string     `json:"name"`
+	Token string     `json:"token,omitempty"`
+	Ln    int        `json:"ln"`
+	Col   int        `json:"col"`
+	Nodes []*astJSON `json:"nodes,omitempty"`
+}
+
+func newAstJSON(ast *Ast) *astJSON {
+	j := &astJSON{Name: ast.Name, Token: ast.Token, Ln: ast.Ln, Col: ast.Col}
+	for _, node := range ast.Nodes {
+		j.Nodes = append(j.Nodes, newAstJSON(node))
+	}
+	return j
+}
+
+// JSON returns the tree as indented JSON.
+func (ast *Ast) JSON() string {
+	var b strings.Builder
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	enc.Encode(newAstJSON(ast))
+	return b.String()
+}
+
 func (p *Parser) EnableAst() (err error) {
 	for name, rule := range p.Grammar {
 		nm := name
@@ -83,39 +179,156 @@ func (p *Parser) ParseAndGetAst(s string, d Any) (*Ast, error) {
 	return val.(*Ast), nil
 }
 
+// AST optimization policy
+type AstPolicy int
+
+const (
+	AstDefault AstPolicy = iota // Collapse the node if it has only one child
+	AstKeep                     // Never collapse or drop the node
+	AstDrop                     // Remove the node and its children
+	AstFlatten                  // Replace the node with its children
+)
+
 type AstOptimizer struct {
-	exceptions []string
+	policies        map[string]AstPolicy
+	renames         map[string]string
+	merges          map[string]bool
+	dropPunctuation bool
 }
 
 func NewAstOptimizer(exceptions []string) *AstOptimizer {
-	return &AstOptimizer{exceptions}
+	o := &AstOptimizer{
+		policies: make(map[string]AstPolicy),
+		renames:  make(map[string]string),
+		merges:   make(map[string]bool),
+	}
+	for _, name := range exceptions {
+		o.policies[name] = AstKeep
+	}
+	return o
+}
+
+// SetPolicy sets the policy for nodes of the named rules.
+func (o *AstOptimizer) SetPolicy(policy AstPolicy, names ...string) *AstOptimizer {
+	for _, name := range names {
+		o.policies[name] = policy
+	}
+	return o
+}
+
+// Rename renames nodes of the rule from to to.
+func (o *AstOptimizer) Rename(from string, to string) *AstOptimizer {
+	o.renames[from] = to
+	return o
+}
+
+// MergeTokens merges adjacent leaf nodes of the same named rule into one
+// node, concatenating their tokens.
+func (o *AstOptimizer) MergeTokens(names ...string) *AstOptimizer {
+	for _, name := range names {
+		o.merges[name] = true
+	}
+	return o
+}
+
+// DropPunctuation makes the optimizer drop leaf nodes whose token has no
+// letters or digits, such as '(' or ';'. Nodes with AstKeep are retained.
+func (o *AstOptimizer) DropPunctuation(drop bool) *AstOptimizer {
+	o.dropPunctuation = drop
+	return o
+}
+
+func (o *AstOptimizer) clone() *AstOptimizer {
+	c := NewAstOptimizer(nil)
+	for name, policy := range o.policies {
+		c.policies[name] = policy
+	}
+	for from, to := range o.renames {
+		c.renames[from] = to
+	}
+	for name := range o.merges {
+		c.merges[name] = true
+	}
+	c.dropPunctuation = o.dropPunctuation
+	return c
 }
 
 func (o *AstOptimizer) Optimize(org *Ast, par *Ast) *Ast {
-	opt := true
-	for _, name := range o.exceptions {
-		if name == org.Name {
-			opt = false
+	nodes := o.optimize(org, par)
+	if len(nodes) == 1 {
+		return nodes[0]
+	}
+	// The root is never dropped or flattened
+	return o.build(org, par, o.optimizeNodes(org.Nodes))
+}
+
+func (o *AstOptimizer) optimize(org *Ast, par *Ast) []*Ast {
+	policy := o.policies[org.Name]
+	switch policy {
+	case AstDrop:
+		return nil
+	case AstFlatten:
+		nodes := o.optimizeNodes(org.Nodes)
+		for _, node := range nodes {
+			node.Parent = par
 		}
+		return nodes
+	}
+
+	if policy != AstKeep && o.dropPunctuation && len(org.Nodes) == 0 && isPunctuation(org.Token) {
+		return nil
 	}
 
-	if opt && len(org.Nodes) == 1 {
-		chl := o.Optimize(org.Nodes[0], par)
-		return chl
+	nodes := o.optimizeNodes(org.Nodes)
+	if policy != AstKeep && len(nodes) == 1 {
+		nodes[0].Parent = par
+		return nodes
 	}
+	return []*Ast{o.build(org, par, nodes)}
+}
 
+func (o *AstOptimizer) optimizeNodes(orgs []*Ast) (nodes []*Ast) {
+	for _, org := range orgs {
+		for _, node := range o.optimize(org, nil) {
+			n := len(nodes)
+			if n > 0 && o.merges[node.Name] && node.Name == nodes[n-1].Name &&
+				len(node.Nodes) == 0 && len(nodes[n-1].Nodes) == 0 {
+				nodes[n-1].Token += node.Token
+				nodes[n-1].S += node.S
+				continue
+			}
+			nodes = append(nodes, node)
+		}
+	}
+	return
+}
+
+func (o *AstOptimizer) build(org *Ast, par *Ast, nodes []*Ast) *Ast {
+	name := org.Name
+	if to, ok := o.renames[name]; ok {
+		name = to
+	}
 	ast := &Ast{
 		Ln:     org.Ln,
 		Col:    org.Col,
 		S:      org.S,
-		Name:   org.Name,
+		Name:   name,
 		Token:  org.Token,
+		Nodes:  nodes,
 		Parent: par,
 		Data:   org.Data,
 	}
-	for _, node := range org.Nodes {
-		chl := o.Optimize(node, ast)
-		ast.Nodes = append(ast.Nodes, chl)
+	for _, node := range nodes {
+		node.Parent = ast
 	}
 	return ast
 }
+
+func isPunctuation(tok string) bool {
+	for _, r := range tok {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,84 @@
+package peg
+
+import "testing"
+
+func TestAstDot(t *testing.T) {
+	parser, _ := NewParser(`
+		ROOT   <- ITEM+
+		ITEM   <- < (!',' .)+ > ','
+	`)
+	parser.EnableAst()
+	ast, err := parser.ParseAndGetAst("a\"b\\,<#>,", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `digraph AST {
+  node [shape=box];
+  n0 [label="ROOT\n1:1"];
+  n1 [label="ITEM\n\"a\\\"b\\\\\"\n1:1"];
+  n0 -> n1;
+  n2 [label="ITEM\n\"<#>\"\n1:6"];
+  n0 -> n2;
+}
+`
+	if got := ast.Dot(true); got != want {
+		t.Errorf("want:\n%s\ngot:\n%s", want, got)
+	}
+}
+
+func TestAstMermaid(t *testing.T) {
+	parser, _ := NewParser(`
+		ROOT   <- ITEM+
+		ITEM   <- < (!',' .)+ > ','
+	`)
+	parser.EnableAst()
+	ast, err := parser.ParseAndGetAst("a\"b\\,<#>,", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `flowchart TD
+  n0["ROOT"]
+  n1["ITEM<br>#quot;a\#quot;b\\#quot;"]
+  n0 --> n1
+  n2["ITEM<br>#quot;#lt;#35;#gt;#quot;"]
+  n0 --> n2
+`
+	if got := ast.Mermaid(false); got != want {
+		t.Errorf("want:\n%s\ngot:\n%s", want, got)
+	}
+}
+
+func TestAstJSON(t *testing.T) {
+	parser, _ := NewParser(`
+		ROOT   <- ITEM+
+		ITEM   <- < (!',' .)+ > ','
+	`)
+	parser.EnableAst()
+	ast, err := parser.ParseAndGetAst("a\"b\\,<#>,", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{
+  "name": "ROOT",
+  "ln": 1,
+  "col": 1,
+  "nodes": [
+    {
+      "name": "ITEM",
+      "token": "a\"b\\",
+      "ln": 1,
+      "col": 1
+    },
+    {
+      "name": "ITEM",
+      "token": "<#>",
+      "ln": 1,
+      "col": 6
+    }
+  ]
+}
+`
+	if got := ast.JSON(); got != want {
+		t.Errorf("want:\n%s\ngot:\n%s", want, got)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/yhirose/go-peg"
+)
+
+var usageMessage = `usage: pegfmt [-w] [-d] [-arrow arrow] [path ...]
+
+pegfmt formats PEG grammar files in the canonical form. Without paths, it formats standard input.
+
+By default, pegfmt prints the formatted grammars on standard output.
+
+The -w flag writes the result back to the files instead.
+
+The -d flag prints diffs between the files and the formatted grammars instead.
+
+The -arrow 'arrow' specifies the arrow of definitions: <- (default) or ←.
+`
+
+func usage() {
+	fmt.Fprint(os.Stderr, usageMessage)
+	os.Exit(2)
+}
+
+var (
+	writeFlag = flag.Bool("w", false, "write result to the files")
+	diffFlag  = flag.Bool("d", false, "display diffs")
+	arrow     = flag.String("arrow", "<-", "arrow of definitions")
+)
+
+var exitCode = 0
+
+func report(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	exitCode = 1
+}
+
+func process(pr *peg.GrammarPrinter, path string, src []byte) error {
+	res, err := pr.Format(string(src))
+	if err != nil {
+		if perr, ok := err.(*peg.Error); ok {
+			for _, d := range perr.Details {
+				report(fmt.Errorf("%s:%s", path, d))
+			}
+			return nil
+		}
+		return err
+	}
+
+	switch {
+	case *diffFlag:
+		fmt.Print(diff(path, string(src), res))
+	case *writeFlag:
+		if res != string(src) {
+			// Keep the permissions of the file as gofmt does
+			fi, err := os.Stat(path)
+			if err != nil {
+				return err
+			}
+			return ioutil.WriteFile(path, []byte(res), fi.Mode().Perm())
+		}
+	default:
+		fmt.Print(res)
+	}
+	return nil
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+
+	if *arrow != "<-" && *arrow != "←" {
+		usage()
+	}
+	pr := peg.NewGrammarPrinter()
+	pr.Arrow = *arrow
+
+	if flag.NArg() == 0 {
+		if *writeFlag {
+			fmt.Fprintln(os.Stderr, "pegfmt: cannot use -w with standard input")
+			os.Exit(2)
+		}
+		src, err := ioutil.ReadAll(os.Stdin)
+		if err == nil {
+			err = process(pr, "<standard input>", src)
+		}
+		if err != nil {
+			report(err)
+		}
+		os.Exit(exitCode)
+	}
+
+	for _, path := range flag.Args() {
+		src, err := ioutil.ReadFile(path)
+		if err == nil {
+			err = process(pr, path, src)
+		}
+		if err != nil {
+			report(err)
+		}
+	}
+	os.Exit(exitCode)
+}
@@ -5,18 +5,33 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"runtime/pprof"
 
 	"github.com/yhirose/go-peg"
 )
 
-var usageMessage = `usage: peglint [-ast] [-opt] [-trace] [-f path] [-s string] [grammar path]
+var usageMessage = `usage: peglint [-syntax syntax] [-fmt] [-export dialect] [-railroad] [-ast] [-opt] [-ast-format format] [-pos] [-diff path] [-trace] [-f path] [-s string] [grammar path]
 
-peglint checks syntax of a given PEG grammar file and reports errors. If the check is successful and a user gives a source file for the grammar, it will also check syntax of the source file.
+peglint checks syntax of a given PEG grammar file and reports errors. It also prints warnings about likely mistakes in the grammar, such as unreachable rules and alternatives which never match, on standard error. If the check is successful and a user gives a source file for the grammar, it will also check syntax of the source file.
+
+The -syntax 'syntax' specifies the notation of the grammar file: peg (default), abnf, ebnf or pegjs (PEG.js and pigeon). Grammars imported with %import are read from the directory of the grammar file.
+
+The -fmt flag prints the grammar in the canonical form instead. See also pegfmt. With -syntax, it prints the grammar translated to PEG.
+
+The -export 'dialect' prints the grammar in the syntax of another PEG library instead: cpp-peglib, pegjs (PEG.js and Peggy) or pigeon.
+
+The -railroad flag prints an HTML page with railroad diagrams of the rules in the grammar instead.
 
 The -ast flag prints the AST (abstract syntax tree) of the source file.
 
-The -opt flag prints the optimized AST (abstract syntax tree) of the source file.
+The -opt flag prints the optimized AST (abstract syntax tree) of the source file. It follows the %ast_* options in the grammar.
+
+The -ast-format 'format' specifies how -ast and -opt print the AST: text (default), dot (Graphviz), mermaid or json.
+
+The -pos flag adds line and column numbers to the dot and mermaid output.
+
+The -diff 'path' parses the file at path as well as the source text, and prints the differences between their ASTs (optimized with -opt) ignoring positions. '+', '-' and '~' mark inserted, deleted and changed nodes. peglint exits with status 1 if they differ.
 
 The -trace flag can be used with the source file. It prints names of rules and operators that the PEG parser detects on standard error.
 
@@ -26,13 +41,20 @@ The -s 'string' specifies the source text.
 `
 
 func usage() {
-	fmt.Fprintf(os.Stderr, usageMessage)
+	fmt.Fprint(os.Stderr, usageMessage)
 	os.Exit(1)
 }
 
 var (
+	syntaxFlag     = flag.String("syntax", "peg", "grammar syntax (peg, abnf, ebnf or pegjs)")
+	fmtFlag        = flag.Bool("fmt", false, "print formatted grammar")
+	exportDialect  = flag.String("export", "", "print grammar for cpp-peglib, pegjs or pigeon")
+	railroadFlag   = flag.Bool("railroad", false, "print railroad diagrams")
 	astFlag        = flag.Bool("ast", false, "show ast")
 	optFlag        = flag.Bool("opt", false, "show optimized ast")
+	astFormat      = flag.String("ast-format", "text", "ast format (text, dot, mermaid or json)")
+	posFlag        = flag.Bool("pos", false, "show line and column numbers in dot and mermaid")
+	diffPath       = flag.String("diff", "", "file path to diff the ast with")
 	traceFlag      = flag.Bool("trace", false, "show trace message")
 	sourceFilePath = flag.String("f", "", "source file path")
 	sourceString   = flag.String("s", "", "source string")
@@ -55,6 +77,19 @@ func pcheck(err error) {
 	}
 }
 
+func printAst(ast *peg.Ast) {
+	switch *astFormat {
+	case "dot":
+		fmt.Print(ast.Dot(*posFlag))
+	case "mermaid":
+		fmt.Print(ast.Mermaid(*posFlag))
+	case "json":
+		fmt.Print(ast.JSON())
+	default:
+		fmt.Println(ast)
+	}
+}
+
 func SetupTracer(p *peg.Parser) {
 	indent := func(level int) string {
 		s := ""
@@ -95,11 +130,78 @@ func main() {
 		usage()
 	}
 
+	switch *astFormat {
+	case "text", "dot", "mermaid", "json":
+	default:
+		usage()
+	}
+
+	var export func(*peg.Parser) (string, error)
+	switch *exportDialect {
+	case "":
+	case "cpp-peglib":
+		export = peg.ExportCppPeglib
+	case "pegjs":
+		export = peg.ExportPEGjs
+	case "pigeon":
+		export = peg.ExportPigeon
+	default:
+		usage()
+	}
+
+	var newParser func(string) (*peg.Parser, error)
+	switch *syntaxFlag {
+	case "peg":
+	case "abnf":
+		newParser = peg.NewParserFromABNF
+	case "ebnf":
+		newParser = peg.NewParserFromEBNF
+	case "pegjs":
+		newParser = peg.NewParserFromPEGjs
+	default:
+		usage()
+	}
+
 	dat, err := ioutil.ReadFile(args[0])
 	check(err)
 
-	parser, err := peg.NewParser(string(dat))
+	if *fmtFlag && *syntaxFlag == "peg" {
+		res, err := peg.FormatGrammar(string(dat))
+		pcheck(err)
+		fmt.Print(res)
+		return
+	}
+
+	var parser *peg.Parser
+	if newParser != nil {
+		parser, err = newParser(string(dat))
+	} else {
+		// Grammars are imported from the directory of the grammar file
+		parser, err = peg.NewParserFromFS(os.DirFS(filepath.Dir(args[0])), filepath.Base(args[0]))
+	}
 	pcheck(err)
+	check(err)
+
+	for _, w := range parser.Lint() {
+		fmt.Fprintln(os.Stderr, w)
+	}
+
+	if *fmtFlag {
+		fmt.Print(peg.NewGrammarPrinter().Print(parser))
+		return
+	}
+
+	if export != nil {
+		res, err := export(parser)
+		pcheck(err)
+		fmt.Print(res)
+		return
+	}
+
+	if *railroadFlag {
+		fmt.Print(peg.NewRailroad(parser).HTML())
+		return
+	}
 
 	var source string
 
@@ -124,10 +226,15 @@ func main() {
 			SetupTracer(parser)
 		}
 
-		if *astFlag || *optFlag {
+		if *astFlag || *optFlag || *diffPath != "" {
 			parser.EnableAst()
 		}
 
+		// Semantic predicates can't be checked without the code
+		for _, name := range parser.Predicates() {
+			parser.SetPredicate(name, func(*peg.Values, int, peg.Any) bool { return true })
+		}
+
 		if *profPath != "" {
 			f, err := os.Create(*profPath)
 			check(err)
@@ -138,13 +245,35 @@ func main() {
 		val, err := parser.ParseAndGetValue(source, nil)
 		pcheck(err)
 
+		if *diffPath != "" {
+			dat, err := ioutil.ReadFile(*diffPath)
+			check(err)
+			other, err := parser.ParseAndGetAst(string(dat), nil)
+			pcheck(err)
+
+			ast := val.(*peg.Ast)
+			if *optFlag {
+				opt := parser.AstOptimizer()
+				ast = opt.Optimize(ast, nil)
+				other = opt.Optimize(other, nil)
+			}
+			diffs := peg.AstCompare{IgnorePos: true}.Diff(ast, other)
+			for _, d := range diffs {
+				fmt.Println(d)
+			}
+			if len(diffs) > 0 {
+				os.Exit(1)
+			}
+			return
+		}
+
 		if *astFlag || *optFlag {
 			ast := val.(*peg.Ast)
 			if *optFlag {
-				opt := peg.NewAstOptimizer(nil)
+				opt := parser.AstOptimizer()
 				ast = opt.Optimize(ast, nil)
 			}
-			fmt.Println(ast)
+			printAst(ast)
 		}
 	}
 }
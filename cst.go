@@ -0,0 +1,151 @@
+package peg
+
+import "strings"
+
+// Concrete syntax tree
+//
+// ParseAndGetCst returns a lossless tree in which every rule that matched
+// has a node, including rules and expressions ignored with '~'. Text that a
+// rule matches outside of its sub-rules, such as literals, becomes a leaf
+// named "%text". A node without sub-rules is a leaf whose Token is the
+// matched text. Text skipped by %whitespace is kept in Leading and Trailing
+// of the adjacent leaf, so Text() of the root reproduces the input.
+
+// ParseAndGetCst parses s and returns its concrete syntax tree. Semantic
+// actions are invoked as with ParseAndGetValue.
+func (p *Parser) ParseAndGetCst(s string, d Any) (*Ast, error) {
+	r, c, err := p.entry(p.start, true)
+	if err != nil {
+		return nil, err
+	}
+	_, v, err := r.parseWith(s, d, c)
+	if err != nil {
+		return nil, err
+	}
+
+	var root *Ast
+	leading := ""
+	for _, node := range v.cs {
+		if node.Name == WhitespceRuleName {
+			leading += node.S
+		} else {
+			root = node
+		}
+	}
+	if root == nil {
+		root = &Ast{Ln: 1, Col: 1, Name: r.Name}
+	}
+	if len(leading) > 0 {
+		first := firstCstLeaf(root)
+		first.Leading = leading + first.Leading
+	}
+	return root, nil
+}
+
+// Text returns the source text of a tree from ParseAndGetCst by
+// concatenating the leaves with their trivia.
+func (ast *Ast) Text() string {
+	var b strings.Builder
+	ast.writeText(&b)
+	return b.String()
+}
+
+func (ast *Ast) writeText(b *strings.Builder) {
+	if len(ast.Nodes) == 0 {
+		b.WriteString(ast.Leading)
+		b.WriteString(ast.Token)
+		b.WriteString(ast.Trailing)
+		return
+	}
+	for _, node := range ast.Nodes {
+		node.writeText(b)
+	}
+}
+
+func newCstNode(name string, s string, p int, l int, children []*Ast) *Ast {
+	ln, col := lineInfo(s, p)
+	ast := &Ast{Ln: ln, Col: col, S: s[p : p+l], Name: name, pos: p}
+
+	hasRule := false
+	for _, node := range children {
+		if node.Name != WhitespceRuleName {
+			hasRule = true
+			break
+		}
+	}
+
+	// Leaf
+	if !hasRule {
+		start, end := p, p+l
+		i := 0
+		for i < len(children) && children[i].pos == start {
+			start += len(children[i].S)
+			i++
+		}
+		for j := len(children); j > i && children[j-1].pos+len(children[j-1].S) == end; j-- {
+			end -= len(children[j-1].S)
+		}
+		ast.Leading = s[p:start]
+		ast.Token = s[start:end]
+		ast.Trailing = s[end : p+l]
+		return ast
+	}
+
+	// Fill gaps between children with text nodes
+	var pieces []*Ast
+	cur := p
+	for _, node := range children {
+		if node.pos < cur {
+			continue
+		}
+		if node.pos > cur {
+			pieces = append(pieces, newCstText(s, cur, node.pos))
+		}
+		pieces = append(pieces, node)
+		cur = node.pos + len(node.S)
+	}
+	if cur < p+l {
+		pieces = append(pieces, newCstText(s, cur, p+l))
+	}
+
+	// Attach whitespace to the neighboring leaves
+	pending := ""
+	for _, node := range pieces {
+		if node.Name == WhitespceRuleName {
+			if len(ast.Nodes) > 0 {
+				last := lastCstLeaf(ast.Nodes[len(ast.Nodes)-1])
+				last.Trailing += node.S
+			} else {
+				pending += node.S
+			}
+			continue
+		}
+		if len(pending) > 0 {
+			first := firstCstLeaf(node)
+			first.Leading = pending + first.Leading
+			pending = ""
+		}
+		node.Parent = ast
+		ast.Nodes = append(ast.Nodes, node)
+	}
+	return ast
+}
+
+func newCstText(s string, start int, end int) *Ast {
+	ln, col := lineInfo(s, start)
+	return &Ast{Ln: ln, Col: col, S: s[start:end], Name: CstTextName, Token: s[start:end], pos: start}
+}
+
+func firstCstLeaf(ast *Ast) *Ast {
+	for len(ast.Nodes) > 0 {
+		ast = ast.Nodes[0]
+	}
+	return ast
+}
+
+func lastCstLeaf(ast *Ast) *Ast {
+	for len(ast.Nodes) > 0 {
+		ast = ast.Nodes[len(ast.Nodes)-1]
+	}
+	return ast
+}
@@ -0,0 +1,50 @@
+package peg
+
+import "testing"
+
+func TestCstRoundTrip(t *testing.T) {
+	parser, err := NewParser(`
+		PROGRAM     <- STATEMENT*
+		STATEMENT   <- ~LET NAME '=' EXPR ';'
+		EXPR        <- ATOM (BINOP ATOM)*
+		ATOM        <- NUMBER / NAME / '(' EXPR ')'
+		BINOP       <- < [-+*/] >
+		LET         <- 'let'
+		NAME        <- < [a-z]+ >
+		NUMBER      <- < [0-9]+ >
+		%whitespace <- ([ \t\r\n] / '#' (!'\n' .)*)*
+		---
+		%expr  = EXPR
+		%binop = L + -
+		%binop = L * /
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inputs := []string{
+		"",
+		"let a = 1;",
+		"  # header\nlet x=(1 + 2)*3 ;  # trailing\n\tlet y = x / 4;\n",
+	}
+	for _, input := range inputs {
+		cst, err := parser.ParseAndGetCst(input, nil)
+		if err != nil {
+			t.Errorf("%q: %v", input, err)
+			continue
+		}
+		if got := cst.Text(); got != input {
+			t.Errorf("want %q, got %q", input, got)
+		}
+	}
+
+	cst, _ := parser.ParseAndGetCst("  # header\nlet x = 1; # one\n", nil)
+	stmt := cst.Nodes[0]
+	assert(t, stmt.Name == "STATEMENT")
+	let := stmt.Nodes[0]
+	assert(t, let.Name == "LET" && let.Token == "let" && let.Leading == "  # header\n" && let.Trailing == " ")
+	eq := stmt.Nodes[2]
+	assert(t, eq.Name == CstTextName && eq.Token == "=" && eq.Parent == stmt)
+	semi := stmt.Nodes[len(stmt.Nodes)-1]
+	assert(t, semi.Token == ";" && semi.Trailing == " # one\n")
+}
@@ -0,0 +1,249 @@
+package peg
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+var astPtrType = reflect.TypeOf((*Ast)(nil))
+
+// AstDecoder populates Go values from an Ast in the manner of encoding/json.
+// Struct fields select child nodes with the `peg` tag:
+//
+//	Name   string   `peg:"rule=IDENT"`    // token of the IDENT child
+//	Params []*Param `peg:"rule=PARAM"`    // every PARAM child
+//	Ret    *Type    `peg:"rule=TYPE"`     // optional TYPE child
+//	Body   Stmt     `peg:"rule=IF|WHILE"` // concrete type chosen by rule name
+//	Op     string   `peg:"token"`         // token of the node itself
+//	Node   *Ast     `peg:"rule=BLOCK"`    // the BLOCK node as is
+//
+// A field without a tag selects children whose name equals the field name,
+// ignoring case, and is left untouched if there is none. `peg:"-"` skips
+// the field. Children are consumed in the order of the fields, so two fields
+// with the same rule get the first and the second occurrence respectively.
+type AstDecoder struct {
+	types map[string]reflect.Type
+}
+
+func NewAstDecoder() *AstDecoder {
+	return &AstDecoder{types: make(map[string]reflect.Type)}
+}
+
+// Register sets the concrete type used when a node named name is decoded
+// into an interface field. v is a value of that type, e.g. &Call{}.
+func (dec *AstDecoder) Register(name string, v interface{}) {
+	dec.types[name] = reflect.TypeOf(v)
+}
+
+// Decode stores the contents of ast in the value pointed to by v.
+func (dec *AstDecoder) Decode(ast *Ast, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return fmt.Errorf("peg: decode requires a non-nil pointer, not %T", v)
+	}
+	return dec.decode(ast, rv.Elem())
+}
+
+// UnmarshalAst decodes ast into v with a decoder that has no registered types.
+func UnmarshalAst(ast *Ast, v interface{}) error {
+	return NewAstDecoder().Decode(ast, v)
+}
+
+func (dec *AstDecoder) decode(ast *Ast, rv reflect.Value) error {
+	if rv.Type() == astPtrType {
+		rv.Set(reflect.ValueOf(ast))
+		return nil
+	}
+
+	switch rv.Kind() {
+	case reflect.Ptr:
+		if rv.IsNil() {
+			rv.Set(reflect.New(rv.Type().Elem()))
+		}
+		return dec.decode(ast, rv.Elem())
+	case reflect.Interface:
+		t, ok := dec.types[ast.Name]
+		if !ok {
+			return decodeError(ast, "no type is registered for '%s'.", ast.Name)
+		}
+		if !t.AssignableTo(rv.Type()) {
+			return decodeError(ast, "%s for '%s' is not assignable to %s.", t, ast.Name, rv.Type())
+		}
+		nv := reflect.New(t).Elem()
+		if err := dec.decode(ast, nv); err != nil {
+			return err
+		}
+		rv.Set(nv)
+		return nil
+	case reflect.Struct:
+		return dec.decodeStruct(ast, rv)
+	case reflect.Slice:
+		rv.Set(reflect.MakeSlice(rv.Type(), 0, len(ast.Nodes)))
+		for _, node := range ast.Nodes {
+			ev := reflect.New(rv.Type().Elem()).Elem()
+			if err := dec.decode(node, ev); err != nil {
+				return err
+			}
+			rv.Set(reflect.Append(rv, ev))
+		}
+		return nil
+	}
+	return decodeToken(ast, rv)
+}
+
+// astTag
+type astTag struct {
+	skip  bool
+	token bool
+	rules []string
+	field string
+}
+
+func parseAstTag(f reflect.StructField) (tag astTag) {
+	s, ok := f.Tag.Lookup("peg")
+	if !ok {
+		tag.field = f.Name
+		return
+	}
+	for _, opt := range strings.Split(s, ",") {
+		switch {
+		case opt == "-":
+			tag.skip = true
+		case opt == "token":
+			tag.token = true
+		case strings.HasPrefix(opt, "rule="):
+			tag.rules = strings.Split(opt[len("rule="):], "|")
+		}
+	}
+	return
+}
+
+func (tag *astTag) match(ast *Ast) bool {
+	if len(tag.field) > 0 {
+		return strings.EqualFold(tag.field, ast.Name)
+	}
+	for _, name := range tag.rules {
+		if name == ast.Name {
+			return true
+		}
+	}
+	return false
+}
+
+func (dec *AstDecoder) decodeStruct(ast *Ast, rv reflect.Value) error {
+	t := rv.Type()
+	used := make([]bool, len(ast.Nodes))
+	var tags []astTag
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		tag := parseAstTag(f)
+		if tag.skip {
+			continue
+		}
+		fv := rv.Field(i)
+
+		if tag.token {
+			if err := decodeToken(ast, fv); err != nil {
+				return err
+			}
+			continue
+		}
+		tags = append(tags, tag)
+
+		if fv.Kind() == reflect.Slice {
+			fv.Set(reflect.Zero(fv.Type()))
+			for j, node := range ast.Nodes {
+				if used[j] || !tag.match(node) {
+					continue
+				}
+				used[j] = true
+				ev := reflect.New(fv.Type().Elem()).Elem()
+				if err := dec.decode(node, ev); err != nil {
+					return err
+				}
+				fv.Set(reflect.Append(fv, ev))
+			}
+			continue
+		}
+
+		found := false
+		for j, node := range ast.Nodes {
+			if used[j] || !tag.match(node) {
+				continue
+			}
+			used[j] = true
+			found = true
+			if err := dec.decode(node, fv); err != nil {
+				return err
+			}
+			break
+		}
+		if !found && len(tag.rules) > 0 && fv.Kind() != reflect.Ptr && fv.Kind() != reflect.Interface {
+			return decodeError(ast, "'%s' has no node for field '%s'.", ast.Name, f.Name)
+		}
+	}
+
+	// Nodes selected by a field, but left over
+	for j, node := range ast.Nodes {
+		if used[j] {
+			continue
+		}
+		for _, tag := range tags {
+			if tag.match(node) {
+				return decodeError(node, "unexpected '%s' in '%s'.", node.Name, ast.Name)
+			}
+		}
+	}
+	return nil
+}
+
+func decodeToken(ast *Ast, rv reflect.Value) error {
+	tok := ast.Token
+	if len(ast.Nodes) > 0 && len(tok) == 0 {
+		return decodeError(ast, "'%s' has no token to decode into %s.", ast.Name, rv.Type())
+	}
+
+	var err error
+	switch rv.Kind() {
+	case reflect.String:
+		rv.SetString(tok)
+	case reflect.Bool:
+		var b bool
+		if b, err = strconv.ParseBool(tok); err == nil {
+			rv.SetBool(b)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		var n int64
+		if n, err = strconv.ParseInt(tok, 0, rv.Type().Bits()); err == nil {
+			rv.SetInt(n)
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		var n uint64
+		if n, err = strconv.ParseUint(tok, 0, rv.Type().Bits()); err == nil {
+			rv.SetUint(n)
+		}
+	case reflect.Float32, reflect.Float64:
+		var f float64
+		if f, err = strconv.ParseFloat(tok, rv.Type().Bits()); err == nil {
+			rv.SetFloat(f)
+		}
+	default:
+		return decodeError(ast, "cannot decode '%s' into %s.", ast.Name, rv.Type())
+	}
+
+	if err != nil {
+		return decodeError(ast, "cannot decode '%s' %q into %s.", ast.Name, tok, rv.Type())
+	}
+	return nil
+}
+
+func decodeError(ast *Ast, format string, args ...interface{}) error {
+	msg := fmt.Sprintf(format, args...)
+	return &Error{Details: []ErrorDetail{{ast.Ln, ast.Col, msg}}}
+}
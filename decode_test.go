@@ -0,0 +1,109 @@
+package peg
+
+import "testing"
+
+type decodeExpr interface{}
+
+type decodeNumber struct {
+	Value int `peg:"token"`
+}
+
+type decodeCall struct {
+	Name string       `peg:"rule=IDENT"`
+	Args []decodeExpr `peg:"rule=NUMBER|CALL"`
+}
+
+type decodeParam struct {
+	Name string `peg:"rule=IDENT"`
+	Type *string
+}
+
+type decodeFunction struct {
+	Name   string         `peg:"rule=IDENT"`
+	Params []*decodeParam `peg:"rule=PARAM"`
+	Body   []decodeExpr   `peg:"rule=NUMBER|CALL"`
+	Node   *Ast           `peg:"-"`
+}
+
+func TestDecodeAst(t *testing.T) {
+	parser, err := NewParser(`
+		FUNCTION  <- 'func' IDENT '(' (PARAM (',' PARAM)*)? ')' '{' (EXPR ';')* '}'
+		PARAM     <- IDENT TYPE?
+		EXPR      <- CALL / NUMBER
+		CALL      <- IDENT '(' (EXPR (',' EXPR)*)? ')'
+		TYPE      <- < 'int' / 'string' >
+		IDENT     <- < [a-z]+ >
+		NUMBER    <- < [0-9]+ >
+		%whitespace <- [ \t\r\n]*
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parser.EnableAst()
+	ast, err := parser.ParseAndGetAst("func add(a int, b) { 1; add(2, sub(3)); }", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ast = NewAstOptimizer([]string{"PARAM", "CALL"}).Optimize(ast, nil)
+
+	dec := NewAstDecoder()
+	dec.Register("NUMBER", &decodeNumber{})
+	dec.Register("CALL", &decodeCall{})
+
+	var fn decodeFunction
+	if err := dec.Decode(ast, &fn); err != nil {
+		t.Fatal(err)
+	}
+
+	assert(t, fn.Name == "add")
+	assert(t, len(fn.Params) == 2)
+	assert(t, fn.Params[0].Name == "a" && *fn.Params[0].Type == "int")
+	assert(t, fn.Params[1].Name == "b" && fn.Params[1].Type == nil)
+	assert(t, len(fn.Body) == 2)
+	assert(t, fn.Body[0].(*decodeNumber).Value == 1)
+	call := fn.Body[1].(*decodeCall)
+	assert(t, call.Name == "add" && len(call.Args) == 2)
+	assert(t, call.Args[1].(*decodeCall).Name == "sub")
+}
+
+func TestDecodeAstErrors(t *testing.T) {
+	parser, err := NewParser(`
+		FUNCTION  <- 'func' IDENT '(' (PARAM (',' PARAM)*)? ')' '{' (EXPR ';')* '}'
+		PARAM     <- IDENT TYPE?
+		EXPR      <- CALL / NUMBER
+		CALL      <- IDENT '(' (EXPR (',' EXPR)*)? ')'
+		TYPE      <- < 'int' / 'string' >
+		IDENT     <- < [a-z]+ >
+		NUMBER    <- < [0-9]+ >
+		%whitespace <- [ \t\r\n]*
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parser.EnableAst()
+	ast, _ := parser.ParseAndGetAst("func f() {\n  g(1);\n}", nil)
+	ast = NewAstOptimizer([]string{"CALL"}).Optimize(ast, nil)
+
+	var fn decodeFunction
+	err = UnmarshalAst(ast, &fn)
+	assert(t, err != nil)
+	assert(t, err.Error() == "2:3 no type is registered for 'CALL'.")
+
+	var num struct {
+		Value int `peg:"rule=IDENT"`
+	}
+	err = UnmarshalAst(ast, &num)
+	assert(t, err != nil)
+	assert(t, err.Error() == "1:6 cannot decode 'IDENT' \"f\" into int.")
+
+	var missing struct {
+		Params []decodeParam `peg:"rule=PARAM"`
+		Type   string        `peg:"rule=TYPE"`
+	}
+	err = UnmarshalAst(ast, &missing)
+	assert(t, err != nil)
+	assert(t, err.Error() == "1:1 'FUNCTION' has no node for field 'Type'.")
+
+	err = UnmarshalAst(ast, fn)
+	assert(t, err != nil)
+}
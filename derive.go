@@ -0,0 +1,206 @@
+package peg
+
+// superName is the name which refers to the rule of the base grammar in a
+// derived grammar.
+const superName = "super"
+
+// NewParserWithBase makes a parser from the grammar s, which derives from the
+// grammar base. A rule in s overrides the rule with the same name in base,
+// and 'super' in it matches the rule of base, so 'A <- 'x' / super' adds an
+// alternative to A. The rules of base refer to the overriding rules.
+//
+// An option in s replaces all the values of the option in base. The start
+// rule is the one of base unless s has '%start'. The base grammar is checked
+// on its own first, and its errors are returned as they are. Errors of the
+// derived grammar are returned together, with the positions in the grammar
+// each rule comes from.
+func NewParserWithBase(base string, s string) (*Parser, error) {
+	if _, err := NewParser(base); err != nil {
+		return nil, err
+	}
+	// Parse again, since checking links the rules
+	bdata := newData()
+	rStart.Parse(base, bdata)
+
+	data := newData()
+	if _, _, err := rStart.Parse(s, data); err != nil {
+		return nil, err
+	}
+
+	if len(data.imports) > 0 {
+		imp := data.imports[0]
+		ln, col := lineInfo(s, imp.pos)
+		msg := "'" + imp.path + "' can't be imported without a file system."
+		return nil, &Error{Details: []ErrorDetail{{ln, col, msg}}}
+	}
+
+	err := deriveGrammar(bdata, data, base, s)
+	p, perr := newParserFromData(s, bdata)
+	if err != nil {
+		if perr != nil {
+			err.(*Error).Details = append(err.(*Error).Details, perr.(*Error).Details...)
+		}
+		return nil, err
+	}
+	return p, perr
+}
+
+// deriveGrammar puts the rules and the options of the derived grammar into
+// base. bs and s are the sources of the grammars.
+func deriveGrammar(base, derived *data, bs, s string) (err error) {
+	addError := func(pos int, msg string) {
+		if err == nil {
+			err = &Error{}
+		}
+		ln, col := lineInfo(s, pos)
+		err.(*Error).Details = append(err.(*Error).Details, ErrorDetail{ln, col, msg})
+	}
+
+	overridden := make(map[*Rule]bool)
+	for _, def := range derived.definitions {
+		r := def.rule
+		b := base.grammar[r.Name]
+		v := &superReplacer{rule: r, base: b, pos: -1}
+		r.Ope = v.replace(r.Ope)
+		switch {
+		case v.pos == -1:
+		case b == nil:
+			addError(v.pos, "'"+r.Name+"' isn't defined in the base grammar, so 'super' can't be used.")
+		case len(b.Parameters) != len(r.Parameters) || (b.Parameters == nil) != (r.Parameters == nil):
+			addError(v.pos, "'"+r.Name+"' has parameters different from the base rule, so 'super' can't be used.")
+		}
+
+		if b != nil {
+			overridden[b] = true
+			// The expression may be put in r by 'super', but its positions
+			// are in the base grammar
+			(&positionRemover{positions: base.positions}).remove(b.Ope)
+		}
+		base.grammar[r.Name] = r
+	}
+	base.duplicates = derived.duplicates
+
+	var definitions []definition
+	for _, def := range base.definitions {
+		if !overridden[def.rule] {
+			definitions = append(definitions, def)
+		}
+	}
+	base.definitions = append(definitions, derived.definitions...)
+
+	var optionList []grammarOption
+	for _, opt := range base.optionList {
+		if _, ok := derived.options[opt.name]; !ok {
+			optionList = append(optionList, opt)
+			base.optionSS[opt.name] = bs
+		}
+	}
+	base.optionList = append(optionList, derived.optionList...)
+	for name, vals := range derived.options {
+		base.options[name] = vals
+		base.optionPos[name] = derived.optionPos[name]
+	}
+
+	for ope, pos := range derived.positions {
+		base.positions[ope] = pos
+	}
+	return
+}
+
+// superReplacer replaces 'super' in the rule with the expression of the base
+// rule.
+type superReplacer struct {
+	*visitorBase
+	rule *Rule
+	base *Rule
+	pos  int // Position of the first 'super', or -1
+}
+
+func (v *superReplacer) replace(ope operator) operator {
+	if ref, ok := ope.(*reference); ok && ref.name == superName && ref.args == nil {
+		if v.pos == -1 {
+			v.pos = ref.pos
+		}
+		// 'super' which can't be used never matches, so that the rest of
+		// the grammar is checked
+		if v.base == nil || len(v.base.Parameters) != len(v.rule.Parameters) ||
+			(v.base.Parameters == nil) != (v.rule.Parameters == nil) {
+			return Cls("")
+		}
+		// The parameters of the base rule may have other names
+		if len(v.base.Parameters) > 0 {
+			params := v.base.Parameters
+			v.base.Ope.accept(&renameReferences{rename: func(name string) string {
+				for i, param := range params {
+					if param == name {
+						return v.rule.Parameters[i]
+					}
+				}
+				return name
+			}})
+			v.base.Parameters = v.rule.Parameters
+		}
+		return v.base.Ope
+	}
+	ope.accept(v)
+	return ope
+}
+
+func (v *superReplacer) visitSequence(ope *sequence) {
+	for i, o := range ope.opes {
+		ope.opes[i] = v.replace(o)
+	}
+}
+func (v *superReplacer) visitPrioritizedChoice(ope *prioritizedChoice) {
+	for i, o := range ope.opes {
+		ope.opes[i] = v.replace(o)
+	}
+}
+func (v *superReplacer) visitZeroOrMore(ope *zeroOrMore)       { ope.ope = v.replace(ope.ope) }
+func (v *superReplacer) visitOneOrMore(ope *oneOrMore)         { ope.ope = v.replace(ope.ope) }
+func (v *superReplacer) visitRepetition(ope *repetition)       { ope.ope = v.replace(ope.ope) }
+func (v *superReplacer) visitOption(ope *option)               { ope.ope = v.replace(ope.ope) }
+func (v *superReplacer) visitAndPredicate(ope *andPredicate)   { ope.ope = v.replace(ope.ope) }
+func (v *superReplacer) visitNotPredicate(ope *notPredicate)   { ope.ope = v.replace(ope.ope) }
+func (v *superReplacer) visitTokenBoundary(ope *tokenBoundary) { ope.ope = v.replace(ope.ope) }
+func (v *superReplacer) visitIgnore(ope *ignore)               { ope.ope = v.replace(ope.ope) }
+func (v *superReplacer) visitReference(ope *reference) {
+	for i, arg := range ope.args {
+		ope.args[i] = v.replace(arg)
+	}
+}
+
+// positionRemover removes the positions of the expressions.
+type positionRemover struct {
+	*visitorBase
+	positions map[operator]int
+}
+
+func (v *positionRemover) remove(ope operator) {
+	delete(v.positions, ope)
+	ope.accept(v)
+}
+
+func (v *positionRemover) visitSequence(ope *sequence) {
+	for _, o := range ope.opes {
+		v.remove(o)
+	}
+}
+func (v *positionRemover) visitPrioritizedChoice(ope *prioritizedChoice) {
+	for _, o := range ope.opes {
+		v.remove(o)
+	}
+}
+func (v *positionRemover) visitZeroOrMore(ope *zeroOrMore)       { v.remove(ope.ope) }
+func (v *positionRemover) visitOneOrMore(ope *oneOrMore)         { v.remove(ope.ope) }
+func (v *positionRemover) visitRepetition(ope *repetition)       { v.remove(ope.ope) }
+func (v *positionRemover) visitOption(ope *option)               { v.remove(ope.ope) }
+func (v *positionRemover) visitAndPredicate(ope *andPredicate)   { v.remove(ope.ope) }
+func (v *positionRemover) visitNotPredicate(ope *notPredicate)   { v.remove(ope.ope) }
+func (v *positionRemover) visitTokenBoundary(ope *tokenBoundary) { v.remove(ope.ope) }
+func (v *positionRemover) visitIgnore(ope *ignore)               { v.remove(ope.ope) }
+func (v *positionRemover) visitReference(ope *reference) {
+	for _, arg := range ope.args {
+		v.remove(arg)
+	}
+}
@@ -0,0 +1,158 @@
+package peg
+
+import "testing"
+
+const deriveTestBase = `
+	PROGRAM     <- STATEMENT*
+	STATEMENT   <- ASSIGN / PRINT
+	ASSIGN      <- NAME '=' VALUE ';'
+	PRINT       <- 'print' VALUE ';'
+	VALUE       <- NAME / NUMBER
+	NAME        <- < [a-z]+ >
+	NUMBER      <- < [0-9]+ >
+	%whitespace <- [ \t\r\n]*
+	---
+	%ast_drop = PRINT
+`
+
+func TestNewParserWithBase(t *testing.T) {
+	parser, err := NewParserWithBase(deriveTestBase, `
+		STATEMENT <- DELETE / super
+		DELETE    <- 'del' NAME ';'
+		VALUE     <- super / STRING
+		STRING    <- < "'" (!"'" .)* "'" >
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, parser.Parse("a = 1; del a; print 'x';", nil) == nil)
+	assert(t, parser.Parse("a = 'x'; print b;", nil) == nil)
+	assert(t, parser.Parse("a = b c;", nil) != nil)
+
+	// The base grammar isn't changed
+	base, err := NewParser(deriveTestBase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, base.Parse("del a;", nil) != nil)
+
+	// Options of the base grammar are kept
+	parser.EnableAst()
+	ast, err := parser.ParseAndGetAst("print 1; del a;", nil)
+	assert(t, err == nil)
+	ast = parser.AstOptimizer().Optimize(ast, nil)
+	assert(t, len(ast.Nodes) == 2 && len(ast.Nodes[0].Nodes) == 0 && ast.Nodes[1].Token == "a")
+	assert(t, len(parser.Lint()) == 0)
+}
+
+func TestNewParserWithBaseOverride(t *testing.T) {
+	// Rules of the base grammar refer to the overriding rule
+	parser, err := NewParserWithBase(deriveTestBase, `
+		NAME <- < [a-zA-Z_]+ >
+		---
+		%start = STATEMENT
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, parser.Parse("Abc = 1;", nil) == nil)
+	assert(t, parser.Parse("a = 1; b = 2;", nil) != nil)
+
+	// Macros
+	parser, err = NewParserWithBase(`
+		ROOT    <- LIST(ITEM)
+		LIST(X) <- X (',' X)*
+		ITEM    <- [a-z]
+	`, `
+		LIST(Y) <- '[' super ']' / '[' ']'
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, parser.Parse("[a,b]", nil) == nil)
+	assert(t, parser.Parse("[]", nil) == nil)
+	assert(t, parser.Parse("a,b", nil) != nil)
+}
+
+func TestNewParserWithBaseErrors(t *testing.T) {
+	_, err := NewParserWithBase(`A <- B
+B <- 'b'
+C <- 'c'
+`, `B <- A / 'x'
+C <- 'y' / super
+D <- super 'd'
+C <- 'z'
+`)
+	perr, ok := err.(*Error)
+	if !ok {
+		t.Fatal(err)
+	}
+	want := []string{
+		"3:6 'D' isn't defined in the base grammar, so 'super' can't be used.",
+		"4:1 'C' is already defined.",
+		"1:6 'A' is left recursive.",
+		"1:6 'B' is left recursive.",
+	}
+	if len(perr.Details) != len(want) {
+		t.Fatalf("want %d errors, got %v", len(want), perr.Details)
+	}
+	got := make(map[string]bool)
+	for _, d := range perr.Details {
+		got[d.String()] = true
+	}
+	for _, w := range want {
+		assert(t, got[w])
+	}
+
+	// Checks are done on the combined grammar with the positions in each
+	// grammar
+	base := "A <- B\nB <- 'b'\nX <- 'x'\nY <- 'y'\nZ <- 'z'\nC <- D 'c'\nD <- 'd'\n"
+	_, err = NewParserWithBase(base, "D <- C\n")
+	perr, ok = err.(*Error)
+	if !ok {
+		t.Fatal(err)
+	}
+	want = []string{
+		"6:6 'D' is left recursive.",
+		"1:6 'C' is left recursive.",
+	}
+	if len(perr.Details) != len(want) {
+		t.Fatalf("want %d errors, got %v", len(want), perr.Details)
+	}
+	got = make(map[string]bool)
+	for _, d := range perr.Details {
+		got[d.String()] = true
+	}
+	for _, w := range want {
+		assert(t, got[w])
+	}
+
+	// The expression of the base rule put by 'super' has no position in the
+	// derived grammar
+	base = "A <- B\nB <- 'b'\nX <- 'x'\nY <- 'y'\nZ <- 'z'\nC <- (&'c' / D)*\nD <- 'd'\n"
+	_, err = NewParserWithBase(base, "C <- super\nD <- ''\n")
+	assert(t, err != nil && err.Error() == "1:1 infinite loop is detected in 'C'.")
+
+	_, err = NewParserWithBase("A <- X(B)\nX(P) <- P\nB <- 'b'\n", "X(P, Q) <- super Q\n")
+	assert(t, err != nil && err.Error() == "1:12 'X' has parameters different from the base rule, so 'super' can't be used.")
+
+	// Options of the base grammar which become invalid are reported at their
+	// positions in the base grammar
+	base = `# Expressions with the operators of the levels below
+EXPR  <- ATOM (BINOP ATOM)*
+ATOM  <- < [0-9]+ >
+BINOP <- < [-+] >
+---
+%start = EXPR
+%expr  = EXPR
+%binop = L + -
+`
+	_, err = NewParserWithBase(base, "EXPR <- ATOM\n")
+	assert(t, err != nil && err.Error() == "7:1 'EXPR' must be in the form of 'ATOM (OPERATOR ATOM)*'.")
+	_, err = NewParserWithBase(base, "EXPR(X) <- X\nLIST <- ATOM (BINOP ATOM)*\n---\n%expr = LIST\n")
+	assert(t, err != nil && err.Error() == "6:1 'EXPR' is a macro, which can't be the start rule.")
+
+	// Errors in the base grammar
+	_, err = NewParserWithBase("A <- B\n", "A <- 'a'\n")
+	assert(t, err != nil && err.Error() == "1:6 'B' is not defined.")
+}
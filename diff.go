@@ -0,0 +1,149 @@
+package peg
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+)
+
+// AstCompare compares two Asts by name, token and children. Positions and
+// Data are compared unless they are ignored. Parent, S and the CST trivia
+// are never compared.
+type AstCompare struct {
+	IgnorePos  bool
+	IgnoreData bool
+}
+
+// Equal reports whether ast and other are the same tree, including positions
+// and Data.
+func (ast *Ast) Equal(other *Ast) bool {
+	return AstCompare{}.Equal(ast, other)
+}
+
+func (c AstCompare) Equal(a, b *Ast) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	if !c.equalNode(a, b) || len(a.Nodes) != len(b.Nodes) {
+		return false
+	}
+	for i := range a.Nodes {
+		if !c.Equal(a.Nodes[i], b.Nodes[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// equalNode compares a and b without their children.
+func (c AstCompare) equalNode(a, b *Ast) bool {
+	if a.Name != b.Name || a.Token != b.Token {
+		return false
+	}
+	if !c.IgnorePos && (a.Ln != b.Ln || a.Col != b.Col) {
+		return false
+	}
+	return c.IgnoreData || reflect.DeepEqual(a.Data, b.Data)
+}
+
+// Diff kind
+type AstDiffKind int
+
+const (
+	AstInserted AstDiffKind = iota // Node only in the new tree
+	AstDeleted                     // Node only in the old tree
+	AstChanged                     // Node in both trees with a different token, position or data
+)
+
+// AstDiff is a difference between two trees. Path locates the node from the
+// root, e.g. "/PROGRAM/STMT[2]/EXPR[0]", where the index is that of the node
+// in its parent in the new tree for AstInserted and in the old tree
+// otherwise. Old is nil for AstInserted and New is nil for AstDeleted.
+type AstDiff struct {
+	Kind AstDiffKind
+	Path string
+	Old  *Ast
+	New  *Ast
+}
+
+func (d AstDiff) String() string {
+	switch d.Kind {
+	case AstInserted:
+		return fmt.Sprintf("+ %s %s", d.Path, astSummary(d.New))
+	case AstDeleted:
+		return fmt.Sprintf("- %s %s", d.Path, astSummary(d.Old))
+	}
+	return fmt.Sprintf("~ %s %s -> %s", d.Path, astSummary(d.Old), astSummary(d.New))
+}
+
+func astSummary(ast *Ast) string {
+	s := fmt.Sprintf("%s %d:%d", ast.Name, ast.Ln, ast.Col)
+	if len(ast.Token) > 0 {
+		s += " " + strconv.Quote(ast.Token)
+	}
+	if ast.Data != nil {
+		s += fmt.Sprintf(" [%v]", ast.Data)
+	}
+	return s
+}
+
+// DiffAst returns the differences from a to b with the default AstCompare.
+func DiffAst(a, b *Ast) []AstDiff {
+	return AstCompare{}.Diff(a, b)
+}
+
+// Diff returns the differences from a to b in depth-first order. Children
+// are matched by name along their longest common subsequence. Matched nodes
+// are compared recursively, and the others are reported as a whole as
+// deleted or inserted. Roots with different names are reported as a single
+// change.
+func (c AstCompare) Diff(a, b *Ast) []AstDiff {
+	if a.Name != b.Name {
+		return []AstDiff{{AstChanged, "/" + a.Name, a, b}}
+	}
+	return c.diff(a, b, "/"+a.Name, nil)
+}
+
+func (c AstCompare) diff(a, b *Ast, path string, diffs []AstDiff) []AstDiff {
+	if !c.equalNode(a, b) {
+		diffs = append(diffs, AstDiff{AstChanged, path, a, b})
+	}
+
+	x, y := a.Nodes, b.Nodes
+	lcs := make([][]int, len(x)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(y)+1)
+	}
+	for i := len(x) - 1; i >= 0; i-- {
+		for j := len(y) - 1; j >= 0; j-- {
+			if x[i].Name == y[j].Name {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	childPath := func(node *Ast, i int) string {
+		return fmt.Sprintf("%s/%s[%d]", path, node.Name, i)
+	}
+
+	i, j := 0, 0
+	for i < len(x) || j < len(y) {
+		switch {
+		case i < len(x) && j < len(y) && x[i].Name == y[j].Name:
+			diffs = c.diff(x[i], y[j], childPath(x[i], i), diffs)
+			i++
+			j++
+		case j == len(y) || (i < len(x) && lcs[i+1][j] >= lcs[i][j+1]):
+			diffs = append(diffs, AstDiff{AstDeleted, childPath(x[i], i), x[i], nil})
+			i++
+		default:
+			diffs = append(diffs, AstDiff{AstInserted, childPath(y[j], j), nil, y[j]})
+			j++
+		}
+	}
+	return diffs
+}
@@ -0,0 +1,78 @@
+package peg
+
+import (
+	"strings"
+	"testing"
+)
+
+func diffStrings(diffs []AstDiff) string {
+	var l []string
+	for _, d := range diffs {
+		l = append(l, d.String())
+	}
+	return strings.Join(l, "\n")
+}
+
+func TestAstEqual(t *testing.T) {
+	parser, err := NewParser(`
+		ROOT        <- STMT*
+		STMT        <- NAME '=' NUMBER ';'
+		NAME        <- < [a-z]+ >
+		NUMBER      <- < [0-9]+ >
+		%whitespace <- [ \t\r\n]*
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parser.EnableAst()
+	a, _ := parser.ParseAndGetAst("a = 1; b = 2;", nil)
+	b, _ := parser.ParseAndGetAst("a = 1; b = 2;", nil)
+	c, _ := parser.ParseAndGetAst("a=1;\nb=2;", nil)
+	d, _ := parser.ParseAndGetAst("a = 1; b = 3;", nil)
+
+	assert(t, a.Equal(b))
+	assert(t, !a.Equal(c))
+	assert(t, AstCompare{IgnorePos: true}.Equal(a, c))
+	assert(t, !AstCompare{IgnorePos: true}.Equal(a, d))
+
+	b.Nodes[0].Data = 1
+	assert(t, !a.Equal(b))
+	assert(t, AstCompare{IgnoreData: true}.Equal(a, b))
+}
+
+func TestAstDiff(t *testing.T) {
+	parser, err := NewParser(`
+		ROOT        <- STMT*
+		STMT        <- NAME '=' NUMBER ';'
+		NAME        <- < [a-z]+ >
+		NUMBER      <- < [0-9]+ >
+		%whitespace <- [ \t\r\n]*
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parser.EnableAst()
+	a, _ := parser.ParseAndGetAst("a = 1; b = 2; c = 3;", nil)
+	b, _ := parser.ParseAndGetAst("a = 1; b = 5; c = 3; d = 4;", nil)
+
+	assert(t, len(DiffAst(a, a)) == 0)
+
+	want := `~ /ROOT/STMT[1]/NUMBER[1] NUMBER 1:12 "2" -> NUMBER 1:12 "5"
++ /ROOT/STMT[3] STMT 1:22`
+	if got := diffStrings(DiffAst(a, b)); got != want {
+		t.Errorf("want:\n%s\ngot:\n%s", want, got)
+	}
+
+	want = `- /ROOT/STMT[3] STMT 1:22`
+	if got := diffStrings(AstCompare{IgnorePos: true}.Diff(b, a)[1:]); got != want {
+		t.Errorf("want:\n%s\ngot:\n%s", want, got)
+	}
+}
+
+func TestAstDiffRoot(t *testing.T) {
+	a := &Ast{Name: "A"}
+	b := &Ast{Name: "B"}
+	diffs := DiffAst(a, b)
+	assert(t, len(diffs) == 1)
+	assert(t, diffs[0].Kind == AstChanged && diffs[0].Old == a && diffs[0].New == b)
+}
@@ -0,0 +1,258 @@
+package peg
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+var (
+	w3cEBNFParser *Parser
+	isoEBNFParser *Parser
+	ebnfOnce      sync.Once
+	ebnfLock      sync.Mutex
+)
+
+func setupEBNFParsers() {
+	// W3C notation, as used in the XML specification
+	w3cEBNFParser, _ = NewParser(`
+		GRAMMAR     <- PRODUCTION*
+		PRODUCTION  <- NUMBER? SYMBOL '::=' CHOICE
+		CHOICE      <- SEQUENCE ('|' SEQUENCE)*
+		SEQUENCE    <- DIFFERENCE*
+		DIFFERENCE  <- ITEM ('-' ITEM)*
+		ITEM        <- PRIMARY SUFFIX?
+		PRIMARY     <- SYMBOL !'::=' / '(' CHOICE ')' / STRING / !(NUMBER SYMBOL '::=') CLASS / CHARCODE
+		SUFFIX      <- < [?*+] >
+		SYMBOL      <- < [a-zA-Z_] [a-zA-Z0-9_]* >
+		STRING      <- < '"' (!'"' .)* '"' / "'" (!"'" .)* "'" >
+		CLASS       <- < '[' '^'? ('#x' [0-9a-fA-F]+ / !']' .)+ ']' >
+		CHARCODE    <- < '#x' [0-9a-fA-F]+ >
+		~NUMBER     <- '[' [0-9]+ [a-z]? ']'
+		%whitespace <- ([ \t\r\n] / '/*' (!'*/' .)* '*/' / '[' [ \t]* ('wfc' / 'vc' / 'WFC' / 'VC') ':' (!']' .)* ']')*
+	`)
+
+	g := w3cEBNFParser.Grammar
+	g["PRODUCTION"].Action = func(v *Values, d Any) (Any, error) {
+		d.(*importer).define(v.ToStr(0), v.ToOpe(1), v.Pos, v.SS, false)
+		return nil, nil
+	}
+	g["CHOICE"].Action = ebnfChoice
+	g["SEQUENCE"].Action = ebnfSequence
+	g["DIFFERENCE"].Action = ebnfDifference
+	g["ITEM"].Action = func(v *Values, d Any) (Any, error) {
+		ope := v.ToOpe(0)
+		if len(v.Vs) > 1 {
+			switch v.ToStr(1) {
+			case "?":
+				ope = Opt(ope)
+			case "*":
+				ope = Zom(ope)
+			case "+":
+				ope = Oom(ope)
+			}
+		}
+		return ope, nil
+	}
+	g["PRIMARY"].Action = func(v *Values, d Any) (Any, error) {
+		if v.Choice == 0 {
+			return Ref(v.ToStr(0), nil, v.Pos), nil
+		}
+		return v.ToOpe(0), nil
+	}
+	g["SUFFIX"].Action = func(v *Values, d Any) (Any, error) {
+		return v.Token(), nil
+	}
+	g["SYMBOL"].Action = func(v *Values, d Any) (Any, error) {
+		return v.Token(), nil
+	}
+	g["STRING"].Action = func(v *Values, d Any) (Any, error) {
+		tok := v.Token()
+		return Lit(tok[1 : len(tok)-1]), nil
+	}
+	g["CLASS"].Action = func(v *Values, d Any) (Any, error) {
+		return w3cClass(v.Token(), v.Pos, d.(*importer)), nil
+	}
+	g["CHARCODE"].Action = func(v *Values, d Any) (Any, error) {
+		r, ok := w3cCharCode(v.Token())
+		if !ok {
+			d.(*importer).diag(v.Pos, "'"+v.Token()+"' is out of the range of characters.")
+		}
+		return Lit(string(r)), nil
+	}
+
+	// ISO/IEC 14977 notation
+	isoEBNFParser, _ = NewParser(`
+		SYNTAX      <- RULE*
+		RULE        <- META '=' DEFINITIONS (';' / '.')
+		DEFINITIONS <- DEFINITION ('|' DEFINITION)*
+		DEFINITION  <- (TERM (',' TERM)*)?
+		TERM        <- FACTOR ('-' FACTOR)?
+		FACTOR      <- (INTEGER '*')? PRIMARY
+		PRIMARY     <- '[' DEFINITIONS ']' / '{' DEFINITIONS '}' / '(' DEFINITIONS ')' / SPECIAL / TERMINAL / META
+		INTEGER     <- < [0-9]+ >
+		META        <- < [a-zA-Z] ([a-zA-Z0-9] / [ \t\r\n]+ &[a-zA-Z0-9])* >
+		SPECIAL     <- < '?' (!'?' .)* '?' >
+		TERMINAL    <- < "'" (!"'" .)+ "'" / '"' (!'"' .)+ '"' >
+		%whitespace <- ([ \t\r\n] / '(*' (!'*)' .)* '*)')*
+	`)
+
+	g = isoEBNFParser.Grammar
+	g["RULE"].Action = func(v *Values, d Any) (Any, error) {
+		d.(*importer).define(v.ToStr(0), v.ToOpe(1), v.Pos, v.SS, false)
+		return nil, nil
+	}
+	g["DEFINITIONS"].Action = ebnfChoice
+	g["DEFINITION"].Action = ebnfSequence
+	g["TERM"].Action = ebnfDifference
+	g["FACTOR"].Action = func(v *Values, d Any) (Any, error) {
+		if len(v.Vs) == 1 {
+			return v.ToOpe(0), nil
+		}
+		n, _ := strconv.Atoi(v.ToStr(0))
+		return repeatOpe(v.ToOpe(1), n, n), nil
+	}
+	g["PRIMARY"].Action = func(v *Values, d Any) (Any, error) {
+		switch v.Choice {
+		case 0:
+			return Opt(v.ToOpe(0)), nil
+		case 1:
+			return Zom(v.ToOpe(0)), nil
+		case 5:
+			return Ref(v.ToStr(0), nil, v.Pos), nil
+		}
+		return v.ToOpe(0), nil
+	}
+	g["INTEGER"].Action = func(v *Values, d Any) (Any, error) {
+		return v.Token(), nil
+	}
+	g["META"].Action = func(v *Values, d Any) (Any, error) {
+		// Spaces in names are allowed in ISO EBNF
+		return strings.Join(strings.Fields(v.Token()), "_"), nil
+	}
+	g["SPECIAL"].Action = func(v *Values, d Any) (Any, error) {
+		d.(*importer).diag(v.Pos, "special sequence '"+v.Token()+"' has no equivalent in PEG.")
+		return Lit(""), nil
+	}
+	g["TERMINAL"].Action = func(v *Values, d Any) (Any, error) {
+		tok := v.Token()
+		return Lit(tok[1 : len(tok)-1]), nil
+	}
+}
+
+func ebnfChoice(v *Values, d Any) (Any, error) {
+	if len(v.Vs) == 1 {
+		return v.ToOpe(0), nil
+	}
+	var opes []operator
+	for i := range v.Vs {
+		opes = append(opes, v.ToOpe(i))
+	}
+	return ChoCore(opes), nil
+}
+
+func ebnfSequence(v *Values, d Any) (Any, error) {
+	switch len(v.Vs) {
+	case 0:
+		return Lit(""), nil
+	case 1:
+		return v.ToOpe(0), nil
+	}
+	var opes []operator
+	for i := range v.Vs {
+		opes = append(opes, v.ToOpe(i))
+	}
+	return SeqCore(opes), nil
+}
+
+// ebnfDifference translates 'A - B' to '!B A'.
+func ebnfDifference(v *Values, d Any) (Any, error) {
+	if len(v.Vs) == 1 {
+		return v.ToOpe(0), nil
+	}
+	var opes []operator
+	for i := 1; i < len(v.Vs); i++ {
+		opes = append(opes, Npd(v.ToOpe(i)))
+	}
+	return SeqCore(append(opes, v.ToOpe(0))), nil
+}
+
+// NewParserFromEBNF makes a parser from a grammar in EBNF. The W3C notation
+// of the XML specification ('::=') is assumed if the grammar has '::=', and
+// the ISO/IEC 14977 notation ('=', ',' and ';') otherwise. Alternatives are
+// tried in order as in PEG. A difference 'A - B' becomes '!B A', which
+// matches the same when B matches no prefix of what A matches, such as for
+// characters. Names in ISO notation have spaces replaced with '_'. Special
+// sequences are reported as errors.
+func NewParserFromEBNF(s string) (*Parser, error) {
+	ebnfOnce.Do(setupEBNFParsers)
+
+	p := isoEBNFParser
+	if strings.Contains(s, "::=") {
+		p = w3cEBNFParser
+	}
+
+	im := newImporter(false)
+	ebnfLock.Lock()
+	_, err := p.ParseAndGetValue(s, im)
+	ebnfLock.Unlock()
+
+	if err != nil {
+		return nil, err
+	}
+	return im.parser(s, nil)
+}
+
+func w3cCharCode(s string) (rune, bool) {
+	n, err := strconv.ParseUint(s[2:], 16, 32)
+	if err != nil || n > unicode.MaxRune {
+		return utf8.RuneError, false
+	}
+	return rune(n), true
+}
+
+// w3cClass makes an operator for a class such as '[^#x20-#x7E]'.
+func w3cClass(tok string, pos int, im *importer) operator {
+	s := tok[1 : len(tok)-1]
+	negated := strings.HasPrefix(s, "^")
+	if negated {
+		s = s[1:]
+	}
+
+	next := func() (rune, bool) {
+		if strings.HasPrefix(s, "#x") {
+			i := 2
+			for i < len(s) && strings.IndexByte("0123456789abcdefABCDEF", s[i]) != -1 {
+				i++
+			}
+			r, ok := w3cCharCode(s[:i])
+			s = s[i:]
+			return r, ok
+		}
+		r, n := utf8.DecodeRuneInString(s)
+		s = s[n:]
+		return r, true
+	}
+
+	var ranges [][2]rune
+	for len(s) > 0 {
+		lo, ok := next()
+		hi := lo
+		if ok && len(s) > 1 && s[0] == '-' {
+			s = s[1:]
+			hi, ok = next()
+		}
+		if !ok {
+			im.diag(pos, "'"+tok+"' is out of the range of characters.")
+			return Lit("")
+		}
+		if lo > hi {
+			im.diag(pos, "'"+tok+"' has the upper bound less than the lower bound.")
+			return Lit("")
+		}
+		ranges = append(ranges, [2]rune{lo, hi})
+	}
+	return runeClass(ranges, negated)
+}
@@ -0,0 +1,89 @@
+package peg
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEBNFW3C(t *testing.T) {
+	parser, err := NewParserFromEBNF(`/* From XML 1.0 */
+[5]  Name          ::= NameStartChar (NameChar)*
+[4]  NameStartChar ::= ":" | [A-Z] | "_" | [a-z] | [#xC0-#xD6] | [#x370-#x37D]
+[4a] NameChar      ::= NameStartChar | "-" | "." | [0-9] | #xB7
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert(t, parser.Parse("abc", nil) == nil)
+	assert(t, parser.Parse("_À", nil) == nil)
+	assert(t, parser.Parse("Ͱx", nil) == nil)
+	assert(t, parser.Parse("a·b", nil) == nil)
+	assert(t, parser.Parse("1a", nil) != nil)
+}
+
+func TestEBNFW3CDifference(t *testing.T) {
+	parser, err := NewParserFromEBNF(`
+Consonants ::= ([a-z] - [aeiou])+  [ vc: Example ]
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert(t, parser.Parse("bcd", nil) == nil)
+	assert(t, parser.Parse("bad", nil) != nil)
+}
+
+func TestEBNFISO(t *testing.T) {
+	parser, err := NewParserFromEBNF(`(* ISO/IEC 14977 *)
+integer = [ "-" ], digit excluding zero, { digit } | "0" ;
+digit excluding zero = "1" | "2" | "3" | "4" | "5" | "6" | "7" | "8" | "9" ;
+digit = "0" | digit excluding zero ;
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert(t, parser.Grammar["digit_excluding_zero"] != nil)
+	assert(t, parser.Parse("-120", nil) == nil)
+	assert(t, parser.Parse("0", nil) == nil)
+	assert(t, parser.Parse("012", nil) != nil)
+	assert(t, parser.Parse("-", nil) != nil)
+}
+
+func TestEBNFISORepetition(t *testing.T) {
+	parser, err := NewParserFromEBNF(`
+code = 3 * letter, ( "-" | "." ), { letter } - "x" ;
+letter = "a" | "b" | "c" | "x" ;
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert(t, parser.Parse("abc-", nil) == nil)
+	assert(t, parser.Parse("abc.ab", nil) == nil)
+	assert(t, parser.Parse("ab-", nil) != nil)
+}
+
+func TestEBNFDiagnostics(t *testing.T) {
+	_, err := NewParserFromEBNF(`
+space = ? US-ASCII character 32 ? ;
+twice = "a" ;
+twice = "b" ;
+`)
+	pe, ok := err.(*Error)
+	if !ok {
+		t.Fatal(err)
+	}
+	assert(t, len(pe.Details) == 1)
+	assert(t, pe.Details[0].Ln == 2 && strings.Contains(pe.Details[0].Msg, "special sequence '? US-ASCII character 32 ?'"))
+
+	_, err = NewParserFromEBNF(`
+twice = "a" ;
+twice = "b" ;
+`)
+	assert(t, err != nil && err.Error() == "3:1 'twice' is already defined.")
+
+	_, err = NewParserFromEBNF("Char ::= [#x7A-#x61]\n")
+	assert(t, err != nil && strings.Contains(err.Error(), "upper bound less than the lower bound"))
+}
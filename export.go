@@ -0,0 +1,711 @@
+package peg
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Dialects of the exporters
+const (
+	dialectCppPeglib = iota
+	dialectPEGjs
+	dialectPigeon
+)
+
+var dialectNames = []string{"cpp-peglib", "PEG.js", "pigeon"}
+
+// ExportCppPeglib writes the grammar of p in the syntax of cpp-peglib.
+// '%whitespace', '%word', macros and instructions are written as they are,
+// and '%expr' and '%binop' become a precedence instruction on the rule. The
+// start rule is written first, and the other options are left out. Classes
+// of characters, including '\u' escapes, '\p{...}' and the classes made by
+// the front-ends for other notations, are written as ranges of characters in
+// UTF-8. Classes and literals of bytes which aren't characters in UTF-8,
+// such as '[\x80-\xff]', are reported since cpp-peglib reads them in UTF-8.
+func ExportCppPeglib(p *Parser) (string, error) {
+	return newExporter(p, dialectCppPeglib).export()
+}
+
+// ExportPEGjs writes the grammar of p in the syntax of PEG.js (and Peggy).
+// The grammar has no actions. Macros are expanded, and whitespace skipping
+// and word checks are written out in the rules: a rule is written more than
+// once if it is used both inside and outside of token boundaries, which
+// become '$e'.
+func ExportPEGjs(p *Parser) (string, error) {
+	return newExporter(p, dialectPEGjs).export()
+}
+
+// ExportPigeon writes the grammar of p in the syntax of pigeon in the same
+// way as ExportPEGjs, except that token boundaries are left out because
+// pigeon has no equivalent. The grammar has neither actions nor the
+// initializer with the package clause.
+func ExportPigeon(p *Parser) (string, error) {
+	return newExporter(p, dialectPigeon).export()
+}
+
+// exportMode tells what the context adds to literals. Whitespace is skipped
+// outside of token boundaries and the whitespace rule, and literals which
+// are words are checked outside of the word rule.
+type exportMode struct {
+	ws   bool
+	word bool
+}
+
+type exportKey struct {
+	rule *Rule
+	mode exportMode
+}
+
+// exportArg is an argument of a macro to expand.
+type exportArg struct {
+	ope operator
+	env []exportArg
+}
+
+// exporter
+type exporter struct {
+	p        *Parser
+	dialect  int
+	rules    []*Rule // In the order of definition
+	ws, word *Rule
+	normal   exportMode
+	keys     []exportKey
+	names    map[exportKey]string
+	macros   map[*Rule]bool // Macros being expanded
+	diags    map[*Rule][]string
+}
+
+func newExporter(p *Parser, dialect int) *exporter {
+	e := &exporter{
+		p:       p,
+		dialect: dialect,
+		names:   make(map[exportKey]string),
+		macros:  make(map[*Rule]bool),
+		diags:   make(map[*Rule][]string),
+	}
+	for _, r := range p.Grammar {
+		e.rules = append(e.rules, r)
+	}
+	sort.Slice(e.rules, func(i, j int) bool {
+		if e.rules[i].Pos != e.rules[j].Pos {
+			return e.rules[i].Pos < e.rules[j].Pos
+		}
+		return e.rules[i].Name < e.rules[j].Name
+	})
+
+	if dialect != dialectCppPeglib {
+		// cpp-peglib has them
+		e.ws = p.Grammar[WhitespceRuleName]
+		e.word = p.Grammar[WordRuleName]
+		e.normal = exportMode{ws: e.ws != nil, word: e.word != nil}
+	}
+	return e
+}
+
+func (e *exporter) diag(r *Rule, msg string) {
+	for _, m := range e.diags[r] {
+		if m == msg {
+			return
+		}
+	}
+	e.diags[r] = append(e.diags[r], msg)
+}
+
+func (e *exporter) export() (string, error) {
+	var items []*grammarItem
+	if e.dialect == dialectCppPeglib {
+		// cpp-peglib starts from the first rule
+		start := e.p.Grammar[e.p.start]
+		if start != nil {
+			items = append(items, e.cppDefinition(start))
+		}
+		for _, r := range e.rules {
+			if r != start {
+				items = append(items, e.cppDefinition(r))
+			}
+		}
+	} else {
+		items = e.definitions()
+	}
+
+	if len(e.diags) > 0 {
+		err := &Error{}
+		for _, r := range e.rules {
+			ln, col := lineInfo(r.SS, r.Pos)
+			for _, msg := range e.diags[r] {
+				err.Details = append(err.Details, ErrorDetail{ln, col, msg})
+			}
+		}
+		return "", err
+	}
+
+	f := &grammarFormatter{items: items}
+	return f.render(), nil
+}
+
+func (e *exporter) cppDefinition(r *Rule) *grammarItem {
+	head := cppName(r.Name)
+	if r.Ignore {
+		head = "~" + head
+	}
+	if r.Parameters != nil {
+		head += "(" + strings.Join(r.Parameters, ", ") + ")"
+	}
+
+	line := e.opeToS(r, r.Ope, precChoice, exportMode{}, nil)
+
+	precedence := r.precedence
+	if name, levels := expressionLevels(e.p.options); name == r.Name {
+		precedence = levels
+	}
+	var binary []string
+	for _, level := range precedence {
+		switch level[0] {
+		case 'N':
+			e.diag(r, fmt.Sprintf("'%s' has a non-associative operator, which has no equivalent in %s.", r.Name, dialectNames[e.dialect]))
+		case 'P', 'S', 'T':
+			// Reported with the expression
+			continue
+		}
+		binary = append(binary, level)
+	}
+	precedence = binary
+	quote := func(s string) string { return "\"" + e.escape(r, s, '"') + "\"" }
+	var items []string
+	if len(r.ErrorMessage) > 0 {
+		items = append(items, "error_message "+quote(r.ErrorMessage))
+	}
+	if len(precedence) > 0 {
+		items = append(items, "precedence "+precedenceToS(precedence, quote))
+	}
+	if len(items) > 0 {
+		line += " { " + strings.Join(items, "; ") + " }"
+	}
+
+	return &grammarItem{pos: -1, end: -1, head: head, sep: "<-", lines: []string{line}}
+}
+
+// definitions writes the rules for PEG.js and pigeon. It collects the rules
+// in the modes they are used first, to name them.
+func (e *exporter) definitions() []*grammarItem {
+	token := exportMode{false, e.normal.word}
+	var start exportKey
+	if r, ok := e.p.Grammar[e.p.start]; ok {
+		start = exportKey{r, e.normal}
+		e.use(start)
+	}
+	if e.ws != nil {
+		e.use(exportKey{e.ws, token})
+	}
+	for i := 0; i < len(e.keys); i++ {
+		e.ruleToS(e.keys[i])
+
+		if i == len(e.keys)-1 {
+			// Rules which aren't used from the start rule
+			for _, r := range e.rules {
+				if !e.used(r) && r.Parameters == nil && r != e.ws && r != e.word {
+					e.use(exportKey{r, e.normal})
+					break
+				}
+			}
+		}
+	}
+
+	// Names by the mode, with '_token' or '_raw' if the rule is written in
+	// more than one mode
+	taken := make(map[string]bool)
+	unique := func(name string) string {
+		for taken[name] {
+			name += "_"
+		}
+		taken[name] = true
+		return name
+	}
+	var ordered []exportKey
+	for _, r := range e.rules {
+		var keys []exportKey
+		for _, mode := range []exportMode{e.normal, token, {}} {
+			if k := (exportKey{r, mode}); e.names[k] == "?" {
+				keys = append(keys, k)
+				e.names[k] = ""
+			}
+		}
+		for i, k := range keys {
+			name := exportName(r.Name)
+			if i > 0 {
+				if k.mode == token {
+					name += "_token"
+				} else {
+					name += "_raw"
+				}
+			}
+			e.names[k] = unique(name)
+		}
+		ordered = append(ordered, keys...)
+	}
+
+	sep := "="
+	if e.dialect == dialectPigeon {
+		sep = "<-"
+	}
+
+	var items []*grammarItem
+	if start.rule != nil && e.ws != nil {
+		// Whitespace at the beginning
+		line := e.names[exportKey{e.ws, token}] + " " + e.names[start]
+		items = append(items, &grammarItem{pos: -1, end: -1, head: unique("start"), sep: sep, lines: []string{line}})
+	} else if start.rule != nil {
+		items = append(items, &grammarItem{pos: -1, end: -1, head: e.names[start], sep: sep, lines: []string{e.ruleToS(start)}})
+	}
+	for _, k := range ordered {
+		if k == start && e.ws == nil {
+			continue
+		}
+		items = append(items, &grammarItem{pos: -1, end: -1, head: e.names[k], sep: sep, lines: []string{e.ruleToS(k)}})
+	}
+	return items
+}
+
+func (e *exporter) used(r *Rule) bool {
+	for _, k := range e.keys {
+		if k.rule == r {
+			return true
+		}
+	}
+	return false
+}
+
+// use adds the rule in the mode to be written.
+func (e *exporter) use(k exportKey) {
+	if _, ok := e.names[k]; !ok {
+		e.names[k] = "?" // Named later
+		e.keys = append(e.keys, k)
+	}
+}
+
+func (e *exporter) ref(k exportKey) string {
+	e.use(k)
+	return e.names[k]
+}
+
+func (e *exporter) ruleToS(k exportKey) string {
+	return e.opeToS(k.rule, k.rule.Ope, precChoice, k.mode, nil)
+}
+
+// opeToS writes ope in rule r, in parentheses if it binds more loosely than
+// prec. env has the arguments of the macro being expanded.
+func (e *exporter) opeToS(r *Rule, ope operator, prec int, mode exportMode, env []exportArg) string {
+	v := e.print(r, ope, mode, env)
+	if v.prec < prec {
+		return "(" + v.s + ")"
+	}
+	return v.s
+}
+
+func (e *exporter) print(r *Rule, ope operator, mode exportMode, env []exportArg) *exportPrinter {
+	v := &exportPrinter{e: e, r: r, mode: mode, env: env}
+	if ranges, negated, ok := classRanges(ope); ok {
+		v.class(ranges, negated)
+	} else {
+		ope.accept(v)
+	}
+	return v
+}
+
+// escape escapes s for a literal closed by quote, or a class if quote is
+// ']'.
+func (e *exporter) escape(r *Rule, s string, quote byte) string {
+	if !utf8.ValidString(s) {
+		e.diag(r, fmt.Sprintf("'%s' has bytes which aren't characters in UTF-8, which %s doesn't support.", r.Name, dialectNames[e.dialect]))
+	}
+
+	var b strings.Builder
+	for _, ch := range s {
+		switch {
+		case ch == '\\' || ch == rune(quote):
+			b.WriteByte('\\')
+			b.WriteRune(ch)
+		case ch == '\n':
+			b.WriteString(`\n`)
+		case ch == '\r':
+			b.WriteString(`\r`)
+		case ch == '\t':
+			b.WriteString(`\t`)
+		case ch < 0x20 || ch == 0x7f:
+			fmt.Fprintf(&b, `\x%02x`, ch)
+		default:
+			b.WriteRune(ch)
+		}
+	}
+	return b.String()
+}
+
+// isWord tells if the literal is checked with the word rule.
+func (e *exporter) isWord(lit string) bool {
+	return success(e.word.parse(lit, 0, &Values{}, &context{s: lit}, nil))
+}
+
+// exportPrinter
+type exportPrinter struct {
+	*visitorBase
+	e    *exporter
+	r    *Rule
+	mode exportMode
+	env  []exportArg
+	s    string
+	prec int
+}
+
+func (v *exportPrinter) set(s string, prec int) {
+	v.s = s
+	v.prec = prec
+}
+
+func (v *exportPrinter) opeToS(ope operator, prec int) string {
+	return v.e.opeToS(v.r, ope, prec, v.mode, v.env)
+}
+
+// skip adds what the mode adds after a literal or a token boundary.
+func (v *exportPrinter) skip(s string, prec int, lit *string) {
+	var l []string
+	if lit != nil && v.mode.word && v.e.isWord(*lit) {
+		l = append(l, "!"+v.e.ref(exportKey{v.e.word, exportMode{}}))
+	}
+	if v.mode.ws {
+		l = append(l, v.e.ref(exportKey{v.e.ws, exportMode{false, v.mode.word}}))
+	}
+	if len(l) > 0 {
+		if prec < precSequence {
+			s = "(" + s + ")"
+		}
+		s, prec = s+" "+strings.Join(l, " "), precSequence
+	}
+	v.set(s, prec)
+}
+
+func (v *exportPrinter) class(ranges [][2]rune, negated bool) {
+	if (!negated && isAnyRune(ranges)) || (negated && len(ranges) == 0) {
+		v.set(".", precPrimary)
+		return
+	}
+
+	ranges = withoutSurrogates(ranges)
+
+	// '-' goes first not to be taken as a range
+	sort.SliceStable(ranges, func(i, j int) bool { return ranges[i][0] == '-' && ranges[j][0] != '-' })
+	var b strings.Builder
+	b.WriteByte('[')
+	if negated {
+		b.WriteByte('^')
+	}
+	for i, r := range ranges {
+		for j, ch := range []rune{r[0], r[1]} {
+			switch {
+			case j == 1 && r[0] == r[1]:
+				continue
+			case j == 1:
+				b.WriteByte('-')
+			}
+			if ch == '^' && i == 0 && j == 0 && !negated {
+				b.WriteString(`\x5e`) // Not to be taken as negation
+			} else {
+				b.WriteString(v.e.escape(v.r, string(ch), ']'))
+			}
+		}
+	}
+	b.WriteByte(']')
+	v.set(b.String(), precPrimary)
+}
+
+func (v *exportPrinter) visitSequence(ope *sequence) {
+	if len(ope.opes) == 1 {
+		ope.opes[0].accept(v)
+		return
+	}
+	var l []string
+	for _, o := range ope.opes {
+		// Sequences in it need no parentheses
+		l = append(l, v.opeToS(o, precSequence))
+	}
+	v.set(strings.Join(l, " "), precSequence)
+}
+func (v *exportPrinter) visitPrioritizedChoice(ope *prioritizedChoice) {
+	var l []string
+	for _, o := range ope.opes {
+		l = append(l, v.opeToS(o, precSequence))
+	}
+	v.set(strings.Join(l, " / "), precChoice)
+}
+func (v *exportPrinter) visitZeroOrMore(ope *zeroOrMore) {
+	v.set(v.opeToS(ope.ope, precPrimary)+"*", precSuffix)
+}
+func (v *exportPrinter) visitOneOrMore(ope *oneOrMore) {
+	v.set(v.opeToS(ope.ope, precPrimary)+"+", precSuffix)
+}
+func (v *exportPrinter) visitRepetition(ope *repetition) {
+	if v.e.dialect == dialectCppPeglib {
+		v.set(v.opeToS(ope.ope, precPrimary)+repetitionToS(ope.min, ope.max), precSuffix)
+		return
+	}
+	// Spelled out with the other operators
+	ope2 := repeatOpe(ope.ope, ope.min, ope.max)
+	v.set(v.opeToS(ope2, precChoice), v.e.print(v.r, ope2, v.mode, v.env).prec)
+}
+func (v *exportPrinter) visitOption(ope *option) {
+	v.set(v.opeToS(ope.ope, precPrimary)+"?", precSuffix)
+}
+func (v *exportPrinter) visitAndPredicate(ope *andPredicate) {
+	v.set("&"+v.opeToS(ope.ope, precSuffix), precPrefix)
+}
+func (v *exportPrinter) visitNotPredicate(ope *notPredicate) {
+	v.set("!"+v.opeToS(ope.ope, precSuffix), precPrefix)
+}
+func (v *exportPrinter) visitLiteralString(ope *literalString) {
+	if v.e.dialect == dialectCppPeglib {
+		v.set("'"+v.e.escape(v.r, ope.lit, '\'')+"'", precPrimary)
+		return
+	}
+	v.skip("\""+v.e.escape(v.r, ope.lit, '"')+"\"", precPrimary, &ope.lit)
+}
+func (v *exportPrinter) visitCharacterClass(ope *characterClass) {
+	// Classes of ASCII characters are written by class, and classes of
+	// characters in UTF-8 are unicodeClass
+	v.e.diag(v.r, fmt.Sprintf("'%s' has a class of bytes which aren't characters in UTF-8, which %s doesn't support.", v.r.Name, dialectNames[v.e.dialect]))
+	v.set("[]", precPrimary)
+}
+func (v *exportPrinter) visitUnicodeClass(ope *unicodeClass) {
+	v.class(ope.allRanges(), false)
+}
+func (v *exportPrinter) visitAnyCharacter(ope *anyCharacter) {
+	v.set(".", precPrimary)
+}
+func (v *exportPrinter) visitTokenBoundary(ope *tokenBoundary) {
+	switch v.e.dialect {
+	case dialectCppPeglib:
+		v.set("< "+v.opeToS(ope.ope, precChoice)+" >", precPrimary)
+		return
+	}
+
+	mode := exportMode{false, v.mode.word}
+	if v.e.dialect == dialectPEGjs {
+		v.skip("$"+v.e.opeToS(v.r, ope.ope, precSuffix, mode, v.env), precPrefix, nil)
+		return
+	}
+	in := v.e.print(v.r, ope.ope, mode, v.env)
+	v.skip(in.s, in.prec, nil)
+}
+func (v *exportPrinter) visitIgnore(ope *ignore) {
+	if v.e.dialect == dialectCppPeglib {
+		v.set("~"+v.opeToS(ope.ope, precPrimary), precPrimary)
+		return
+	}
+	ope.ope.accept(v)
+}
+func (v *exportPrinter) visitUser(ope *user) {
+	v.e.diag(v.r, fmt.Sprintf("'%s' has a user-defined operator, which has no equivalent in %s.", v.r.Name, dialectNames[v.e.dialect]))
+	v.set("''", precPrimary)
+}
+func (v *exportPrinter) visitSemanticPredicate(ope *semanticPredicate) {
+	v.e.diag(v.r, fmt.Sprintf("'%s' has a semantic predicate, which has no equivalent in %s.", v.r.Name, dialectNames[v.e.dialect]))
+	v.set("''", precPrimary)
+}
+func (v *exportPrinter) visitReference(ope *reference) {
+	if v.e.dialect == dialectCppPeglib {
+		s := cppName(ope.name)
+		if ope.args != nil {
+			var l []string
+			for _, arg := range ope.args {
+				l = append(l, v.opeToS(arg, precChoice))
+			}
+			s += "(" + strings.Join(l, ", ") + ")"
+		}
+		v.set(s, precPrimary)
+		return
+	}
+
+	switch {
+	case ope.rule == nil:
+		// Parameter of the macro being expanded
+		arg := v.env[ope.iarg]
+		in := v.e.print(v.r, arg.ope, v.mode, arg.env)
+		v.set(in.s, in.prec)
+	case ope.rule.Parameters != nil:
+		// Macros are expanded
+		r := ope.rule
+		if v.e.macros[r] {
+			v.e.diag(v.r, fmt.Sprintf("'%s' is a recursive macro, which can't be expanded.", r.Name))
+			v.set("''", precPrimary)
+			return
+		}
+		var args []exportArg
+		for _, arg := range ope.args {
+			args = append(args, exportArg{arg, v.env})
+		}
+		v.e.macros[r] = true
+		in := v.e.print(v.r, r.Ope, v.mode, args)
+		v.set(in.s, in.prec)
+		delete(v.e.macros, r)
+	default:
+		v.set(v.e.ref(exportKey{ope.rule, v.mode}), precPrimary)
+	}
+}
+func (v *exportPrinter) visitRule(ope *Rule) {
+	if v.e.dialect == dialectCppPeglib {
+		v.set(ope.Name, precPrimary)
+		return
+	}
+	v.set(v.e.ref(exportKey{ope, v.mode}), precPrimary)
+}
+func (v *exportPrinter) visitWhitespace(ope *whitespace) {
+	ope.ope.accept(v)
+}
+func (v *exportPrinter) visitExpression(ope *expression) {
+	t := ope.table
+	if len(t.prefix) > 0 || len(t.postfix) > 0 || len(t.prefixOpes) > 0 || len(t.postfixOpes) > 0 {
+		v.e.diag(v.r, fmt.Sprintf("'%s' has prefix or postfix operators, which have no equivalent in %s.", v.r.Name, dialectNames[v.e.dialect]))
+	}
+	if len(t.ternary) > 0 {
+		v.e.diag(v.r, fmt.Sprintf("'%s' has a ternary operator, which has no equivalent in %s.", v.r.Name, dialectNames[v.e.dialect]))
+	}
+	Seq(ope.atom, Zom(Seq(ope.binop, ope.atom))).accept(v)
+}
+
+// cppName makes name of an imported rule such as 'common.Identifier' an
+// identifier in cpp-peglib.
+func cppName(name string) string {
+	return strings.ReplaceAll(name, ".", "_")
+}
+
+// exportName makes name an identifier in JavaScript and Go.
+func exportName(name string) string {
+	name = strings.TrimPrefix(name, "%")
+	var b strings.Builder
+	for i, ch := range name {
+		if ch == '_' || unicode.IsLetter(ch) || (i > 0 && unicode.IsDigit(ch)) {
+			b.WriteRune(ch)
+		} else {
+			b.WriteByte('_')
+		}
+	}
+	return b.String()
+}
+
+// classRanges tells if ope matches a character in ranges in UTF-8, or a
+// character not in them if negated, such as classes of ASCII characters and
+// the operators made by runeClass.
+func classRanges(ope operator) (ranges [][2]rune, negated bool, ok bool) {
+	switch ope := ope.(type) {
+	case *characterClass:
+		chars := ope.chars
+		for i := 0; i < len(chars); {
+			lo, hi := chars[i], chars[i]
+			if i+2 < len(chars) && chars[i+1] == '-' {
+				hi = chars[i+2]
+				i += 3
+			} else {
+				i++
+			}
+			if lo >= utf8.RuneSelf || hi >= utf8.RuneSelf {
+				return nil, false, false
+			}
+			ranges = append(ranges, [2]rune{rune(lo), rune(hi)})
+		}
+		return ranges, false, len(ranges) > 0
+	case *sequence:
+		if len(ope.opes) == 2 {
+			if npd, ok := ope.opes[0].(*notPredicate); ok {
+				any, negated, ok := classRanges(ope.opes[1])
+				if !ok || negated || !isAnyRune(any) {
+					return nil, false, false
+				}
+				ranges, negated, ok := classRanges(npd.ope)
+				return ranges, true, ok && !negated
+			}
+		}
+		r, ok := utf8Range(ope.opes)
+		return [][2]rune{r}, false, ok
+	case *prioritizedChoice:
+		for _, o := range ope.opes {
+			r, negated, ok := classRanges(o)
+			if !ok || negated {
+				return nil, false, false
+			}
+			ranges = append(ranges, r...)
+		}
+		return ranges, false, true
+	}
+	return nil, false, false
+}
+
+// withoutSurrogates removes surrogates, such as the ones of '\p{Cs}', from
+// ranges. They aren't characters in UTF-8, so classes never match them.
+func withoutSurrogates(ranges [][2]rune) [][2]rune {
+	var l [][2]rune
+	for _, r := range ranges {
+		if r[0] < 0xd800 {
+			l = append(l, [2]rune{r[0], min(r[1], 0xd7ff)})
+		}
+		if r[1] > 0xdfff {
+			l = append(l, [2]rune{max(r[0], 0xe000), r[1]})
+		}
+	}
+	return l
+}
+
+// utf8Range tells if the sequence of classes matches the characters from lo
+// to hi in UTF-8, as made by appendUTF8Range.
+func utf8Range(opes []operator) ([2]rune, bool) {
+	n := len(opes)
+	if n < 2 || n > utf8.UTFMax {
+		return [2]rune{}, false
+	}
+	lo := make([]byte, n)
+	hi := make([]byte, n)
+	for i, o := range opes {
+		cls, ok := o.(*characterClass)
+		if !ok {
+			return [2]rune{}, false
+		}
+		switch {
+		case len(cls.chars) == 1:
+			lo[i], hi[i] = cls.chars[0], cls.chars[0]
+		case len(cls.chars) == 3 && cls.chars[1] == '-':
+			lo[i], hi[i] = cls.chars[0], cls.chars[2]
+		default:
+			return [2]rune{}, false
+		}
+	}
+
+	// The bytes after the first which differs must be any
+	differs := false
+	for i := range lo {
+		if differs && (lo[i] != 0x80 || hi[i] != 0xbf) {
+			return [2]rune{}, false
+		}
+		differs = differs || lo[i] != hi[i]
+	}
+
+	l, ln := utf8.DecodeRune(lo)
+	h, hn := utf8.DecodeRune(hi)
+	if l == utf8.RuneError || h == utf8.RuneError || ln != n || hn != n {
+		return [2]rune{}, false
+	}
+	return [2]rune{l, h}, true
+}
+
+// isAnyRune tells if ranges have all characters in UTF-8.
+func isAnyRune(ranges [][2]rune) bool {
+	sorted := append([][2]rune(nil), ranges...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i][0] < sorted[j][0] })
+	next := rune(0)
+	for _, r := range sorted {
+		if r[0] > next && !(next == 0xd800 && r[0] == 0xe000) {
+			return false
+		}
+		next = max(next, r[1]+1)
+	}
+	return next > unicode.MaxRune
+}
@@ -0,0 +1,267 @@
+package peg
+
+import (
+	"strings"
+	"testing"
+)
+
+// Grammars and sources for the round-trip tests
+var exportTests = []struct {
+	grammar string
+	sources []string
+}{
+	{`
+		PROGRAM     <- STATEMENT*
+		STATEMENT   <- 'if' EXPR BLOCK / 'print' LIST(EXPR, ',') ';'
+		BLOCK       <- '{' STATEMENT* '}' { error_message "missing block" }
+		EXPR        <- ATOM (BINOP ATOM)*
+		ATOM        <- NUMBER / IDENT / '(' EXPR ')'
+		BINOP       <- < [-+*/^] >
+		NUMBER      <- < '-'? [0-9]+ >
+		~IDENT      <- < [a-zA-Z_] [a-zA-Z0-9_]* >
+		LIST(I, D)  <- I (D I)*
+		%whitespace <- [ \t\r\n]*
+		%word       <- [a-zA-Z0-9_]+
+		---
+		%expr  = EXPR
+		%binop = L + -
+		%binop = L * /
+		%binop = R ^
+	`, []string{
+		"print 1 + 2 * 3 ^ 4 ^ 5 - 6;",
+		"if x { print a, (b - c) / d; }",
+		"ifx { print 1; }",
+		"if x { print 1 }",
+		"  print -1;\n",
+		"printx;",
+	}},
+	{`
+		LINE   <- ENTRY (',' ENTRY)* EOL?
+		ENTRY  <- < KEY > '=' < VALUE >
+		KEY    <- NAME ('.' NAME)*
+		NAME   <- [a-z]+
+		VALUE  <- QUOTED / (!',' !EOL .)*
+		QUOTED <- '"' ('\\' . / !'"' .)* '"'
+		EOL    <- '\r\n' / '\n'
+	`, []string{
+		`a=1,b.c="x,\"y",d=`,
+		"a.b=c\n",
+		"a=b,",
+		"A=1",
+	}},
+	{`
+		S           <- A / B
+		A           <- < WORD > WORD
+		B           <- WORD '?'
+		WORD        <- [a-z]+ / '(' WORD ')'
+		%whitespace <- ([ \t] / '#' (!'\n' .)* '\n')*
+	`, []string{
+		"abc def",
+		"(abc) # note\n def",
+		"abc ?",
+		"( abc) def",
+		"abc (def)",
+	}},
+	{`
+		LIST        <- ITEM (',' ITEM)*
+		ITEM        <- 'nil' / '[' LIST ']'
+		%whitespace <- [ \t]*
+		%word       <- [a-z]+
+		---
+		%start = ITEM
+	`, []string{
+		" [nil, [nil]] ",
+		"nil",
+		"nil, nil",
+		"nilx",
+	}},
+	{`
+		DATE  <- YEAR '-' MONTH '-' DAY (' ' HEX{2,})?
+		YEAR  <- [0-9]{4}
+		MONTH <- [0-9]{1,2}
+		DAY   <- [0-9]{,2}
+		HEX   <- [0-9a-f]
+	`, []string{
+		"2024-01-15",
+		"2024-1-5 ff0",
+		"2024-1- ",
+		"202-01-01",
+		"2024-123-01",
+		"2024-01-15 f",
+	}},
+	{`
+		IDENT <- [\p{Lu}_] [\p{Ll}\u{3041}-\u{3093}]* \p{Greek}?
+	`, []string{
+		"Aabc",
+		"_あい",
+		"Abα",
+		"abc",
+		"Aα1",
+	}},
+}
+
+func TestExportCppPeglib(t *testing.T) {
+	for _, test := range exportTests {
+		p, err := NewParser(test.grammar)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, err := ExportCppPeglib(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		q, err := NewParser(s)
+		if err != nil {
+			t.Fatalf("%s\n%s", err, s)
+		}
+
+		p.EnableAst()
+		q.EnableAst()
+		for _, src := range test.sources {
+			a, aerr := p.ParseAndGetAst(src, nil)
+			b, berr := q.ParseAndGetAst(src, nil)
+			if (aerr == nil) != (berr == nil) || (aerr == nil && !a.Equal(b)) {
+				t.Errorf("%q: %v %v\n%s", src, aerr, berr, s)
+			}
+			if aerr != nil && berr != nil && aerr.Error() != berr.Error() {
+				t.Errorf("%q: %v %v", src, aerr, berr)
+			}
+		}
+	}
+}
+
+func TestExportCppPeglibSyntax(t *testing.T) {
+	p, err := NewParser(test1Grammar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := ExportCppPeglib(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, strings.Contains(s, "EXPR   <- ATOM (BINOP ATOM)* { precedence L + - L * / }\n"))
+	assert(t, !strings.Contains(s, "%expr"))
+
+	p, err = NewParserFromPEGjs(`start = [^a-z\]^é] "é" .`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err = ExportCppPeglib(p)
+	assert(t, err == nil && s == "start <- [^a-z\\]^é] 'é' .\n")
+
+	p, err = NewParser(`
+		A <- [\x80-\xff] B
+		B <- 'é' '\xff'
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ExportCppPeglib(p)
+	pe, ok := err.(*Error)
+	if !ok {
+		t.Fatal(err)
+	}
+	assert(t, len(pe.Details) == 2)
+	assert(t, pe.Details[0].Ln == 2 && pe.Details[0].Msg == "'A' has a class of bytes which aren't characters in UTF-8, which cpp-peglib doesn't support.")
+	assert(t, pe.Details[1].Ln == 3 && pe.Details[1].Msg == "'B' has bytes which aren't characters in UTF-8, which cpp-peglib doesn't support.")
+
+	// Classes of characters in UTF-8 have no surrogates
+	p, err = NewParser(`
+		A <- [\p{Cs}a] B
+		B <- [\u{D000}-\u{E000}ぁ-ん]
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err = ExportCppPeglib(p)
+	assert(t, err == nil && s == "A <- [a] B\nB <- [\ud000-\ud7ff\ue000ぁ-ん]\n")
+
+	p, err = NewParser(test1Grammar + "%binop = N ==\n%prefix = -\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ExportCppPeglib(p)
+	pe, ok = err.(*Error)
+	if !ok {
+		t.Fatal(err)
+	}
+	assert(t, len(pe.Details) == 2)
+	assert(t, pe.Details[0].Ln == 2 && pe.Details[0].Msg == "'EXPR' has prefix or postfix operators, which have no equivalent in cpp-peglib.")
+	assert(t, pe.Details[1].Ln == 2 && pe.Details[1].Msg == "'EXPR' has a non-associative operator, which has no equivalent in cpp-peglib.")
+}
+
+var test1Grammar = `
+	EXPR   <- ATOM (BINOP ATOM)*
+	ATOM   <- NUMBER / '(' EXPR ')'
+	BINOP  <- < [-+/*] >
+	NUMBER <- < [0-9]+ >
+	---
+	%expr  = EXPR
+	%binop = L + -
+	%binop = L * /
+`
+
+func TestExportPEGjs(t *testing.T) {
+	exports := map[string]func(*Parser) (string, error){
+		"PEG.js": ExportPEGjs,
+		"pigeon": ExportPigeon,
+	}
+	for dialect, export := range exports {
+		for _, test := range exportTests {
+			p, err := NewParser(test.grammar)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s, err := export(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			q, err := NewParserFromPEGjs(s)
+			if err != nil {
+				t.Fatalf("%s: %s\n%s", dialect, err, s)
+			}
+
+			for _, src := range test.sources {
+				aerr := p.Parse(src, nil)
+				berr := q.Parse(src, nil)
+				if (aerr == nil) != (berr == nil) {
+					t.Errorf("%s: %q: %v %v\n%s", dialect, src, aerr, berr, s)
+				}
+			}
+		}
+	}
+}
+
+func TestExportPEGjsSyntax(t *testing.T) {
+	p, err := NewParser(`
+		S           <- < A > A 'x'
+		A           <- 'a' / '(' A ')'
+		%whitespace <- ' '*
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := ExportPEGjs(p)
+	assert(t, err == nil)
+	assert(t, s == `start      = whitespace S
+S          = $A_token whitespace A "x" whitespace
+A          = "a" whitespace / "(" whitespace A ")" whitespace
+A_token    = "a" / "(" A_token ")"
+whitespace = " "*
+`)
+
+	s, err = ExportPigeon(p)
+	assert(t, err == nil)
+	assert(t, strings.HasPrefix(s, "start      <- whitespace S\nS          <- A_token whitespace A \"x\" whitespace\n"))
+
+	p, err = NewParser(`
+		A       <- LIST('a')
+		LIST(X) <- X LIST(X)?
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ExportPEGjs(p)
+	assert(t, err != nil && err.Error() == "2:3 'LIST' is a recursive macro, which can't be expanded.")
+}
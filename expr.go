@@ -1,112 +1,335 @@
 package peg
 
-const (
-	assocNone = iota
-	assocLeft
-	assocRight
-)
+import "fmt"
 
 type BinOpeInfo map[string]struct {
 	level int
 	assoc int
 }
 
+// Forms of the operators, which the action of an expression rule gets in
+// Values.Form with the values in the comments.
+const (
+	ExprBinary  = iota // lhs, op, rhs
+	ExprPrefix         // op, operand
+	ExprPostfix        // operand, op
+	ExprTernary        // cond, op1, mid, op2, rhs
+)
+
 // Expression parsing
 type expression struct {
 	opeBase
 	atom   operator
 	binop  operator
-	bopinf BinOpeInfo
+	table  *OperatorTable
 	action *Action
 }
 
 func (o *expression) parseExpr(s string, p int, v *Values, c *context, d Any, minPrec int) (l int) {
-	l = o.atom.parse(s, p, v, c, d)
-	if fail(l) {
-		return
-	}
-
 	var tok string
-	r := o.binop.(*reference).rule
-	action := r.Action
-	r.Action = func(v *Values, d Any) (val Any, err error) {
-		tok = v.Token()
-		if action != nil {
-			val, err = action(v, d)
-		} else if len(v.Vs) > 0 {
-			val = v.Vs[0]
+	if r := o.binopRule(); r != nil {
+		action := r.Action
+		r.Action = func(v *Values, d Any) (val Any, err error) {
+			tok = operatorToken(v.Token())
+			if action != nil {
+				val, err = action(v, d)
+			} else if len(v.Vs) > 0 {
+				val = v.Vs[0]
+			} else {
+				val = tok
+			}
+			return val, err
 		}
-		return val, err
+		defer func() { r.Action = action }()
 	}
-	defer func() { r.Action = action }()
 
+	t := o.table
 	saveErrorPos := c.errorPos
 
+	l = -1
+	if len(t.prefix) > 0 || len(t.prefixOpes) > 0 {
+		l = o.parsePrefix(s, p, v, c, d, minPrec, &tok)
+	}
+	if fail(l) {
+		n := len(v.Vs)
+		l = o.atom.parse(s, p, v, c, d)
+		if fail(l) {
+			return
+		}
+		// The text is the value of an atom without one, as with operators
+		if len(v.Vs) == n {
+			v.Vs = append(v.Vs, s[p:p+l])
+		}
+	}
+
+	last := -1 // Level of the last binary operator
 	for p+l < len(s) {
 		saveVs := v.Vs
 		saveTs := v.Ts
+		saveCs := v.cs
+		restore := func() {
+			v.Vs = saveVs
+			v.Ts = saveTs
+			v.cs = saveCs
+			c.errorPos = saveErrorPos
+		}
 
-		chv := c.push()
-		chl := o.binop.parse(s, p+l, chv, c, d)
-		c.pop()
+		// Postfix operators matched by expressions
+		if val, cs, chl, ope := o.matchOpes(t.postfixOpes, s, p+l, c, d); success(chl) {
+			if ope.Level < minPrec {
+				break
+			}
+			v.Vs = append(v.Vs, val)
+			v.cs = append(v.cs, cs...)
+			l += chl
+			if !o.reduce(s, p, l, v, c, d, ExprPostfix, ope.Action) {
+				l = -1
+				restore()
+				break
+			}
+			continue
+		}
 
+		val, cs, chl := o.parseOperator(s, p+l, c, d, &tok)
 		if fail(chl) {
 			c.errorPos = saveErrorPos
 			break
 		}
 
-		inf, ok := o.bopinf[tok]
-		if !ok || inf.level < minPrec {
+		if ope, ok := t.postfix[tok]; ok {
+			if ope.Level < minPrec {
+				break
+			}
+			v.Vs = append(v.Vs, val)
+			v.cs = append(v.cs, cs...)
+			l += chl
+			if !o.reduce(s, p, l, v, c, d, ExprPostfix, ope.Action) {
+				l = -1
+				restore()
+				break
+			}
+			continue
+		}
+
+		if ope, ok := t.ternary[tok]; ok {
+			if ope.Level < minPrec {
+				break
+			}
+			if chl = o.parseTernary(s, p+l, v, c, d, val, cs, chl, ope, &tok); fail(chl) {
+				restore()
+				break
+			}
+			l += chl
+			if !o.reduce(s, p, l, v, c, d, ExprTernary, ope.Action) {
+				l = -1
+				restore()
+				break
+			}
+			continue
+		}
+
+		ope, ok := t.binary[tok]
+		if !ok || ope.Level < minPrec {
 			break
 		}
 
-		v.Vs = append(v.Vs, chv.Vs[0])
+		// A non-associative operator can't follow one of the same level
+		if ope.Assoc == AssocNone && ope.Level == last {
+			break
+		}
+
+		v.Vs = append(v.Vs, val)
+		v.cs = append(v.cs, cs...)
 		l += chl
 
-		nextMinPrec := inf.level
-		if inf.assoc == assocLeft {
-			nextMinPrec = inf.level + 1
+		nextMinPrec := ope.Level
+		if ope.Assoc != AssocRight {
+			nextMinPrec = ope.Level + 1
 		}
 
-		chv = c.push()
+		chv := c.push()
 		chl = o.parseExpr(s, p+l, chv, c, d, nextMinPrec)
 		c.pop()
 
 		if fail(chl) {
-			v.Vs = saveVs
-			v.Ts = saveTs
-			c.errorPos = saveErrorPos
+			restore()
 			break
 		}
 
 		v.Vs = append(v.Vs, chv.Vs[0])
+		v.cs = append(v.cs, chv.cs...)
 		l += chl
 
-		var val Any
-		if *o.action != nil {
-			v.S = s[p : p+l]
-			v.Pos = p
-
-			var err error
-			if val, err = (*o.action)(v, d); err != nil {
-				if c.messagePos < p {
-					c.messagePos = p
-					c.message = err.Error()
-				}
-				l = -1
-				v.Vs = saveVs
-				v.Ts = saveTs
-				c.errorPos = saveErrorPos
-				break
+		if !o.reduce(s, p, l, v, c, d, ExprBinary, ope.Action) {
+			l = -1
+			restore()
+			break
+		}
+		last = ope.Level
+	}
+
+	return
+}
+
+// binopRule returns the rule of the operator, or nil if the operator isn't a
+// reference to a rule.
+func (o *expression) binopRule() *Rule {
+	if ref, ok := o.binop.(*reference); ok {
+		return ref.rule
+	}
+	return nil
+}
+
+// parseOperator parses an operator at p, and returns the value, the nodes
+// and the length of the operator. The token of the operator is set to tok,
+// which the action of the rule of the operator sets if there is the rule.
+func (o *expression) parseOperator(s string, p int, c *context, d Any, tok *string) (val Any, cs []*Ast, l int) {
+	chv := c.push()
+	l = o.binop.parse(s, p, chv, c, d)
+	c.pop()
+	if fail(l) {
+		return nil, nil, l
+	}
+
+	if o.binopRule() == nil {
+		if len(chv.Ts) > 0 {
+			*tok = operatorToken(chv.Ts[0].S)
+		} else {
+			*tok = operatorToken(s[p : p+l])
+		}
+	}
+	val = *tok
+	if len(chv.Vs) > 0 {
+		val = chv.Vs[0]
+	}
+	return val, chv.cs, l
+}
+
+// parsePrefix parses a prefix operator and its operand, which has the
+// operators of the higher levels than the operator.
+func (o *expression) parsePrefix(s string, p int, v *Values, c *context, d Any, minPrec int, tok *string) int {
+	saveErrorPos := c.errorPos
+
+	val, cs, chl, ope := o.matchOpes(o.table.prefixOpes, s, p, c, d)
+	if fail(chl) {
+		if val, cs, chl = o.parseOperator(s, p, c, d, tok); success(chl) {
+			ope = o.table.prefix[*tok]
+		}
+		if ope == nil {
+			c.errorPos = saveErrorPos
+			return -1
+		}
+	}
+
+	level := ope.Level
+	if level < minPrec {
+		level = minPrec
+	}
+	chv := c.push()
+	opl := o.parseExpr(s, p+chl, chv, c, d, level)
+	c.pop()
+
+	if fail(opl) {
+		return -1
+	}
+
+	v.Vs = append(v.Vs, val, chv.Vs[0])
+	v.cs = append(append(v.cs, cs...), chv.cs...)
+	l := chl + opl
+	if !o.reduce(s, p, l, v, c, d, ExprPrefix, ope.Action) {
+		v.Vs = nil
+		v.cs = nil
+		return -1
+	}
+	return l
+}
+
+// parseTernary parses the rest of a ternary operator after the first
+// operator, which has the value val and the nodes cs and is chl long. The
+// middle operand is parsed as a whole expression, and the last operand has
+// the operators of the same level, so 'a ? b : c ? d : e' is
+// 'a ? b : (c ? d : e)'.
+func (o *expression) parseTernary(s string, p int, v *Values, c *context, d Any, val Any, cs []*Ast, chl int, ope *Operator, tok *string) int {
+	vals := []Any{val}
+	l := chl
+
+	chv := c.push()
+	chl = o.parseExpr(s, p+l, chv, c, d, 0)
+	c.pop()
+	if fail(chl) {
+		return -1
+	}
+	vals = append(vals, chv.Vs[0])
+	cs = append(cs, chv.cs...)
+	l += chl
+
+	val, opcs, chl := o.parseOperator(s, p+l, c, d, tok)
+	if fail(chl) || *tok != ope.Second {
+		return -1
+	}
+	vals = append(vals, val)
+	cs = append(cs, opcs...)
+	l += chl
+
+	chv = c.push()
+	chl = o.parseExpr(s, p+l, chv, c, d, ope.Level)
+	c.pop()
+	if fail(chl) {
+		return -1
+	}
+	v.Vs = append(append(v.Vs, vals...), chv.Vs[0])
+	v.cs = append(append(v.cs, cs...), chv.cs...)
+	return l + chl
+}
+
+// matchOpes parses the first of the operators matched by expressions at p,
+// and returns the value, the nodes and the length of the operator, and the
+// operator.
+func (o *expression) matchOpes(opes []*Operator, s string, p int, c *context, d Any) (val Any, cs []*Ast, l int, ope *Operator) {
+	saveErrorPos := c.errorPos
+	for _, ope := range opes {
+		chv := c.push()
+		l = ope.Ope.parse(s, p, chv, c, d)
+		c.pop()
+		if success(l) {
+			if len(chv.Vs) > 0 {
+				val = chv.Vs[0]
 			}
-		} else if len(v.Vs) > 0 {
-			val = v.Vs[0]
+			return val, chv.cs, l, ope
 		}
+	}
+	c.errorPos = saveErrorPos
+	return nil, nil, -1, nil
+}
 
-		v.Vs = []Any{val}
+// reduce calls the action of the operator, or the action of the expression
+// without one, with the operands and the operators in v, which are in form,
+// and leaves only the value in v. Without an action, the value is the first
+// operand.
+func (o *expression) reduce(s string, p int, l int, v *Values, c *context, d Any, form int, act Action) bool {
+	val := v.Vs[0]
+	if form == ExprPrefix {
+		val = v.Vs[1]
 	}
+	if act == nil && o.action != nil {
+		act = *o.action
+	}
+	if act != nil {
+		v.S = s[p : p+l]
+		v.Pos = p
+		v.Form = form
 
-	return
+		var err error
+		if val, err = act(v, d); err != nil {
+			if c.messagePos < p {
+				c.messagePos = p
+				c.message = err.Error()
+			}
+			return false
+		}
+	}
+	v.Vs = []Any{val}
+	return true
 }
 
 func (o *expression) parseCore(s string, p int, v *Values, c *context, d Any) (l int) {
@@ -119,29 +342,67 @@ func (o *expression) accept(v visitor) {
 }
 
 func Exp(atom operator, binop operator, bopinf BinOpeInfo, action *Action) operator {
-	o := &expression{atom: atom, binop: binop, bopinf: bopinf, action: action}
+	return ExpWithTable(atom, binop, binOpeTable(bopinf), action)
+}
+
+// ExpWithTable parses the expression of atom and the operators in t, which
+// binop matches. The token of binop is the token of the operator, and its
+// value is passed to the actions. atom is expected to push one value such as
+// a reference to a rule does, and the text is the value of an atom which
+// pushes none. The table can be changed while parsing.
+func ExpWithTable(atom operator, binop operator, t *OperatorTable, action *Action) operator {
+	o := &expression{atom: atom, binop: binop, table: t, action: action}
 	o.derived = o
 	return o
 }
 
 func EnableExpressionParsing(p *Parser, name string, bopinf BinOpeInfo) error {
-	if r, ok := p.Grammar[name]; ok {
-		seq := r.Ope.(*sequence)
-		atom := seq.opes[0].(*reference)
-		opes := seq.opes[1].(*zeroOrMore).ope.(*sequence).opes
-		atom1 := opes[1].(*reference)
-		binop := opes[0].(*reference)
+	r, ok := p.Grammar[name]
+	if !ok {
+		return fmt.Errorf("peg: '%s' is not defined", name)
+	}
+	if _, _, ok := expressionOperands(r); !ok {
+		ln, col := lineInfo(r.SS, r.Pos)
+		msg := "'" + name + "' must be in the form of 'ATOM (OPERATOR ATOM)*'."
+		return &Error{Details: []ErrorDetail{{ln, col, msg}}}
+	}
+	enableExpressionParsing(r, binOpeTable(bopinf))
+	return nil
+}
 
-		if atom.name != atom1.name {
-			err := &Error{}
-			ln, col := lineInfo(r.SS, r.Pos)
-			msg := "expression syntax error"
-			err.Details = append(err.Details, ErrorDetail{ln, col, msg})
-			return err
-		}
+// enableExpressionParsing makes the rule in the form of 'ATOM (OPERATOR
+// ATOM)*' parse the operators in t.
+func enableExpressionParsing(r *Rule, t *OperatorTable) {
+	atom, binop, _ := expressionOperands(r)
+	r.Ope = ExpWithTable(atom, binop, t, &r.Action)
+	r.disableAction = true
+}
 
-		r.Ope = Exp(atom, binop, bopinf, &r.Action)
-		r.disableAction = true
+// expressionOperands returns the atom and the operator of the rule in the
+// form of 'ATOM (OPERATOR ATOM)*', where both are references to rules.
+func expressionOperands(r *Rule) (atom, binop *reference, ok bool) {
+	isRule := func(ope operator) (*reference, bool) {
+		ref, ok := ope.(*reference)
+		return ref, ok && ref.rule != nil && ref.rule.Parameters == nil && ref.args == nil
 	}
-	return nil
+
+	seq, ok := r.Ope.(*sequence)
+	if !ok || len(seq.opes) != 2 || r.Parameters != nil {
+		return nil, nil, false
+	}
+	zom, ok := seq.opes[1].(*zeroOrMore)
+	if !ok {
+		return nil, nil, false
+	}
+	rest, ok := zom.ope.(*sequence)
+	if !ok || len(rest.opes) != 2 {
+		return nil, nil, false
+	}
+	atom, ok1 := isRule(seq.opes[0])
+	binop, ok2 := isRule(rest.opes[0])
+	atom1, ok3 := isRule(rest.opes[1])
+	if !ok1 || !ok2 || !ok3 || atom.rule != atom1.rule {
+		return nil, nil, false
+	}
+	return atom, binop, true
 }
@@ -0,0 +1,493 @@
+package peg
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// GrammarPrinter prints grammars back to PEG text in a canonical form. Each
+// definition takes one line, except that a choice written over several lines
+// keeps an alternative per line. Operands are separated by a single space,
+// literals and classes are quoted and escaped uniformly, at most one blank
+// line is kept between definitions, and arrows and '=' of options are
+// aligned within each block of lines between blank lines.
+type GrammarPrinter struct {
+	Arrow string // "<-" or "←"
+}
+
+func NewGrammarPrinter() *GrammarPrinter {
+	return &GrammarPrinter{Arrow: "<-"}
+}
+
+// FormatGrammar formats grammar source with the default printer.
+func FormatGrammar(s string) (string, error) {
+	return NewGrammarPrinter().Format(s)
+}
+
+// Format formats grammar source. The grammar is parsed but not linked, so
+// it may refer to undefined rules. Comments are kept. Comments inside a
+// definition are moved above it.
+func (pr *GrammarPrinter) Format(s string) (string, error) {
+	data := newData()
+	data.comments = make(map[int]string)
+	if _, _, err := rStart.Parse(s, data); err != nil {
+		return "", err
+	}
+
+	f := &grammarFormatter{pr: pr, s: s, commentEnds: make(map[int]int)}
+	for pos, text := range data.comments {
+		f.commentEnds[pos+len(text)] = pos
+	}
+
+	for _, imp := range data.imports {
+		head := "%import "
+		if len(imp.name) > 0 {
+			head += imp.name + " "
+		}
+		head += quoteLiteral(imp.path)
+		f.items = append(f.items, &grammarItem{pos: imp.pos, end: f.contentEnd(imp.end), head: head})
+	}
+	for _, def := range data.definitions {
+		end := f.contentEnd(def.end)
+		multiline := strings.Contains(s[def.rule.Pos:end], "\n")
+		f.items = append(f.items, pr.definitionItem(def.rule, def.rule.Pos, end, multiline))
+	}
+	if data.separatorPos != -1 {
+		f.items = append(f.items, &grammarItem{pos: data.separatorPos, end: data.separatorPos + 3, head: "---"})
+	}
+	for _, opt := range data.optionList {
+		f.items = append(f.items, optionItem(opt, opt.pos, f.contentEnd(opt.end)))
+	}
+	f.items = append(f.items, &grammarItem{pos: len(s), end: len(s)})
+
+	var positions []int
+	for pos := range data.comments {
+		positions = append(positions, pos)
+	}
+	sort.Ints(positions)
+	for _, pos := range positions {
+		f.attachComment(pos, data.comments[pos])
+	}
+
+	return f.render(), nil
+}
+
+// Print prints the grammar of p, including the options, in the order of
+// definition. Rules given to NewParserWithUserRules are left out.
+func (pr *GrammarPrinter) Print(p *Parser) string {
+	var rules []*Rule
+	for _, r := range p.Grammar {
+		if len(r.SS) > 0 {
+			rules = append(rules, r)
+		}
+	}
+	sort.Slice(rules, func(i, j int) bool {
+		if rules[i].Pos != rules[j].Pos {
+			return rules[i].Pos < rules[j].Pos
+		}
+		return rules[i].Name < rules[j].Name
+	})
+
+	f := &grammarFormatter{pr: pr}
+	for _, r := range rules {
+		f.items = append(f.items, pr.definitionItem(r, -1, -1, false))
+	}
+	if len(p.options) > 0 {
+		f.items = append(f.items, &grammarItem{pos: -1, head: "---"})
+	}
+	for _, opt := range p.options {
+		f.items = append(f.items, optionItem(opt, -1, -1))
+	}
+	return f.render()
+}
+
+// grammarItem is a definition, the separator or an option.
+type grammarItem struct {
+	pos, end int // Content in the source, or -1
+	head     string
+	sep      string
+	lines    []string
+	leading  []grammarComment
+	trailing string
+}
+
+type grammarComment struct {
+	pos  int // -1 for comments moved out of a definition
+	text string
+}
+
+func (pr *GrammarPrinter) definitionItem(r *Rule, pos, end int, multiline bool) *grammarItem {
+	head := r.Name
+	if r.Ignore {
+		head = "~" + head
+	}
+	if r.Parameters != nil {
+		head += "(" + strings.Join(r.Parameters, ", ") + ")"
+	}
+
+	ope := r.Ope
+	if ex, ok := ope.(*expression); ok {
+		ope = Seq(ex.atom, Zom(Seq(ex.binop, ex.atom)))
+	}
+
+	var lines []string
+	if cho, ok := ope.(*prioritizedChoice); ok && multiline {
+		for _, o := range cho.opes {
+			lines = append(lines, opeToS(o, precSequence))
+		}
+	} else {
+		lines = []string{opeToS(ope, precChoice)}
+	}
+	var items []string
+	if len(r.ErrorMessage) > 0 {
+		items = append(items, "error_message "+quoteLiteral(r.ErrorMessage))
+	}
+	if len(r.precedence) > 0 {
+		items = append(items, "precedence "+precedenceToS(r.precedence, quoteLiteral))
+	}
+	if len(items) > 0 {
+		lines[len(lines)-1] += " { " + strings.Join(items, "; ") + " }"
+	}
+
+	return &grammarItem{pos: pos, end: end, head: head, sep: pr.Arrow, lines: lines}
+}
+
+func optionItem(opt grammarOption, pos, end int) *grammarItem {
+	return &grammarItem{pos: pos, end: end, head: opt.name, sep: "=", lines: []string{opt.value}}
+}
+
+// grammarFormatter
+type grammarFormatter struct {
+	pr          *GrammarPrinter
+	s           string
+	commentEnds map[int]int
+	items       []*grammarItem // Ends with an empty item for the end of file
+}
+
+// contentEnd returns end without the whitespace and comments before it.
+func (f *grammarFormatter) contentEnd(end int) int {
+	for {
+		end = len(strings.TrimRightFunc(f.s[:end], unicode.IsSpace))
+		pos, ok := f.commentEnds[end]
+		if !ok {
+			return end
+		}
+		end = pos
+	}
+}
+
+// attachComment puts a comment after the item on the same line, or before
+// the item which follows it.
+func (f *grammarFormatter) attachComment(pos int, text string) {
+	var owner, next *grammarItem
+	for _, item := range f.items {
+		if item.pos <= pos {
+			owner = item
+		} else if next == nil {
+			next = item
+		}
+	}
+
+	if owner != nil && pos < owner.end {
+		owner.leading = append(owner.leading, grammarComment{-1, text})
+		return
+	}
+
+	lineStart := strings.LastIndex(f.s[:pos], "\n") + 1
+	if owner != nil && len(strings.TrimSpace(f.s[lineStart:pos])) > 0 {
+		owner.trailing = text
+		owner.end = pos + len(text)
+		return
+	}
+	next.leading = append(next.leading, grammarComment{pos, text})
+}
+
+// blankLine tells if there is a blank line in the source between the
+// positions.
+func (f *grammarFormatter) blankLine(from, to int) bool {
+	return from >= 0 && to >= 0 && strings.Count(f.s[from:to], "\n") > 1
+}
+
+func (f *grammarFormatter) render() string {
+	type row struct {
+		item    *grammarItem // nil for comments and blank lines
+		comment string
+	}
+	var rows []row
+
+	prevEnd := -1
+	for _, item := range f.items {
+		for _, c := range item.leading {
+			if len(rows) > 0 && f.blankLine(prevEnd, c.pos) {
+				rows = append(rows, row{})
+			}
+			rows = append(rows, row{comment: c.text})
+			if c.pos >= 0 {
+				prevEnd = c.pos + len(c.text)
+			}
+		}
+		if len(item.head) == 0 {
+			continue
+		}
+		if len(rows) > 0 && f.blankLine(prevEnd, item.pos) {
+			rows = append(rows, row{})
+		}
+		rows = append(rows, row{item: item})
+		prevEnd = item.end
+	}
+
+	// Align the items in each block
+	widths := make([]int, len(rows))
+	for i := 0; i < len(rows); {
+		j, w := i, 0
+		for ; j < len(rows); j++ {
+			item := rows[j].item
+			if item == nil && len(rows[j].comment) == 0 {
+				break // Blank line
+			}
+			if item != nil && len(item.sep) == 0 {
+				break // Separator
+			}
+			if item != nil {
+				if n := utf8.RuneCountInString(item.head); n > w {
+					w = n
+				}
+			}
+		}
+		for k := i; k < j; k++ {
+			widths[k] = w
+		}
+		i = j + 1
+	}
+
+	var b strings.Builder
+	for i, r := range rows {
+		switch {
+		case r.item == nil && len(r.comment) > 0:
+			b.WriteString(r.comment)
+		case r.item == nil:
+		case len(r.item.sep) == 0:
+			b.WriteString(r.item.head)
+			if len(r.item.trailing) > 0 {
+				b.WriteString(" " + r.item.trailing)
+			}
+		default:
+			item := r.item
+			pad := widths[i] - utf8.RuneCountInString(item.head)
+			line := item.head + strings.Repeat(" ", pad) + " " + item.sep + " " + item.lines[0]
+			indent := strings.Repeat(" ", widths[i]+1) + "/" + strings.Repeat(" ", utf8.RuneCountInString(item.sep))
+			for _, l := range item.lines[1:] {
+				b.WriteString(strings.TrimRight(line, " ") + "\n")
+				line = indent + l
+			}
+			if len(item.trailing) > 0 {
+				line += " " + item.trailing
+			}
+			b.WriteString(strings.TrimRight(line, " "))
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// Precedence of operators in PEG text
+const (
+	precChoice = iota
+	precSequence
+	precPrefix
+	precSuffix
+	precPrimary
+)
+
+// opeToS prints ope, in parentheses if it binds more loosely than prec.
+func opeToS(ope operator, prec int) string {
+	v := &opePrinter{}
+	ope.accept(v)
+	if v.prec < prec {
+		return "(" + v.s + ")"
+	}
+	return v.s
+}
+
+// repetitionToS prints the suffix for a repetition, such as '{2,4}'.
+func repetitionToS(min, max int) string {
+	switch {
+	case max == -1:
+		return fmt.Sprintf("{%d,}", min)
+	case min == max:
+		return fmt.Sprintf("{%d}", min)
+	case min == 0:
+		return fmt.Sprintf("{,%d}", max)
+	}
+	return fmt.Sprintf("{%d,%d}", min, max)
+}
+
+// predicateToS prints a semantic predicate as in '&{isType}'.
+func predicateToS(ope *semanticPredicate) string {
+	if ope.negated {
+		return "!{" + ope.name + "}"
+	}
+	return "&{" + ope.name + "}"
+}
+
+// opePrinter
+type opePrinter struct {
+	*visitorBase
+	s    string
+	prec int
+}
+
+func (v *opePrinter) set(s string, prec int) {
+	v.s = s
+	v.prec = prec
+}
+
+func (v *opePrinter) visitSequence(ope *sequence) {
+	if len(ope.opes) == 1 {
+		ope.opes[0].accept(v)
+		return
+	}
+	var l []string
+	for _, o := range ope.opes {
+		l = append(l, opeToS(o, precPrefix))
+	}
+	v.set(strings.Join(l, " "), precSequence)
+}
+func (v *opePrinter) visitPrioritizedChoice(ope *prioritizedChoice) {
+	var l []string
+	for _, o := range ope.opes {
+		l = append(l, opeToS(o, precSequence))
+	}
+	v.set(strings.Join(l, " / "), precChoice)
+}
+func (v *opePrinter) visitZeroOrMore(ope *zeroOrMore) {
+	v.set(opeToS(ope.ope, precPrimary)+"*", precSuffix)
+}
+func (v *opePrinter) visitOneOrMore(ope *oneOrMore) {
+	v.set(opeToS(ope.ope, precPrimary)+"+", precSuffix)
+}
+func (v *opePrinter) visitRepetition(ope *repetition) {
+	v.set(opeToS(ope.ope, precPrimary)+repetitionToS(ope.min, ope.max), precSuffix)
+}
+func (v *opePrinter) visitOption(ope *option) {
+	v.set(opeToS(ope.ope, precPrimary)+"?", precSuffix)
+}
+func (v *opePrinter) visitAndPredicate(ope *andPredicate) {
+	v.set("&"+opeToS(ope.ope, precSuffix), precPrefix)
+}
+func (v *opePrinter) visitNotPredicate(ope *notPredicate) {
+	v.set("!"+opeToS(ope.ope, precSuffix), precPrefix)
+}
+func (v *opePrinter) visitLiteralString(ope *literalString) {
+	v.set(quoteLiteral(ope.lit), precPrimary)
+}
+func (v *opePrinter) visitCharacterClass(ope *characterClass) {
+	v.set("["+escapeGrammarText(ope.chars, ']')+"]", precPrimary)
+}
+func (v *opePrinter) visitUnicodeClass(ope *unicodeClass) {
+	v.set(ope.text, precPrimary)
+}
+func (v *opePrinter) visitAnyCharacter(ope *anyCharacter) {
+	v.set(".", precPrimary)
+}
+func (v *opePrinter) visitTokenBoundary(ope *tokenBoundary) {
+	v.set("< "+opeToS(ope.ope, precChoice)+" >", precPrimary)
+}
+func (v *opePrinter) visitIgnore(ope *ignore) {
+	v.set("~"+opeToS(ope.ope, precPrimary), precPrimary)
+}
+func (v *opePrinter) visitUser(ope *user) {
+	v.set("<user>", precPrimary)
+}
+func (v *opePrinter) visitSemanticPredicate(ope *semanticPredicate) {
+	v.set(predicateToS(ope), precPrefix)
+}
+func (v *opePrinter) visitReference(ope *reference) {
+	s := ope.name
+	if ope.args != nil {
+		var l []string
+		for _, arg := range ope.args {
+			l = append(l, opeToS(arg, precChoice))
+		}
+		s += "(" + strings.Join(l, ", ") + ")"
+	}
+	v.set(s, precPrimary)
+}
+func (v *opePrinter) visitRule(ope *Rule) {
+	v.set(ope.Name, precPrimary)
+}
+func (v *opePrinter) visitWhitespace(ope *whitespace) {
+	ope.ope.accept(v)
+}
+func (v *opePrinter) visitExpression(ope *expression) {
+	Seq(ope.atom, Zom(Seq(ope.binop, ope.atom))).accept(v)
+}
+
+// precedenceToS prints the levels of a precedence instruction. Operators
+// are quoted with quote if they can't be written as they are.
+func precedenceToS(levels []string, quote func(string) string) string {
+	var l []string
+	for _, level := range levels {
+		flds, _ := operatorFields(level)
+		for i, fld := range flds[1:] {
+			if len(fld) == 0 || fld == "N" || strings.ContainsAny(fld, "LR}'\";\\ \t") {
+				flds[i+1] = quote(fld)
+			}
+		}
+		l = append(l, strings.Join(flds, " "))
+	}
+	return strings.Join(l, " ")
+}
+
+// quoteLiteral quotes lit with single quotes, or double quotes if it has
+// only single quotes in it.
+func quoteLiteral(lit string) string {
+	if strings.Contains(lit, "'") && !strings.Contains(lit, "\"") {
+		return "\"" + escapeGrammarText(lit, '"') + "\""
+	}
+	return "'" + escapeGrammarText(lit, '\'') + "'"
+}
+
+// escapeGrammarText escapes s for a literal or a class closed by quote.
+func escapeGrammarText(s string, quote byte) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		if ch >= utf8.RuneSelf {
+			// Bytes which don't make a character in UTF-8, or bytes in a
+			// class, which would be taken as characters
+			if r, n := utf8.DecodeRuneInString(s[i:]); quote == ']' || r == utf8.RuneError && n == 1 {
+				fmt.Fprintf(&b, `\x%02x`, ch)
+			} else {
+				b.WriteString(s[i : i+n])
+				i += n - 1
+			}
+			continue
+		}
+		switch ch {
+		case '\\', quote:
+			b.WriteByte('\\')
+			b.WriteByte(ch)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\r':
+			b.WriteString(`\r`)
+		case '\t':
+			b.WriteString(`\t`)
+		case '\f':
+			b.WriteString(`\f`)
+		case '\v':
+			b.WriteString(`\v`)
+		default:
+			if ch < 0x20 || ch == 0x7f {
+				fmt.Fprintf(&b, `\x%02x`, ch)
+			} else {
+				b.WriteByte(ch)
+			}
+		}
+	}
+	return b.String()
+}
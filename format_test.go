@@ -0,0 +1,135 @@
+package peg
+
+import "testing"
+
+func TestFormatGrammar(t *testing.T) {
+	src := `# Calculator
+
+EXPR<-TERM ( ('+'/'-') TERM )*   # sum
+TERM  <-  FACTOR  (  [*/] FACTOR)*
+FACTOR <- NUMBER
+        # parenthesized
+        / '(' EXPR ')' {error_message "missing %t"}
+
+
+~_ <- [ \t\r\n]*
+LIST(X) <- X (',' X)*
+NUMBER <- < [0-9]+ > / "'" !. &'a' ~_ LIST(NUMBER / 'x')
+---
+%expr = EXPR   # expression
+%whitespace_rule = x
+# end
+`
+	want := `# Calculator
+
+EXPR   <- TERM (('+' / '-') TERM)* # sum
+TERM   <- FACTOR ([*/] FACTOR)*
+# parenthesized
+FACTOR <- NUMBER
+       /  '(' EXPR ')' { error_message 'missing %t' }
+
+~_      <- [ \t\r\n]*
+LIST(X) <- X (',' X)*
+NUMBER  <- < [0-9]+ > / "'" !. &'a' ~_ LIST(NUMBER / 'x')
+---
+%expr            = EXPR # expression
+%whitespace_rule = x
+# end
+`
+	got, err := FormatGrammar(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("want:\n%s\ngot:\n%s", want, got)
+	}
+
+	again, _ := FormatGrammar(got)
+	assert(t, again == got)
+}
+
+func TestFormatGrammarPrecedence(t *testing.T) {
+	got, _ := FormatGrammar("E <- A (O A)* {precedence\n  L + -\n  R 'L' '}'}\n")
+	want := "E <- A (O A)* { precedence L + - R 'L' '}' }\n"
+	if got != want {
+		t.Errorf("want:\n%s\ngot:\n%s", want, got)
+	}
+
+	got, _ = FormatGrammar("E <- A (O A)* { precedence L or AND N == \"is  not\" 'N' R \"'\" }\n")
+	want = "E <- A (O A)* { precedence L or AND N == 'is  not' 'N' R \"'\" }\n"
+	if got != want {
+		t.Errorf("want:\n%s\ngot:\n%s", want, got)
+	}
+}
+
+func TestFormatGrammarArrow(t *testing.T) {
+	pr := NewGrammarPrinter()
+	pr.Arrow = "←"
+	got, _ := pr.Format("A <- B\n  / 'a'\nLONG ← 'b'*\n")
+	want := "A    ← B\n     / 'a'\nLONG ← 'b'*\n"
+	if got != want {
+		t.Errorf("want:\n%s\ngot:\n%s", want, got)
+	}
+}
+
+func TestFormatGrammarEscape(t *testing.T) {
+	got, _ := FormatGrammar(`A <- "it's" '\n\t\\' [\]a-z\\] '\x01'` + "\n")
+	want := `A <- "it's" '\n\t\\' [\]a-z\\] '\x01'` + "\n"
+	assert(t, got == want)
+
+	// Octal escapes keep their meaning
+	got, _ = FormatGrammar(`A <- '\477' '\1018'` + "\n")
+	assert(t, got == `A <- "'7" 'A8'`+"\n")
+}
+
+func TestFormatGrammarSyntaxError(t *testing.T) {
+	_, err := FormatGrammar("A <- 'a\n")
+	assert(t, err != nil)
+}
+
+func TestPrintGrammar(t *testing.T) {
+	parser, _ := NewParser(`
+		EXPR        <- ATOM (OPE ATOM)*
+		ATOM        <- < [0-9]+ > / '(' EXPR ')'
+		OPE         <- < [-+] >
+		%whitespace <- [ \t]*
+		---
+		%expr  = EXPR
+		%binop = L + -
+	`)
+	want := `EXPR        <- ATOM (OPE ATOM)*
+ATOM        <- < [0-9]+ > / '(' EXPR ')'
+OPE         <- < [-+] >
+%whitespace <- [ \t]*
+---
+%expr  = EXPR
+%binop = L + -
+`
+	got := NewGrammarPrinter().Print(parser)
+	if got != want {
+		t.Errorf("want:\n%s\ngot:\n%s", want, got)
+	}
+
+	p2, err := NewParser(got)
+	assert(t, err == nil)
+	assert(t, NewGrammarPrinter().Print(p2) == got)
+}
+
+func TestFormatGrammarImport(t *testing.T) {
+	src := `%import "common.peg"   # lexical rules
+%import  lex   'lex.peg'
+
+A <- common.Identifier lex.Number`
+	want := `%import 'common.peg' # lexical rules
+%import lex 'lex.peg'
+
+A <- common.Identifier lex.Number
+`
+	got, err := FormatGrammar(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("want:\n%s\ngot:\n%s", want, got)
+	}
+}
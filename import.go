@@ -0,0 +1,330 @@
+package peg
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// importer collects the definitions made by the front-ends for grammars
+// written in other notations, and the constructs they can't translate.
+type importer struct {
+	data  *data
+	names map[string]string // Names by the key for references
+	fold  bool              // Names are case-insensitive
+	diags map[int]string
+}
+
+func newImporter(fold bool) *importer {
+	return &importer{
+		data:  newData(),
+		names: make(map[string]string),
+		fold:  fold,
+		diags: make(map[int]string),
+	}
+}
+
+func (im *importer) key(name string) string {
+	if im.fold {
+		return strings.ToLower(name)
+	}
+	return name
+}
+
+// define adds a rule, or an alternative to the rule if incremental.
+func (im *importer) define(name string, ope operator, pos int, s string, incremental bool) {
+	if defined, ok := im.names[im.key(name)]; ok {
+		r := im.data.grammar[defined]
+		if incremental {
+			if cho, ok := r.Ope.(*prioritizedChoice); ok {
+				cho.opes = append(cho.opes, ope)
+			} else {
+				r.Ope = Cho(r.Ope, ope)
+			}
+		} else {
+			im.data.duplicates = append(im.data.duplicates, duplicate{name, pos})
+		}
+		return
+	}
+	if incremental {
+		im.diag(pos, "'"+name+"' is not defined before '=/'.")
+	}
+
+	im.names[im.key(name)] = name
+	r := &Rule{Ope: ope, Name: name, SS: s, Pos: pos}
+	im.data.grammar[name] = r
+	im.data.definitions = append(im.data.definitions, definition{r, pos})
+	if len(im.data.start) == 0 {
+		im.data.start = name
+	}
+}
+
+// diag records a construct that can't be translated.
+func (im *importer) diag(pos int, msg string) {
+	if _, ok := im.diags[pos]; !ok {
+		im.diags[pos] = msg
+	}
+}
+
+// parser resolves the references and makes the parser. builtin returns
+// rules which are used if they aren't defined, such as the core rules of
+// ABNF.
+func (im *importer) parser(s string, builtin func(name string) operator) (*Parser, error) {
+	v := &renameReferences{rename: func(name string) string {
+		if defined, ok := im.names[im.key(name)]; ok {
+			return defined
+		}
+		if builtin != nil {
+			if ope := builtin(name); ope != nil {
+				im.names[im.key(name)] = name
+				// Placed after the definitions
+				im.data.grammar[name] = &Rule{Ope: ope, Name: name, SS: s, Pos: len(s)}
+			}
+		}
+		return name
+	}}
+	for _, def := range im.data.definitions {
+		def.rule.Ope.accept(v)
+	}
+
+	if len(im.diags) > 0 {
+		var positions []int
+		for pos := range im.diags {
+			positions = append(positions, pos)
+		}
+		sort.Ints(positions)
+
+		err := &Error{}
+		for _, pos := range positions {
+			ln, col := lineInfo(s, pos)
+			err.Details = append(err.Details, ErrorDetail{ln, col, im.diags[pos]})
+		}
+		return nil, err
+	}
+
+	if len(im.data.grammar) == 0 {
+		return nil, &Error{Details: []ErrorDetail{{1, 1, "no rule is defined."}}}
+	}
+	return newParserFromData(s, im.data)
+}
+
+// renameReferences
+type renameReferences struct {
+	*visitorBase
+	rename func(name string) string
+}
+
+func (v *renameReferences) visitSequence(ope *sequence) {
+	for _, o := range ope.opes {
+		o.accept(v)
+	}
+}
+func (v *renameReferences) visitPrioritizedChoice(ope *prioritizedChoice) {
+	for _, o := range ope.opes {
+		o.accept(v)
+	}
+}
+func (v *renameReferences) visitZeroOrMore(ope *zeroOrMore)       { ope.ope.accept(v) }
+func (v *renameReferences) visitOneOrMore(ope *oneOrMore)         { ope.ope.accept(v) }
+func (v *renameReferences) visitRepetition(ope *repetition)       { ope.ope.accept(v) }
+func (v *renameReferences) visitOption(ope *option)               { ope.ope.accept(v) }
+func (v *renameReferences) visitAndPredicate(ope *andPredicate)   { ope.ope.accept(v) }
+func (v *renameReferences) visitNotPredicate(ope *notPredicate)   { ope.ope.accept(v) }
+func (v *renameReferences) visitTokenBoundary(ope *tokenBoundary) { ope.ope.accept(v) }
+func (v *renameReferences) visitIgnore(ope *ignore)               { ope.ope.accept(v) }
+func (v *renameReferences) visitReference(ope *reference) {
+	ope.name = v.rename(ope.name)
+	for _, arg := range ope.args {
+		arg.accept(v)
+	}
+}
+
+// repeatOpe matches ope min to max times, or min times or more if max is -1.
+func repeatOpe(ope operator, min, max int) operator {
+	switch {
+	case min == 0 && max == -1:
+		return Zom(ope)
+	case min == 1 && max == -1:
+		return Oom(ope)
+	case min == 0 && max == 1:
+		return Opt(ope)
+	case min == 1 && max == 1:
+		return ope
+	}
+
+	var opes []operator
+	for i := 0; i < min; i++ {
+		opes = append(opes, ope)
+	}
+	if max == -1 {
+		opes = append(opes, Zom(ope))
+	} else if max > min {
+		opt := Opt(ope)
+		for i := max - min - 1; i > 0; i-- {
+			opt = Opt(Seq(ope, opt))
+		}
+		opes = append(opes, opt)
+	}
+	if len(opes) == 1 {
+		return opes[0]
+	}
+	return SeqCore(opes)
+}
+
+// foldLit matches s ignoring the case of ASCII letters, as in ABNF.
+func foldLit(s string) operator {
+	var opes []operator
+	start := 0
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		if ch < utf8.RuneSelf && unicode.IsLetter(rune(ch)) {
+			if start < i {
+				opes = append(opes, Lit(s[start:i]))
+			}
+			opes = append(opes, Cls(string([]byte{ch | 0x20, ch &^ 0x20})))
+			start = i + 1
+		}
+	}
+	if start < len(s) || len(opes) == 0 {
+		opes = append(opes, Lit(s[start:]))
+	}
+	if len(opes) == 1 {
+		return opes[0]
+	}
+	return SeqCore(opes)
+}
+
+// runeRange matches a character from lo to hi in UTF-8, which takes more
+// than a character class for non-ASCII characters. Surrogates are skipped.
+func runeRange(lo, hi rune) operator {
+	var opes []operator
+	for _, r := range [][2]rune{{lo, min(hi, 0xd7ff)}, {max(lo, 0xe000), hi}} {
+		// Split by the length of encoding
+		for _, b := range []rune{0x7f, 0x7ff, 0xffff, unicode.MaxRune} {
+			if r[0] > r[1] {
+				break
+			}
+			if r[0] <= b {
+				opes = appendUTF8Range(opes, r[0], min(r[1], b))
+				r[0] = b + 1
+			}
+		}
+	}
+	if len(opes) == 1 {
+		return opes[0]
+	}
+	return ChoCore(opes)
+}
+
+// appendUTF8Range appends sequences of byte classes that match the
+// characters from lo to hi, which have the same length in UTF-8.
+func appendUTF8Range(opes []operator, lo, hi rune) []operator {
+	n := utf8.RuneLen(lo)
+	for i := 1; i < n; i++ {
+		m := rune(1)<<(6*i) - 1
+		if lo&^m != hi&^m {
+			if lo&m != 0 {
+				opes = appendUTF8Range(opes, lo, lo|m)
+				return appendUTF8Range(opes, (lo|m)+1, hi)
+			}
+			if hi&m != m {
+				opes = appendUTF8Range(opes, lo, (hi&^m)-1)
+				return appendUTF8Range(opes, hi&^m, hi)
+			}
+		}
+	}
+
+	a := make([]byte, n)
+	b := make([]byte, n)
+	utf8.EncodeRune(a, lo)
+	utf8.EncodeRune(b, hi)
+	var seq []operator
+	for i := 0; i < n; i++ {
+		seq = append(seq, byteRange(a[i], b[i]))
+	}
+	if len(seq) == 1 {
+		return append(opes, seq[0])
+	}
+	return append(opes, SeqCore(seq))
+}
+
+func byteRange(lo, hi byte) operator {
+	if lo == hi {
+		return Cls(string([]byte{lo}))
+	}
+	return Cls(string([]byte{lo, '-', hi}))
+}
+
+// anyRune matches a character in UTF-8.
+func anyRune() operator {
+	return runeRange(0, unicode.MaxRune)
+}
+
+// foldRanges adds the characters in other cases to ranges. A character is
+// added if it has the same lowercase, as in JavaScript.
+func foldRanges(ranges [][2]rune) [][2]rune {
+	var folded []rune
+	for _, r := range ranges {
+		for c := r[0]; c <= r[1]; c++ {
+			for f := unicode.SimpleFold(c); f != c; f = unicode.SimpleFold(f) {
+				if unicode.ToLower(f) == unicode.ToLower(c) {
+					folded = append(folded, f)
+				}
+			}
+		}
+	}
+	sort.Slice(folded, func(i, j int) bool { return folded[i] < folded[j] })
+
+	result := append([][2]rune(nil), ranges...)
+	n := len(result)
+	for _, f := range folded {
+		if last := len(result) - 1; last >= n && result[last][1]+1 >= f {
+			result[last][1] = f
+			continue
+		}
+		result = append(result, [2]rune{f, f})
+	}
+	return result
+}
+
+// runeClass matches a character in ranges, or a character not in them if
+// negated. A range of a single character has the same lo and hi.
+func runeClass(ranges [][2]rune, negated bool) operator {
+	var opes []operator
+	var ascii, dashes []byte
+	dash := false
+	for _, r := range ranges {
+		switch {
+		case r[1] >= utf8.RuneSelf:
+			opes = append(opes, runeRange(r[0], r[1]))
+		case r[0] == '-' && r[1] == '-':
+			dash = true
+		case r[0] == '-':
+			dashes = append(dashes, '-', '-', byte(r[1]))
+		case r[0] == r[1]:
+			ascii = append(ascii, byte(r[0]))
+		default:
+			ascii = append(ascii, byte(r[0]), '-', byte(r[1]))
+		}
+	}
+
+	// '-' goes first not to be taken as a range
+	if dash && len(dashes) == 0 {
+		dashes = []byte{'-'}
+	}
+	if ascii = append(dashes, ascii...); len(ascii) > 0 {
+		opes = append([]operator{Cls(string(ascii))}, opes...)
+	}
+
+	var ope operator
+	if len(opes) == 1 {
+		ope = opes[0]
+	} else {
+		ope = ChoCore(opes)
+	}
+	if negated {
+		return Seq(Npd(ope), anyRune())
+	}
+	return ope
+}
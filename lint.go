@@ -0,0 +1,477 @@
+package peg
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Warning is a part of a grammar which is valid but is likely a mistake.
+type Warning struct {
+	Ln  int
+	Col int
+	Msg string
+}
+
+func (w Warning) String() string {
+	return fmt.Sprintf("%d:%d warning: %s", w.Ln, w.Col, w.Msg)
+}
+
+// Lint checks the grammar for rules unreachable from the start rule,
+// alternatives which never match, repetitions of expressions which match an
+// empty string, unused macro parameters and misuse of '%whitespace' and
+// '%word'. The warnings are sorted by position.
+func (p *Parser) Lint() []Warning {
+	l := &linter{p: p, nullable: nullableRules(p.Grammar)}
+	l.ws = p.Grammar[WhitespceRuleName] != nil
+
+	var names []string
+	for name := range p.Grammar {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	l.checkReachability(names)
+	for _, name := range names {
+		r := p.Grammar[name]
+		l.checkParameters(r)
+		r.Ope.accept(&lintVisitor{l: l, r: r})
+	}
+	l.checkWhitespace(names)
+
+	sort.SliceStable(l.warnings, func(i, j int) bool {
+		a, b := l.warnings[i], l.warnings[j]
+		return a.Ln < b.Ln || a.Ln == b.Ln && a.Col < b.Col
+	})
+	return l.warnings
+}
+
+type linter struct {
+	p        *Parser
+	nullable map[*Rule]bool
+	ws       bool
+	warnings []Warning
+}
+
+func (l *linter) warn(r *Rule, pos int, msg string) {
+	// Rules imported from other files or base grammars are checked with them
+	if r.SS != l.p.source {
+		return
+	}
+	ln, col := lineInfo(r.SS, pos)
+	l.warnings = append(l.warnings, Warning{ln, col, msg})
+}
+
+// posOf returns the position of ope in the grammar, or the position of r if
+// it isn't known.
+func (l *linter) posOf(r *Rule, ope operator) int {
+	if pos, ok := l.p.positions[ope]; ok {
+		return pos
+	}
+	return r.Pos
+}
+
+// isWord tells if the literal is checked with the word rule.
+func (l *linter) isWord(lit string) bool {
+	if r, ok := l.p.Grammar[WordRuleName]; ok {
+		return success(r.parse(lit, 0, &Values{}, &context{s: lit}, nil))
+	}
+	return false
+}
+
+func (l *linter) checkReachability(names []string) {
+	reached := make(map[string]bool)
+	var reach func(name string)
+	reach = func(name string) {
+		r, ok := l.p.Grammar[name]
+		if !ok || reached[name] {
+			return
+		}
+		reached[name] = true
+		v := &referenceCollector{rules: make(map[string]bool), params: make(map[string]bool)}
+		r.accept(v)
+		for name := range v.rules {
+			reach(name)
+		}
+	}
+	reach(l.p.start)
+	reach(WhitespceRuleName)
+	reach(WordRuleName)
+
+	for _, name := range names {
+		// User rules have no source
+		if r := l.p.Grammar[name]; !reached[name] && len(r.SS) > 0 {
+			l.warn(r, r.Pos, "'"+name+"' is unreachable from '"+l.p.start+"'.")
+		}
+	}
+}
+
+func (l *linter) checkParameters(r *Rule) {
+	v := &referenceCollector{rules: make(map[string]bool), params: make(map[string]bool)}
+	r.accept(v)
+	for _, param := range r.Parameters {
+		if !v.params[param] {
+			l.warn(r, r.Pos, "'"+param+"' is not used in '"+r.Name+"'.")
+		}
+	}
+}
+
+func (l *linter) checkAlternatives(r *Rule, ope *prioritizedChoice) {
+	for i, o := range ope.opes {
+		pre := &literalPrefix{l: l}
+		o.accept(pre)
+		for _, earlier := range ope.opes[:i] {
+			msg := ""
+			if alwaysMatches(earlier) {
+				msg = "always matches"
+			} else if len(pre.s) > 0 && matchesPrefix(l, earlier, pre.s) {
+				msg = "matches a prefix of it"
+			}
+			if len(msg) > 0 {
+				l.warn(r, l.posOf(r, o), opeToS(o, precSequence)+" never matches because "+opeToS(earlier, precSequence)+" before it "+msg+".")
+				break
+			}
+		}
+	}
+}
+
+func (l *linter) checkWhitespace(names []string) {
+	if r, ok := l.p.Grammar[WhitespceRuleName]; ok && !l.nullable[r] {
+		l.warn(r, r.Pos, "'"+WhitespceRuleName+"' doesn't match an empty string, so whitespace is required after every token.")
+	}
+
+	r, ok := l.p.Grammar[WordRuleName]
+	if !ok {
+		return
+	}
+	if l.nullable[r] {
+		l.warn(r, r.Pos, "'"+WordRuleName+"' matches an empty string, so no literal can match.")
+		return
+	}
+	v := &literalCollector{}
+	for _, name := range names {
+		if name != WordRuleName {
+			l.p.Grammar[name].Ope.accept(v)
+		}
+	}
+	for _, lit := range v.lits {
+		if l.isWord(lit) {
+			return
+		}
+	}
+	if len(v.lits) > 0 {
+		l.warn(r, r.Pos, "'"+WordRuleName+"' doesn't match any literal, so it has no effect.")
+	}
+}
+
+// matchesPrefix tells if earlier always matches input starting with s, so
+// that an alternative starting with s is never tried.
+func matchesPrefix(l *linter, earlier operator, s string) bool {
+	switch earlier.(type) {
+	case *characterClass, *unicodeClass, *anyCharacter:
+		return success(earlier.parseCore(s, 0, &Values{}, &context{s: s}, nil))
+	}
+	pre := &literalPrefix{l: l}
+	earlier.accept(pre)
+	return pre.complete && !pre.word && len(pre.s) <= len(s) && s[:len(pre.s)] == pre.s
+}
+
+// nullableRules returns the rules which can match an empty string.
+func nullableRules(grammar map[string]*Rule) map[*Rule]bool {
+	rules := make(map[*Rule]bool)
+	for changed := true; changed; {
+		changed = false
+		for _, r := range grammar {
+			if !rules[r] {
+				v := &nullableChecker{rules: rules}
+				r.Ope.accept(v)
+				if v.nullable {
+					rules[r] = true
+					changed = true
+				}
+			}
+		}
+	}
+	return rules
+}
+
+// lintVisitor
+type lintVisitor struct {
+	*visitorBase
+	l *linter
+	r *Rule
+}
+
+func (v *lintVisitor) visitSequence(ope *sequence) {
+	for _, o := range ope.opes {
+		o.accept(v)
+	}
+}
+func (v *lintVisitor) visitPrioritizedChoice(ope *prioritizedChoice) {
+	v.l.checkAlternatives(v.r, ope)
+	for _, o := range ope.opes {
+		o.accept(v)
+	}
+}
+func (v *lintVisitor) visitZeroOrMore(ope *zeroOrMore) {
+	v.checkLoop(ope, ope.ope)
+	ope.ope.accept(v)
+}
+func (v *lintVisitor) visitOneOrMore(ope *oneOrMore) {
+	v.checkLoop(ope, ope.ope)
+	ope.ope.accept(v)
+}
+func (v *lintVisitor) visitRepetition(ope *repetition) {
+	if ope.max == -1 {
+		v.checkLoop(ope, ope.ope)
+	}
+	ope.ope.accept(v)
+}
+func (v *lintVisitor) visitOption(ope *option)               { ope.ope.accept(v) }
+func (v *lintVisitor) visitAndPredicate(ope *andPredicate)   { ope.ope.accept(v) }
+func (v *lintVisitor) visitNotPredicate(ope *notPredicate)   { ope.ope.accept(v) }
+func (v *lintVisitor) visitTokenBoundary(ope *tokenBoundary) { ope.ope.accept(v) }
+func (v *lintVisitor) visitIgnore(ope *ignore)               { ope.ope.accept(v) }
+func (v *lintVisitor) visitReference(ope *reference) {
+	for _, arg := range ope.args {
+		arg.accept(v)
+	}
+}
+func (v *lintVisitor) visitWhitespace(ope *whitespace) { ope.ope.accept(v) }
+func (v *lintVisitor) visitExpression(ope *expression) { ope.atom.accept(v) }
+
+func (v *lintVisitor) checkLoop(loop, ope operator) {
+	n := &nullableChecker{rules: v.l.nullable}
+	ope.accept(n)
+	if n.nullable {
+		v.l.warn(v.r, v.l.posOf(v.r, loop), opeToS(loop, precSuffix)+" repeats an expression which matches an empty string.")
+	}
+}
+
+// referenceCollector
+type referenceCollector struct {
+	*visitorBase
+	rules  map[string]bool
+	params map[string]bool
+}
+
+func (v *referenceCollector) visitSequence(ope *sequence) {
+	for _, o := range ope.opes {
+		o.accept(v)
+	}
+}
+func (v *referenceCollector) visitPrioritizedChoice(ope *prioritizedChoice) {
+	for _, o := range ope.opes {
+		o.accept(v)
+	}
+}
+func (v *referenceCollector) visitZeroOrMore(ope *zeroOrMore)       { ope.ope.accept(v) }
+func (v *referenceCollector) visitOneOrMore(ope *oneOrMore)         { ope.ope.accept(v) }
+func (v *referenceCollector) visitRepetition(ope *repetition)       { ope.ope.accept(v) }
+func (v *referenceCollector) visitOption(ope *option)               { ope.ope.accept(v) }
+func (v *referenceCollector) visitAndPredicate(ope *andPredicate)   { ope.ope.accept(v) }
+func (v *referenceCollector) visitNotPredicate(ope *notPredicate)   { ope.ope.accept(v) }
+func (v *referenceCollector) visitTokenBoundary(ope *tokenBoundary) { ope.ope.accept(v) }
+func (v *referenceCollector) visitIgnore(ope *ignore)               { ope.ope.accept(v) }
+func (v *referenceCollector) visitReference(ope *reference) {
+	if ope.rule != nil {
+		v.rules[ope.name] = true
+	} else {
+		v.params[ope.name] = true
+	}
+	for _, arg := range ope.args {
+		arg.accept(v)
+	}
+}
+func (v *referenceCollector) visitRule(ope *Rule)             { ope.Ope.accept(v) }
+func (v *referenceCollector) visitWhitespace(ope *whitespace) { ope.ope.accept(v) }
+func (v *referenceCollector) visitExpression(ope *expression) {
+	ope.atom.accept(v)
+	ope.binop.accept(v)
+	for _, o := range append(ope.table.prefixOpes, ope.table.postfixOpes...) {
+		o.Ope.accept(v)
+	}
+}
+
+// literalCollector
+type literalCollector struct {
+	*visitorBase
+	lits []string
+}
+
+func (v *literalCollector) visitSequence(ope *sequence) {
+	for _, o := range ope.opes {
+		o.accept(v)
+	}
+}
+func (v *literalCollector) visitPrioritizedChoice(ope *prioritizedChoice) {
+	for _, o := range ope.opes {
+		o.accept(v)
+	}
+}
+func (v *literalCollector) visitZeroOrMore(ope *zeroOrMore)       { ope.ope.accept(v) }
+func (v *literalCollector) visitOneOrMore(ope *oneOrMore)         { ope.ope.accept(v) }
+func (v *literalCollector) visitRepetition(ope *repetition)       { ope.ope.accept(v) }
+func (v *literalCollector) visitOption(ope *option)               { ope.ope.accept(v) }
+func (v *literalCollector) visitAndPredicate(ope *andPredicate)   { ope.ope.accept(v) }
+func (v *literalCollector) visitNotPredicate(ope *notPredicate)   { ope.ope.accept(v) }
+func (v *literalCollector) visitLiteralString(ope *literalString) { v.lits = append(v.lits, ope.lit) }
+func (v *literalCollector) visitTokenBoundary(ope *tokenBoundary) { ope.ope.accept(v) }
+func (v *literalCollector) visitIgnore(ope *ignore)               { ope.ope.accept(v) }
+func (v *literalCollector) visitWhitespace(ope *whitespace)       { ope.ope.accept(v) }
+func (v *literalCollector) visitExpression(ope *expression)       { ope.atom.accept(v) }
+func (v *literalCollector) visitReference(ope *reference) {
+	for _, arg := range ope.args {
+		arg.accept(v)
+	}
+}
+
+// nullableChecker tells if an operator can match an empty string. rules are
+// the rules known to be nullable.
+type nullableChecker struct {
+	*visitorBase
+	rules    map[*Rule]bool
+	nullable bool
+}
+
+func (v *nullableChecker) visitSequence(ope *sequence) {
+	for _, o := range ope.opes {
+		if o.accept(v); !v.nullable {
+			return
+		}
+	}
+	v.nullable = true
+}
+func (v *nullableChecker) visitPrioritizedChoice(ope *prioritizedChoice) {
+	for _, o := range ope.opes {
+		if o.accept(v); v.nullable {
+			return
+		}
+	}
+	v.nullable = false
+}
+func (v *nullableChecker) visitZeroOrMore(ope *zeroOrMore)         { v.nullable = true }
+func (v *nullableChecker) visitOneOrMore(ope *oneOrMore)           { ope.ope.accept(v) }
+func (v *nullableChecker) visitOption(ope *option)                 { v.nullable = true }
+func (v *nullableChecker) visitAndPredicate(ope *andPredicate)     { v.nullable = true }
+func (v *nullableChecker) visitNotPredicate(ope *notPredicate)     { v.nullable = true }
+func (v *nullableChecker) visitLiteralString(ope *literalString)   { v.nullable = len(ope.lit) == 0 }
+func (v *nullableChecker) visitCharacterClass(ope *characterClass) { v.nullable = false }
+func (v *nullableChecker) visitUnicodeClass(ope *unicodeClass)     { v.nullable = false }
+func (v *nullableChecker) visitAnyCharacter(ope *anyCharacter)     { v.nullable = false }
+func (v *nullableChecker) visitTokenBoundary(ope *tokenBoundary)   { ope.ope.accept(v) }
+func (v *nullableChecker) visitIgnore(ope *ignore)                 { ope.ope.accept(v) }
+func (v *nullableChecker) visitUser(ope *user)                     { v.nullable = false }
+func (v *nullableChecker) visitSemanticPredicate(ope *semanticPredicate) {
+	v.nullable = true
+}
+func (v *nullableChecker) visitRepetition(ope *repetition) {
+	if ope.ope.accept(v); ope.min == 0 {
+		v.nullable = true
+	}
+}
+func (v *nullableChecker) visitReference(ope *reference) {
+	// Arguments of macros are taken as not nullable
+	v.nullable = ope.rule != nil && v.rules[ope.rule]
+}
+func (v *nullableChecker) visitRule(ope *Rule)             { ope.Ope.accept(v) }
+func (v *nullableChecker) visitWhitespace(ope *whitespace) { ope.ope.accept(v) }
+func (v *nullableChecker) visitExpression(ope *expression) { ope.atom.accept(v) }
+
+// alwaysMatches tells if ope never fails.
+func alwaysMatches(ope operator) bool {
+	v := &failureChecker{visiting: make(map[*Rule]bool)}
+	ope.accept(v)
+	return v.always
+}
+
+// failureChecker
+type failureChecker struct {
+	*visitorBase
+	visiting map[*Rule]bool
+	always   bool
+}
+
+func (v *failureChecker) visitSequence(ope *sequence) {
+	for _, o := range ope.opes {
+		if o.accept(v); !v.always {
+			return
+		}
+	}
+	v.always = true
+}
+func (v *failureChecker) visitPrioritizedChoice(ope *prioritizedChoice) {
+	for _, o := range ope.opes {
+		if o.accept(v); v.always {
+			return
+		}
+	}
+	v.always = false
+}
+func (v *failureChecker) visitZeroOrMore(ope *zeroOrMore)         { v.always = true }
+func (v *failureChecker) visitOneOrMore(ope *oneOrMore)           { ope.ope.accept(v) }
+func (v *failureChecker) visitOption(ope *option)                 { v.always = true }
+func (v *failureChecker) visitAndPredicate(ope *andPredicate)     { ope.ope.accept(v) }
+func (v *failureChecker) visitNotPredicate(ope *notPredicate)     { v.always = false }
+func (v *failureChecker) visitLiteralString(ope *literalString)   { v.always = len(ope.lit) == 0 }
+func (v *failureChecker) visitCharacterClass(ope *characterClass) { v.always = false }
+func (v *failureChecker) visitUnicodeClass(ope *unicodeClass)     { v.always = false }
+func (v *failureChecker) visitAnyCharacter(ope *anyCharacter)     { v.always = false }
+func (v *failureChecker) visitTokenBoundary(ope *tokenBoundary)   { ope.ope.accept(v) }
+func (v *failureChecker) visitIgnore(ope *ignore)                 { ope.ope.accept(v) }
+func (v *failureChecker) visitUser(ope *user)                     { v.always = false }
+func (v *failureChecker) visitSemanticPredicate(ope *semanticPredicate) {
+	v.always = false
+}
+func (v *failureChecker) visitRepetition(ope *repetition) {
+	if ope.ope.accept(v); ope.min == 0 {
+		v.always = true
+	}
+}
+func (v *failureChecker) visitReference(ope *reference) {
+	v.always = false
+	if ope.rule != nil && !v.visiting[ope.rule] {
+		v.visiting[ope.rule] = true
+		ope.rule.Ope.accept(v)
+		v.visiting[ope.rule] = false
+	}
+}
+func (v *failureChecker) visitWhitespace(ope *whitespace) { ope.ope.accept(v) }
+func (v *failureChecker) visitExpression(ope *expression) { ope.atom.accept(v) }
+
+// literalPrefix finds the string which input has to start with for an
+// operator to match. complete is set if the operator matches whenever input
+// starts with it, and word if a literal in it is checked with the word rule.
+type literalPrefix struct {
+	*visitorBase
+	l        *linter
+	inToken  bool
+	s        string
+	complete bool
+	word     bool
+}
+
+func (v *literalPrefix) visitSequence(ope *sequence) {
+	v.complete = true
+	for i, o := range ope.opes {
+		pre := &literalPrefix{l: v.l, inToken: v.inToken}
+		o.accept(pre)
+		v.s += pre.s
+		v.word = v.word || pre.word
+		// Whitespace may come between the elements
+		if !pre.complete || v.l.ws && !v.inToken && len(pre.s) > 0 && i < len(ope.opes)-1 {
+			v.complete = false
+			return
+		}
+	}
+}
+func (v *literalPrefix) visitLiteralString(ope *literalString) {
+	v.s = ope.lit
+	v.complete = true
+	v.word = v.l.isWord(ope.lit)
+}
+func (v *literalPrefix) visitTokenBoundary(ope *tokenBoundary) {
+	pre := &literalPrefix{l: v.l, inToken: true}
+	ope.ope.accept(pre)
+	*v = literalPrefix{l: v.l, inToken: v.inToken, s: pre.s, complete: pre.complete, word: pre.word}
+}
+func (v *literalPrefix) visitIgnore(ope *ignore) { ope.ope.accept(v) }
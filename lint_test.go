@@ -0,0 +1,127 @@
+package peg
+
+import "testing"
+
+func lintMessages(t *testing.T, grammar string) []string {
+	parser, err := NewParser(grammar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msgs []string
+	for _, w := range parser.Lint() {
+		msgs = append(msgs, w.String())
+	}
+	return msgs
+}
+
+func checkLint(t *testing.T, grammar string, want ...string) {
+	got := lintMessages(t, grammar)
+	if len(got) != len(want) {
+		t.Errorf("want %q, got %q", want, got)
+		return
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("want %q, got %q", want[i], got[i])
+		}
+	}
+}
+
+func TestLintClean(t *testing.T) {
+	checkLint(t, `
+		EXPR        <- TERM (('+' / '-') TERM)*
+		TERM        <- FACTOR (('*' / '/') FACTOR)*
+		FACTOR      <- NUMBER / '(' EXPR ')' / 'if' / 'ifx' / 'f' ARGS
+		NUMBER      <- < [0-9]+ >
+		LIST(X)     <- X (',' X)*
+		ARGS        <- '(' LIST(EXPR)? ')'
+		%whitespace <- [ \t]*
+		%word       <- [a-z]+
+	`)
+}
+
+func TestLintUnreachable(t *testing.T) {
+	checkLint(t, `
+		A <- B
+		B <- 'b'
+		C <- 'c' D
+		D <- C
+	`,
+		"4:3 warning: 'C' is unreachable from 'A'.",
+		"5:3 warning: 'D' is unreachable from 'A'.")
+
+	// Rules which are used for whitespace and words
+	checkLint(t, `
+		A           <- 'a'
+		%whitespace <- SPACE*
+		SPACE       <- [ \t]
+		%word       <- [a-z]+
+	`)
+}
+
+func TestLintDeadAlternatives(t *testing.T) {
+	checkLint(t, `
+		A <- 'a' / 'ab' / 'b' 'c' / 'bcd' / B
+		B <- [a-z] / 'x' / . / 'y' / C? / 'z'
+		C <- 'c' / 'c'
+	`,
+		"2:14 warning: 'ab' never matches because 'a' before it matches a prefix of it.",
+		"2:31 warning: 'bcd' never matches because 'b' 'c' before it matches a prefix of it.",
+		"3:16 warning: 'x' never matches because [a-z] before it matches a prefix of it.",
+		"3:26 warning: 'y' never matches because [a-z] before it matches a prefix of it.",
+		"3:37 warning: 'z' never matches because [a-z] before it matches a prefix of it.",
+		"4:14 warning: 'c' never matches because 'c' before it matches a prefix of it.")
+
+	// Whitespace may come between literals, and words are followed by
+	// a non-word
+	checkLint(t, `
+		A           <- 'a' 'b' / 'ab' / < '+' '-' > / '+-=' / 'if' / 'ifx'
+		%whitespace <- ' '*
+		%word       <- [a-z]+
+	`, "2:49 warning: '+-=' never matches because < '+' '-' > before it matches a prefix of it.")
+
+	checkLint(t, `
+		A <- B / 'a' / 'b'
+		B <- 'c'?
+	`,
+		"2:12 warning: 'a' never matches because B before it always matches.",
+		"2:18 warning: 'b' never matches because B before it always matches.")
+}
+
+func TestLintEmptyLoops(t *testing.T) {
+	checkLint(t, `
+		A <- ('d' / '')* ('a'?)+ (B / 'b')* ('a' / &'b')* 'c'* ('e'?){2,}
+		B <- 'b'*
+	`,
+		"2:8 warning: ('d' / '')* repeats an expression which matches an empty string.",
+		"2:20 warning: ('a'?)+ repeats an expression which matches an empty string.",
+		"2:28 warning: (B / 'b')* repeats an expression which matches an empty string.",
+		"2:33 warning: 'b' never matches because B before it always matches.",
+		"2:39 warning: ('a' / &'b')* repeats an expression which matches an empty string.",
+		"2:58 warning: ('e'?){2,} repeats an expression which matches an empty string.")
+}
+
+func TestLintMacroParameters(t *testing.T) {
+	checkLint(t, `
+		A          <- LIST('a', ',') PAIR('b', 'c')
+		LIST(X, D) <- X (',' X)*
+		PAIR(X, Y) <- X Y
+	`, "3:3 warning: 'D' is not used in 'LIST'.")
+}
+
+func TestLintWhitespaceAndWord(t *testing.T) {
+	checkLint(t, `
+		A           <- 'a' 'b'
+		%whitespace <- [ \t]+
+	`, "3:3 warning: '%whitespace' doesn't match an empty string, so whitespace is required after every token.")
+
+	checkLint(t, `
+		A           <- 'a' 'b'
+		%word       <- [a-z]*
+	`, "3:3 warning: '%word' matches an empty string, so no literal can match.")
+
+	checkLint(t, `
+		A           <- '+' '-'
+		%word       <- [a-z]+
+	`, "3:3 warning: '%word' doesn't match any literal, so it has no effect.")
+}
@@ -0,0 +1,181 @@
+package peg
+
+import (
+	"io/fs"
+	"path"
+	"strings"
+)
+
+// NewParserFromFS makes a parser from the grammar file name in fsys, such as
+// an embed.FS. The grammar can import rules from other files with directives
+// such as '%import "common.peg"' before the definitions, and refer to them
+// as 'common.Identifier'. The namespace is the file name without the
+// extension unless given as in '%import lex "common.peg"'. A name is
+// qualified only by an imported namespace, so 'B.C' is B, any character and
+// C otherwise. Paths are relative to the importing file.
+//
+// An imported grammar is checked on its own first, and its errors are
+// reported at the directive with the file name. Its '%whitespace' and
+// '%word' keep their names, so they conflict with the ones of the importing
+// grammar. '%expr', '%binop', '%prefix', '%postfix' and '%ternary' become a
+// precedence instruction on the rule, and the other options aren't imported.
+func NewParserFromFS(fsys fs.FS, name string) (*Parser, error) {
+	l := &grammarLoader{
+		fsys:    fsys,
+		loading: make(map[string]bool),
+		checked: make(map[string]error),
+	}
+	s, data, err := l.load(name)
+	if err != nil {
+		return nil, err
+	}
+	return newParserFromData(s, data)
+}
+
+// grammarLoader
+type grammarLoader struct {
+	fsys    fs.FS
+	loading map[string]bool  // Files being loaded, to detect cycles
+	checked map[string]error // Results of checking files on their own
+}
+
+// load reads the grammar file name, and merges the grammars it imports.
+func (l *grammarLoader) load(name string) (string, *data, error) {
+	b, err := fs.ReadFile(l.fsys, name)
+	if err != nil {
+		return "", nil, err
+	}
+	s := string(b)
+	data := newData()
+	if _, _, err := rStart.Parse(s, data); err != nil {
+		return s, nil, err
+	}
+
+	l.loading[name] = true
+	defer delete(l.loading, name)
+
+	err = nil
+	namespaces := make(map[string]bool)
+	for _, imp := range data.imports {
+		file := path.Join(path.Dir(name), imp.path)
+		ns := imp.namespace()
+
+		var msgs []string
+		if _, _, nsErr := rIdentCont.Parse(ns, nil); nsErr != nil {
+			msgs = []string{"'" + ns + "' can't be a namespace, so give one as in '%import name \"" + imp.path + "\"'."}
+		} else if namespaces[ns] {
+			msgs = []string{"'" + ns + "' is already imported."}
+		} else if l.loading[file] {
+			msgs = []string{"'" + file + "' is imported recursively."}
+		} else if checkErr := l.check(file); checkErr != nil {
+			msgs = importErrors(file, checkErr)
+		} else {
+			// Load again, since checking links the rules
+			_, imported, _ := l.load(file)
+			msgs = mergeGrammar(data, imported, ns)
+		}
+		namespaces[ns] = true
+
+		ln, col := lineInfo(s, imp.pos)
+		for _, msg := range msgs {
+			if err == nil {
+				err = &Error{}
+			}
+			err.(*Error).Details = append(err.(*Error).Details, ErrorDetail{ln, col, msg})
+		}
+	}
+	if err != nil {
+		return s, nil, err
+	}
+	return s, data, nil
+}
+
+// check tells if the grammar file name is valid on its own.
+func (l *grammarLoader) check(name string) error {
+	if err, ok := l.checked[name]; ok {
+		return err
+	}
+	s, data, err := l.load(name)
+	if err == nil {
+		_, err = newParserFromData(s, data)
+	}
+	l.checked[name] = err
+	return err
+}
+
+// importErrors makes the messages for errors in an imported file.
+func importErrors(file string, err error) []string {
+	perr, ok := err.(*Error)
+	if !ok {
+		return []string{err.Error()}
+	}
+	var msgs []string
+	for _, d := range perr.Details {
+		msgs = append(msgs, file+":"+d.String())
+	}
+	return msgs
+}
+
+// mergeGrammar adds the rules of an imported grammar to data, with the names
+// qualified by ns. It returns the messages for conflicts.
+func mergeGrammar(data, imported *data, ns string) (msgs []string) {
+	qualify := func(name string) string {
+		if name == WhitespceRuleName || name == WordRuleName {
+			return name
+		}
+		return ns + "." + name
+	}
+
+	if name, levels := expressionLevels(imported.optionList); len(name) > 0 {
+		// Rules as prefix and postfix operators
+		for i, level := range levels {
+			flds, _ := operatorFields(level)
+			if flds[0] != "P" && flds[0] != "S" {
+				continue
+			}
+			for j, fld := range flds[1:] {
+				if _, ok := imported.grammar[fld]; ok {
+					flds[j+1] = qualify(fld)
+				} else {
+					flds[j+1] = quoteOperator(fld)
+				}
+			}
+			levels[i] = strings.Join(flds, " ")
+		}
+		if r, ok := imported.grammar[name]; ok && len(r.precedence) == 0 {
+			r.precedence = levels
+		}
+	}
+
+	for _, def := range imported.definitions {
+		r := def.rule
+		params := r.Parameters
+		r.Ope.accept(&renameReferences{rename: func(name string) string {
+			for _, param := range params {
+				if param == name {
+					return name
+				}
+			}
+			if _, ok := imported.grammar[name]; ok {
+				return qualify(name)
+			}
+			return name
+		}})
+		r.Name = qualify(r.Name)
+
+		if other, ok := data.grammar[r.Name]; ok {
+			// The same rule may come through more than one path
+			if other.SS != r.SS || other.Pos != r.Pos {
+				msgs = append(msgs, "'"+r.Name+"' is already defined.")
+			}
+			continue
+		}
+		data.grammar[r.Name] = r
+		data.definitions = append(data.definitions, def)
+	}
+
+	for ope, pos := range imported.positions {
+		data.positions[ope] = pos
+	}
+	return
+}
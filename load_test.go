@@ -0,0 +1,189 @@
+package peg
+
+import (
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+var loadTestFS = fstest.MapFS{
+	"main.peg": {Data: []byte(`
+		%import "lex/common.peg"
+		%import n "lex/number.peg"
+
+		PROGRAM     <- STATEMENT*
+		STATEMENT   <- common.Identifier '=' EXPR ';'
+		EXPR        <- n.Number (('+' / '-') n.Number)*
+		%whitespace <- [ \t\r\n]*
+	`)},
+	"lex/common.peg": {Data: []byte(`
+		%import "chars.peg"
+
+		Identifier  <- < chars.Alpha (chars.Alpha / chars.Digit)* >
+		String      <- < '"' (!'"' .)* '"' >
+	`)},
+	"lex/chars.peg": {Data: []byte(`
+		Alpha <- [a-zA-Z_]
+		Digit <- [0-9]
+	`)},
+	"lex/number.peg": {Data: []byte(`
+		%import "chars.peg"
+
+		Number <- < chars.Digit+ >
+	`)},
+}
+
+func TestNewParserFromFS(t *testing.T) {
+	parser, err := NewParserFromFS(loadTestFS, "main.peg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, parser.Parse("a = 1 + 2; b1 = 3;", nil) == nil)
+	assert(t, parser.Parse("1 = 1;", nil) != nil)
+
+	_, ok := parser.Grammar["common.chars.Alpha"]
+	assert(t, ok)
+	_, ok = parser.Grammar["n.chars.Digit"]
+	assert(t, ok)
+	assert(t, len(parser.Lint()) == 0)
+
+	s, err := ExportCppPeglib(parser)
+	assert(t, err == nil)
+	assert(t, strings.Contains(s, "<- common_Identifier '=' EXPR ';'\n"))
+	_, err = NewParser(s)
+	assert(t, err == nil)
+
+	parser.EnableAst()
+	ast, err := parser.ParseAndGetAst("a = 1;", nil)
+	assert(t, err == nil)
+	assert(t, ast.Nodes[0].Nodes[0].Name == "common.Identifier")
+	assert(t, ast.Nodes[0].Nodes[1].Nodes[0].Name == "n.Number")
+}
+
+func TestNewParserFromFSOptions(t *testing.T) {
+	fsys := fstest.MapFS{
+		"main.peg": {Data: []byte(`
+			%import "expr.peg"
+			ROOT <- expr.EXPR
+		`)},
+		"expr.peg": {Data: []byte(`
+			EXPR   <- ATOM (BINOP ATOM)*
+			ATOM   <- < [0-9]+ >
+			BINOP  <- < [-+*/] >
+			FACT   <- '!'
+			---
+			%expr  = EXPR
+			%binop = L + -
+			%binop = L * /
+			%prefix  = -
+			%postfix = FACT
+			%ast_drop = BINOP
+		`)},
+	}
+	parser, err := NewParserFromFS(fsys, "main.peg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parser.Grammar["expr.EXPR"].Action = func(v *Values, d Any) (Any, error) {
+		switch {
+		case len(v.Vs) == 1:
+			return v.Vs[0], nil
+		case v.Form == ExprPrefix || v.Form == ExprPostfix:
+			return "(" + v.ToStr(0) + v.ToStr(1) + ")", nil
+		}
+		return "(" + v.ToStr(0) + v.ToStr(1) + v.ToStr(2) + ")", nil
+	}
+	parser.Grammar["expr.ATOM"].Action = func(v *Values, d Any) (Any, error) { return v.Token(), nil }
+	parser.Grammar["expr.BINOP"].Action = func(v *Values, d Any) (Any, error) { return v.Token(), nil }
+	parser.Grammar["expr.FACT"].Action = func(v *Values, d Any) (Any, error) { return "!", nil }
+	val, err := parser.ParseAndGetValue("1+2*3-4", nil)
+	assert(t, err == nil && val == "((1+(2*3))-4)")
+	val, err = parser.ParseAndGetValue("1+2*-3!-4", nil)
+	assert(t, err == nil && val == "((1+(2*(-(3!))))-4)")
+	assert(t, len(parser.AstOptimizer().policies) == 0)
+}
+
+func TestNewParserFromFSErrors(t *testing.T) {
+	fsys := fstest.MapFS{
+		"main.peg": {Data: []byte(`%import "a.peg"
+%import a "b.peg"
+%import "missing.peg"
+%import "bad.peg"
+%import "my-lex.peg"
+%import "cycle.peg"
+%import "ws.peg"
+ROOT        <- a.A b.B
+a.A         <- 'x'
+%whitespace <- ' '*
+`)},
+		"a.peg":      {Data: []byte("A <- 'a'\n")},
+		"b.peg":      {Data: []byte("B <- 'b'\n")},
+		"bad.peg":    {Data: []byte("A <- 'a'\n\nC <- C 'c'\n")},
+		"my-lex.peg": {Data: []byte("A <- 'a'\n")},
+		"cycle.peg":  {Data: []byte("%import \"main.peg\"\nA <- 'a'\n")},
+		"ws.peg":     {Data: []byte("%whitespace <- [ \\t]*\n")},
+	}
+	_, err := NewParserFromFS(fsys, "main.peg")
+	perr, ok := err.(*Error)
+	if !ok {
+		t.Fatal(err)
+	}
+	want := []string{
+		"1:1 'a.A' is already defined.",
+		"2:1 'a' is already imported.",
+		"3:1 open missing.peg: file does not exist",
+		"4:1 bad.peg:3:6 'C' is left recursive.",
+		"5:1 'my-lex' can't be a namespace, so give one as in '%import name \"my-lex.peg\"'.",
+		"6:1 cycle.peg:1:1 'main.peg' is imported recursively.",
+		"7:1 '%whitespace' is already defined.",
+	}
+	if len(perr.Details) != len(want) {
+		t.Fatalf("want %d errors, got %v", len(want), perr.Details)
+	}
+	for i, d := range perr.Details {
+		if d.String() != want[i] {
+			t.Errorf("want %q, got %q", want[i], d.String())
+		}
+	}
+
+	_, err = NewParser(`
+		%import "a.peg"
+		ROOT <- a.A
+	`)
+	assert(t, err != nil && err.Error() == "2:3 'a.peg' can't be imported without a file system.")
+}
+
+func TestNewParserFromFSDiamond(t *testing.T) {
+	fsys := fstest.MapFS{
+		"main.peg": {Data: []byte(`
+			%import "a.peg"
+			%import "b.peg"
+			ROOT <- a.A b.B
+		`)},
+		"a.peg":  {Data: []byte("%import \"ws.peg\"\nA <- 'a' ws.X\n")},
+		"b.peg":  {Data: []byte("%import \"ws.peg\"\nB <- 'b' ws.X\n")},
+		"ws.peg": {Data: []byte("X <- 'x'\n%whitespace <- [ \\t]*\n")},
+	}
+	parser, err := NewParserFromFS(fsys, "main.peg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, parser.Parse(" a x b x ", nil) == nil)
+}
+
+func TestNewParserFromFSDot(t *testing.T) {
+	// Only imported namespaces qualify names
+	fsys := fstest.MapFS{
+		"main.peg": {Data: []byte(`
+			%import "a.peg"
+			ROOT <- a.A B.a.A
+			B    <- 'b'
+		`)},
+		"a.peg": {Data: []byte("A <- 'a'\n")},
+	}
+	parser, err := NewParserFromFS(fsys, "main.peg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, parser.Parse("abxa", nil) == nil)
+}
@@ -1,8 +1,12 @@
 package peg
 
 import (
+	"fmt"
 	"reflect"
+	"runtime"
 	"sync"
+	"unicode"
+	"unicode/utf8"
 )
 
 func success(l int) bool {
@@ -30,7 +34,11 @@ type Values struct {
 	Pos    int
 	S      string
 	Choice int
+	Form   int // Form of the operator in the action of an expression rule
 	Ts     []Token
+
+	name string
+	cs   []*Ast
 }
 
 func (v *Values) Len() int {
@@ -68,6 +76,56 @@ func (v *Values) Token() string {
 	return v.S
 }
 
+// Semantic value error
+type ValueError struct {
+	Rule  string
+	Index int
+	Want  string
+	Got   string
+}
+
+func (e *ValueError) Error() string {
+	return fmt.Sprintf("'%s': semantic value %d is %s, not %s.", e.Rule, e.Index, e.Got, e.Want)
+}
+
+// Get returns the i-th semantic value as T. Unlike the ToXxx methods it
+// reports a missing value or a type mismatch as an error, so that an action
+// can return it as a parse error.
+func Get[T any](v *Values, i int) (val T, err error) {
+	if i < 0 || i >= len(v.Vs) {
+		err = &ValueError{v.name, i, typeName[T](), "missing"}
+		return
+	}
+	val, ok := v.Vs[i].(T)
+	if !ok {
+		err = &ValueError{v.name, i, typeName[T](), fmt.Sprintf("%T", v.Vs[i])}
+	}
+	return
+}
+
+// TypedAction adapts an action returning T to Action. A failed type
+// assertion in fn, such as v.ToInt(i) on a string, becomes an error with the
+// rule name instead of a panic. Other panics aren't recovered.
+func TypedAction[T any](fn func(v *Values, d Any) (T, error)) Action {
+	return func(v *Values, d Any) (val Any, err error) {
+		defer func() {
+			if e := recover(); e != nil {
+				te, ok := e.(*runtime.TypeAssertionError)
+				if !ok {
+					panic(e)
+				}
+				val = nil
+				err = fmt.Errorf("'%s': %s", v.name, te.Error())
+			}
+		}()
+		return fn(v, d)
+	}
+}
+
+func typeName[T any]() string {
+	return reflect.TypeOf((*T)(nil)).Elem().String()
+}
+
 // Context
 type context struct {
 	s string
@@ -81,6 +139,8 @@ type context struct {
 
 	inToken bool
 
+	cst bool
+
 	whitespaceOpe operator
 	inWhitespace  bool
 
@@ -197,6 +257,7 @@ func (o *prioritizedChoice) parseCore(s string, p int, v *Values, c *context, d
 			v.S = chv.S
 			v.Choice = id
 			v.Ts = append(v.Ts, chv.Ts...)
+			v.cs = append(v.cs, chv.cs...)
 			return
 		}
 		id++
@@ -221,14 +282,20 @@ func (o *zeroOrMore) parseCore(s string, p int, v *Values, c *context, d Any) (l
 	for p+l < len(s) {
 		saveVs := v.Vs
 		saveTs := v.Ts
+		saveCs := v.cs
 		chl := o.ope.parse(s, p+l, v, c, d)
 		if fail(chl) {
 			v.Vs = saveVs
 			v.Ts = saveTs
+			v.cs = saveCs
 			c.errorPos = saveErrorPos
 			break
 		}
 		l += chl
+		if chl == 0 {
+			// It would match nothing forever
+			break
+		}
 	}
 	return
 }
@@ -252,14 +319,20 @@ func (o *oneOrMore) parseCore(s string, p int, v *Values, c *context, d Any) (l
 	for p+l < len(s) {
 		saveVs := v.Vs
 		saveTs := v.Ts
+		saveCs := v.cs
 		chl := o.ope.parse(s, p+l, v, c, d)
 		if fail(chl) {
 			v.Vs = saveVs
 			v.Ts = saveTs
+			v.cs = saveCs
 			c.errorPos = saveErrorPos
 			break
 		}
 		l += chl
+		if chl == 0 {
+			// It would match nothing forever
+			break
+		}
 	}
 	return
 }
@@ -268,6 +341,54 @@ func (o *oneOrMore) accept(v visitor) {
 	v.visitOneOrMore(o)
 }
 
+// Repetition
+type repetition struct {
+	opeBase
+	ope operator
+	min int
+	max int // -1 if unbounded
+}
+
+func (o *repetition) parseCore(s string, p int, v *Values, c *context, d Any) (l int) {
+	saveVs := v.Vs
+	saveTs := v.Ts
+	saveCs := v.cs
+	for i := 0; i < o.min; i++ {
+		chl := o.ope.parse(s, p+l, v, c, d)
+		if fail(chl) {
+			v.Vs = saveVs
+			v.Ts = saveTs
+			v.cs = saveCs
+			return -1
+		}
+		l += chl
+	}
+	saveErrorPos := c.errorPos
+	for i := o.min; (o.max == -1 || i < o.max) && p+l < len(s); i++ {
+		saveVs := v.Vs
+		saveTs := v.Ts
+		saveCs := v.cs
+		chl := o.ope.parse(s, p+l, v, c, d)
+		if fail(chl) {
+			v.Vs = saveVs
+			v.Ts = saveTs
+			v.cs = saveCs
+			c.errorPos = saveErrorPos
+			break
+		}
+		l += chl
+		if chl == 0 {
+			// It would match nothing forever
+			break
+		}
+	}
+	return
+}
+
+func (o *repetition) accept(v visitor) {
+	v.visitRepetition(o)
+}
+
 // Option
 type option struct {
 	opeBase
@@ -278,10 +399,12 @@ func (o *option) parseCore(s string, p int, v *Values, c *context, d Any) (l int
 	saveErrorPos := c.errorPos
 	saveVs := v.Vs
 	saveTs := v.Ts
+	saveCs := v.cs
 	l = o.ope.parse(s, p, v, c, d)
 	if fail(l) {
 		v.Vs = saveVs
 		v.Ts = saveTs
+		v.cs = saveCs
 		c.errorPos = saveErrorPos
 		l = 0
 	}
@@ -430,6 +553,76 @@ func (o *characterClass) accept(v visitor) {
 	v.visitCharacterClass(o)
 }
 
+// Unicode Class
+type unicodeClass struct {
+	opeBase
+	text   string // As in the grammar, such as '[\p{L}_]'
+	ranges [][2]rune
+	tables []*unicode.RangeTable
+}
+
+func newUnicodeClass(text string, ranges [][2]rune, tables []*unicode.RangeTable) *unicodeClass {
+	o := &unicodeClass{text: text, ranges: ranges, tables: tables}
+	o.derived = o
+	return o
+}
+
+func (o *unicodeClass) parseCore(s string, p int, v *Values, c *context, d Any) (l int) {
+	if p < len(s) {
+		ch, n := utf8.DecodeRuneInString(s[p:])
+		if (ch != utf8.RuneError || n > 1) && o.matches(ch) {
+			return n
+		}
+	}
+	c.setErrorPos(p)
+	return -1
+}
+
+func (o *unicodeClass) matches(ch rune) bool {
+	for _, r := range o.ranges {
+		if r[0] <= ch && ch <= r[1] {
+			return true
+		}
+	}
+	for _, t := range o.tables {
+		if unicode.Is(t, ch) {
+			return true
+		}
+	}
+	return false
+}
+
+// allRanges returns the ranges of the characters in the class, including
+// the ones in the tables.
+func (o *unicodeClass) allRanges() [][2]rune {
+	ranges := append([][2]rune(nil), o.ranges...)
+	for _, t := range o.tables {
+		for _, r := range t.R16 {
+			for lo := rune(r.Lo); lo <= rune(r.Hi); lo += rune(r.Stride) {
+				if r.Stride == 1 {
+					ranges = append(ranges, [2]rune{lo, rune(r.Hi)})
+					break
+				}
+				ranges = append(ranges, [2]rune{lo, lo})
+			}
+		}
+		for _, r := range t.R32 {
+			for lo := rune(r.Lo); lo <= rune(r.Hi); lo += rune(r.Stride) {
+				if r.Stride == 1 {
+					ranges = append(ranges, [2]rune{lo, rune(r.Hi)})
+					break
+				}
+				ranges = append(ranges, [2]rune{lo, lo})
+			}
+		}
+	}
+	return ranges
+}
+
+func (o *unicodeClass) accept(v visitor) {
+	v.visitUnicodeClass(o)
+}
+
 // Any Character
 type anyCharacter struct {
 	opeBase
@@ -488,6 +681,9 @@ type ignore struct {
 func (o *ignore) parseCore(s string, p int, v *Values, c *context, d Any) int {
 	chv := c.push()
 	l := o.ope.parse(s, p, chv, c, d)
+	if success(l) && c.cst {
+		v.cs = append(v.cs, chv.cs...)
+	}
 	c.pop()
 	return l
 }
@@ -510,6 +706,27 @@ func (o *user) accept(v visitor) {
 	v.visitUser(o)
 }
 
+// Semantic predicate
+type semanticPredicate struct {
+	opeBase
+	name       string
+	negated    bool
+	predicates map[string]Predicate
+}
+
+func (o *semanticPredicate) parseCore(s string, p int, v *Values, c *context, d Any) int {
+	fn := o.predicates[o.name]
+	if (fn != nil && fn(v, p, d)) != o.negated {
+		return 0
+	}
+	c.setErrorPos(p)
+	return -1
+}
+
+func (o *semanticPredicate) accept(v visitor) {
+	v.visitSemanticPredicate(o)
+}
+
 // Reference
 type reference struct {
 	opeBase
@@ -603,6 +820,16 @@ func Oom(ope operator) operator {
 	o.derived = o
 	return o
 }
+// Rep matches ope min to max times, or min times or more if max is -1. It
+// panics if the range can't match, such as Rep(ope, 3, 2).
+func Rep(ope operator, min, max int) operator {
+	if min < 0 || max < -1 || (max != -1 && max < min) {
+		panic(fmt.Sprintf("peg: Rep(%d, %d) has an impossible range", min, max))
+	}
+	o := &repetition{ope: ope, min: min, max: max}
+	o.derived = o
+	return o
+}
 func Opt(ope operator) operator {
 	o := &option{ope: ope}
 	o.derived = o
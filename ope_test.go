@@ -76,6 +76,42 @@ func TestOneOrMore(t *testing.T) {
 	run("OneOrMore", t, ope, cases)
 }
 
+func TestRepetition(t *testing.T) {
+	cases := Cases{
+		{"", -1},
+		{"ab", 2},
+		{"abab", 4},
+		{"ababab", 6},
+		{"abababab", 6},
+	}
+	run("Repetition", t, Rep(Lit("ab"), 1, 3), cases)
+
+	cases = Cases{
+		{"", -1},
+		{"ab", -1},
+		{"abab", 4},
+		{"ababab", 6},
+	}
+	run("Repetition", t, Rep(Lit("ab"), 2, -1), cases)
+
+	cases = Cases{
+		{"", 0},
+		{"ab", 2},
+		{"abab", 2},
+	}
+	run("Repetition", t, Rep(Lit("ab"), 0, 1), cases)
+
+	// Impossible ranges are rejected
+	for _, r := range [][2]int{{3, 2}, {-1, 2}, {0, -2}} {
+		func() {
+			defer func() {
+				assert(t, recover() != nil)
+			}()
+			Rep(Lit("ab"), r[0], r[1])
+		}()
+	}
+}
+
 func TestOption(t *testing.T) {
 	ope := Opt(
 		Lit("abc"),
@@ -0,0 +1,328 @@
+package peg
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Associativity of binary operators
+const (
+	AssocNone = iota
+	AssocLeft
+	AssocRight
+)
+
+// Operator is an operator for expression parsing. Operators of higher
+// levels bind tighter. Ope is an expression made by Lit, Seq, Ref and the
+// other functions for operators, or a *Rule.
+type Operator struct {
+	Kind   int      // ExprBinary, ExprPrefix, ExprPostfix or ExprTernary
+	Token  string   // Operator, or the first operator of a ternary operator
+	Second string   // Second operator of a ternary operator
+	Assoc  int      // Associativity of a binary operator
+	Level  int      // Binding power, which is positive
+	Action Action   // Called instead of the action of the rule if not nil
+	Ope    operator // Matches a prefix or postfix operator named Token if not nil
+}
+
+// OperatorTable is the table of the operators for expression parsing. It
+// can be changed while parsing, such as by the action for a declaration of
+// a user-defined operator.
+type OperatorTable struct {
+	binary  map[string]*Operator
+	prefix  map[string]*Operator
+	postfix map[string]*Operator
+	ternary map[string]*Operator // By the first operator
+
+	// Operators matched by Ope, in the order of addition
+	prefixOpes  []*Operator
+	postfixOpes []*Operator
+}
+
+func NewOperatorTable() *OperatorTable {
+	return &OperatorTable{
+		binary:  make(map[string]*Operator),
+		prefix:  make(map[string]*Operator),
+		postfix: make(map[string]*Operator),
+		ternary: make(map[string]*Operator),
+	}
+}
+
+// Add adds the operator to the table. Words in Token and Second may be
+// separated by spaces, which match any spaces between the words.
+func (t *OperatorTable) Add(ope Operator) error {
+	if msg := t.add(ope); len(msg) > 0 {
+		return fmt.Errorf("peg: %s", msg)
+	}
+	return nil
+}
+
+// add adds the operator, or returns the message for the error.
+func (t *OperatorTable) add(ope Operator) string {
+	ope.Token = operatorToken(ope.Token)
+	ope.Second = operatorToken(ope.Second)
+	name := "'" + ope.Token + "'"
+	switch {
+	case len(ope.Token) == 0 || (ope.Kind == ExprTernary && len(ope.Second) == 0):
+		return "'' can't be an operator"
+	case ope.Kind < ExprBinary || ope.Kind > ExprTernary:
+		return name + " has an unknown kind"
+	case ope.Kind == ExprBinary && (ope.Assoc < AssocNone || ope.Assoc > AssocRight):
+		return name + " has an unknown associativity"
+	case ope.Level <= 0:
+		return name + " needs a positive level"
+	case ope.Ope != nil && ope.Kind != ExprPrefix && ope.Kind != ExprPostfix:
+		return name + " can't be matched by an expression unless it is a prefix or postfix operator"
+	}
+
+	if ope.Ope != nil {
+		opes := &t.prefixOpes
+		if ope.Kind == ExprPostfix {
+			opes = &t.postfixOpes
+		}
+		for _, o := range *opes {
+			if o.Token == ope.Token {
+				return name + " is already an operator"
+			}
+		}
+		*opes = append(*opes, &ope)
+		return ""
+	}
+
+	switch ope.Kind {
+	case ExprPrefix:
+		if _, ok := t.prefix[ope.Token]; ok {
+			return name + " is already a prefix operator"
+		}
+		t.prefix[ope.Token] = &ope
+	case ExprPostfix:
+		if msg := t.checkInfix(ope.Token); len(msg) > 0 {
+			return msg
+		}
+		t.postfix[ope.Token] = &ope
+	case ExprTernary:
+		if msg := t.checkInfix(ope.Token); len(msg) > 0 {
+			return msg
+		}
+		if msg := t.checkInfix(ope.Second); len(msg) > 0 {
+			return msg
+		}
+		t.ternary[ope.Token] = &ope
+	default:
+		if msg := t.checkInfix(ope.Token); len(msg) > 0 {
+			return msg
+		}
+		t.binary[ope.Token] = &ope
+	}
+	return ""
+}
+
+// checkInfix returns the message for the error if tok can't be a new
+// operator after an operand.
+func (t *OperatorTable) checkInfix(tok string) string {
+	_, isBinary := t.binary[tok]
+	_, isPostfix := t.postfix[tok]
+	_, isTernary := t.ternary[tok]
+	for _, ope := range t.ternary {
+		// The second operator ends the middle operand
+		isTernary = isTernary || ope.Second == tok
+	}
+	switch {
+	case isBinary:
+		return "'" + tok + "' is already a binary operator"
+	case isPostfix:
+		return "'" + tok + "' is already a postfix operator"
+	case isTernary:
+		return "'" + tok + "' is already a ternary operator"
+	}
+	return ""
+}
+
+// Remove removes the operator of the kind named tok, and tells if there was
+// one. A ternary operator is named by the first operator.
+func (t *OperatorTable) Remove(kind int, tok string) bool {
+	tok = operatorToken(tok)
+	removeOpe := func(opes *[]*Operator) bool {
+		for i, ope := range *opes {
+			if ope.Token == tok {
+				*opes = append((*opes)[:i:i], (*opes)[i+1:]...)
+				return true
+			}
+		}
+		return false
+	}
+	removeTok := func(m map[string]*Operator) bool {
+		_, ok := m[tok]
+		delete(m, tok)
+		return ok
+	}
+
+	switch kind {
+	case ExprBinary:
+		return removeTok(t.binary)
+	case ExprPrefix:
+		return removeOpe(&t.prefixOpes) || removeTok(t.prefix)
+	case ExprPostfix:
+		return removeOpe(&t.postfixOpes) || removeTok(t.postfix)
+	case ExprTernary:
+		return removeTok(t.ternary)
+	}
+	return false
+}
+
+// Operators returns the operators in the table from the lowest level.
+func (t *OperatorTable) Operators() []Operator {
+	var opes []Operator
+	for _, m := range []map[string]*Operator{t.binary, t.prefix, t.postfix, t.ternary} {
+		for _, ope := range m {
+			opes = append(opes, *ope)
+		}
+	}
+	for _, ope := range append(t.prefixOpes, t.postfixOpes...) {
+		opes = append(opes, *ope)
+	}
+	sort.Slice(opes, func(i, j int) bool {
+		if opes[i].Level != opes[j].Level {
+			return opes[i].Level < opes[j].Level
+		}
+		if opes[i].Kind != opes[j].Kind {
+			return opes[i].Kind < opes[j].Kind
+		}
+		return opes[i].Token < opes[j].Token
+	})
+	return opes
+}
+
+// OperatorTable returns the table of the operators of the expression rule
+// name, or nil if name isn't one.
+func (p *Parser) OperatorTable(name string) *OperatorTable {
+	if r, ok := p.Grammar[name]; ok {
+		if o, ok := r.Ope.(*expression); ok {
+			return o.table
+		}
+	}
+	return nil
+}
+
+// SetOperatorTable makes the rule name in the form of 'ATOM (OPERATOR
+// ATOM)*' parse the operators in t, or replaces the table of the expression
+// rule name.
+func (p *Parser) SetOperatorTable(name string, t *OperatorTable) error {
+	r, ok := p.Grammar[name]
+	if !ok {
+		return fmt.Errorf("peg: '%s' is not defined", name)
+	}
+	if o, ok := r.Ope.(*expression); ok {
+		o.table = t
+		return nil
+	}
+	if _, _, ok := expressionOperands(r); !ok {
+		return fmt.Errorf("peg: '%s' must be in the form of 'ATOM (OPERATOR ATOM)*'", name)
+	}
+	enableExpressionParsing(r, t)
+	return nil
+}
+
+// newOperatorTable makes the table from the levels such as "L + -", from the
+// lowest precedence. A level begins with L, R or N for binary operators
+// which are left, right or non-associative, with P or S for prefix or
+// postfix operators, or with T for a ternary operator. Prefix and postfix
+// operators which are names of rules in grammar are matched by the rules.
+// The levels must have been checked with operatorFields, and errors of the
+// operators in levels[i] are reported with addError.
+func newOperatorTable(levels []string, grammar map[string]*Rule, addError func(i int, msg string)) *OperatorTable {
+	t := NewOperatorTable()
+	for i, s := range levels {
+		level := i + 1
+		flds, _ := operatorFields(s)
+		mode := flds[0]
+
+		var opes []Operator
+		switch mode {
+		case "P", "S":
+			kind := ExprPrefix
+			if mode == "S" {
+				kind = ExprPostfix
+			}
+			for _, fld := range flds[1:] {
+				ope := Operator{Kind: kind, Token: fld, Level: level}
+				if r, ok := grammar[fld]; ok && r.Parameters == nil {
+					ope.Ope = Ref(fld, nil, -1)
+					ope.Ope.(*reference).rule = r
+				}
+				opes = append(opes, ope)
+			}
+		case "T":
+			opes = append(opes, Operator{Kind: ExprTernary, Token: flds[1], Second: flds[2], Level: level})
+		default:
+			assoc := map[string]int{"L": AssocLeft, "R": AssocRight, "N": AssocNone}[mode]
+			for _, fld := range flds[1:] {
+				opes = append(opes, Operator{Kind: ExprBinary, Token: fld, Assoc: assoc, Level: level})
+			}
+		}
+
+		for _, ope := range opes {
+			if msg := t.add(ope); len(msg) > 0 {
+				addError(i, msg+".")
+			}
+		}
+	}
+	return t
+}
+
+// binOpeTable makes the table of the binary operators in bopinf.
+func binOpeTable(bopinf BinOpeInfo) *OperatorTable {
+	t := NewOperatorTable()
+	for tok, inf := range bopinf {
+		t.add(Operator{Kind: ExprBinary, Token: tok, Assoc: inf.assoc, Level: inf.level})
+	}
+	return t
+}
+
+// operatorFields splits a level of operators such as "L + 'is not'" into the
+// fields. Operators in quotes may have spaces and escape sequences.
+func operatorFields(s string) (flds []string, ok bool) {
+	for i := 0; i < len(s); {
+		switch ch := s[i]; {
+		case ch == ' ' || ch == '\t':
+			i++
+		case ch == '\'' || ch == '"':
+			j := i + 1
+			for j < len(s) && s[j] != ch {
+				if s[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(s) {
+				return nil, false
+			}
+			flds = append(flds, resolveEscapeSequence(s[i+1:j]))
+			i = j + 1
+		default:
+			j := i
+			for j < len(s) && s[j] != ' ' && s[j] != '\t' {
+				j++
+			}
+			flds = append(flds, s[i:j])
+			i = j
+		}
+	}
+	return flds, true
+}
+
+// quoteOperator quotes the operator for a level if it can't be written as it
+// is.
+func quoteOperator(op string) string {
+	if len(op) == 0 || strings.ContainsAny(op, " \t'\"\\") {
+		return quoteLiteral(op)
+	}
+	return op
+}
+
+// operatorToken makes the token of an operator with words separated by single
+// spaces, so that 'is  not' matches the operator "is not".
+func operatorToken(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
@@ -0,0 +1,202 @@
+package peg
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestOperatorTable(t *testing.T) {
+	table := NewOperatorTable()
+	binary := func(f func(a, b int) int) Action {
+		return func(v *Values, d Any) (Any, error) { return f(v.ToInt(0), v.ToInt(2)), nil }
+	}
+	opes := []Operator{
+		{Kind: ExprBinary, Token: "+", Assoc: AssocLeft, Level: 1, Action: binary(func(a, b int) int { return a + b })},
+		{Kind: ExprBinary, Token: "-", Assoc: AssocLeft, Level: 1, Action: binary(func(a, b int) int { return a - b })},
+		{Kind: ExprBinary, Token: "*", Assoc: AssocLeft, Level: 2, Action: binary(func(a, b int) int { return a * b })},
+		{Kind: ExprBinary, Token: "^", Assoc: AssocRight, Level: 3, Action: binary(func(a, b int) int {
+			n := 1
+			for i := 0; i < b; i++ {
+				n *= a
+			}
+			return n
+		})},
+		{Kind: ExprPrefix, Token: "-", Level: 4, Action: func(v *Values, d Any) (Any, error) { return -v.ToInt(1), nil }},
+		{Kind: ExprPostfix, Token: "!", Level: 5, Action: func(v *Values, d Any) (Any, error) {
+			n := 1
+			for i := 2; i <= v.ToInt(0); i++ {
+				n *= i
+			}
+			return n, nil
+		}},
+	}
+	for _, ope := range opes {
+		if err := table.Add(ope); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var EXPR, NUMBER Rule
+	EXPR.Ope = ExpWithTable(&NUMBER, Tok(Cls("-+*^!")), table, nil)
+	NUMBER.Ope = Tok(Oom(Cls("0-9")))
+	NUMBER.Action = func(v *Values, d Any) (Any, error) { return strconv.Atoi(v.Token()) }
+
+	tests := []struct {
+		in   string
+		want int
+	}{
+		{"1+2*3-4", 3},
+		{"2^3^2", 512},
+		{"-2*3!", -12},
+		{"2*-3", -6},
+	}
+	for _, test := range tests {
+		_, val, err := EXPR.Parse(test.in, nil)
+		if err != nil || val != test.want {
+			t.Errorf("%q: want %d, got %v (%v)", test.in, test.want, val, err)
+		}
+	}
+
+	// The text is the value of an atom without one
+	list := NewOperatorTable()
+	assert(t, list.Add(Operator{Kind: ExprBinary, Token: "+", Assoc: AssocLeft, Level: 1}) == nil)
+	concat := Action(func(v *Values, d Any) (Any, error) {
+		return "(" + v.ToStr(0) + v.ToStr(1) + v.ToStr(2) + ")", nil
+	})
+	var LIST Rule
+	LIST.Ope = ExpWithTable(Cls("0-9"), Cls("+"), list, &concat)
+	_, val, err := LIST.Parse("1+2+3", nil)
+	assert(t, err == nil && val == "((1+2)+3)")
+
+	// Operators can be changed after the rule is made
+	assert(t, table.Remove(ExprPostfix, "!"))
+	assert(t, !table.Remove(ExprPostfix, "!"))
+	_, _, err = EXPR.Parse("3!", nil)
+	assert(t, err != nil)
+
+	got := table.Operators()
+	assert(t, len(got) == 5 && got[0].Token == "+" && got[2].Token == "*" && got[4].Kind == ExprPrefix)
+
+	errs := []struct {
+		ope  Operator
+		want string
+	}{
+		{Operator{Kind: ExprBinary, Token: "+", Level: 1}, "peg: '+' is already a binary operator"},
+		{Operator{Kind: ExprPrefix, Token: " - ", Level: 1}, "peg: '-' is already a prefix operator"},
+		{Operator{Kind: ExprTernary, Token: "?", Second: "*", Level: 1}, "peg: '*' is already a binary operator"},
+		{Operator{Kind: ExprTernary, Token: "?", Level: 1}, "peg: '' can't be an operator"},
+		{Operator{Kind: ExprBinary, Token: "/"}, "peg: '/' needs a positive level"},
+		{Operator{Kind: ExprBinary, Token: "/", Assoc: 5, Level: 1}, "peg: '/' has an unknown associativity"},
+		{Operator{Kind: 9, Token: "/", Level: 1}, "peg: '/' has an unknown kind"},
+		{Operator{Kind: ExprBinary, Token: "/", Level: 1, Ope: Lit("/")}, "peg: '/' can't be matched by an expression unless it is a prefix or postfix operator"},
+	}
+	for _, test := range errs {
+		if err := table.Add(test.ope); err == nil || err.Error() != test.want {
+			t.Errorf("want %q, got %v", test.want, err)
+		}
+	}
+}
+
+func TestUserDefinedOperators(t *testing.T) {
+	parser, err := NewParser(`
+		PROGRAM     <- (DECL / EXPR ';')*
+		DECL        <- 'infix' < [lrn] > < [1-9] > OPE ';'
+		EXPR        <- ATOM (OPE ATOM)*
+		ATOM        <- < [a-z0-9]+ >
+		OPE         <- < [-+*/<>|&^%$=]+ >
+		%whitespace <- [ \t\n]*
+		---
+		%expr  = EXPR
+		%binop = L + -
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g := parser.Grammar
+	g["PROGRAM"].Action = func(v *Values, d Any) (Any, error) {
+		var vals []string
+		for i := range v.Vs {
+			if v.Vs[i] != nil {
+				vals = append(vals, v.ToStr(i))
+			}
+		}
+		return vals, nil
+	}
+	g["DECL"].Action = func(v *Values, d Any) (Any, error) {
+		level, _ := strconv.Atoi(v.Ts[1].S)
+		assoc := map[string]int{"l": AssocLeft, "r": AssocRight, "n": AssocNone}[v.Ts[0].S]
+		return nil, parser.OperatorTable("EXPR").Add(Operator{
+			Kind:  ExprBinary,
+			Token: v.ToStr(0),
+			Assoc: assoc,
+			Level: level,
+			Action: func(v *Values, d Any) (Any, error) {
+				return v.ToStr(1) + "(" + v.ToStr(0) + "," + v.ToStr(2) + ")", nil
+			},
+		})
+	}
+	g["EXPR"].Action = func(v *Values, d Any) (Any, error) {
+		if len(v.Vs) == 1 {
+			return v.Vs[0], nil
+		}
+		return "(" + v.ToStr(0) + " " + v.ToStr(1) + " " + v.ToStr(2) + ")", nil
+	}
+	g["ATOM"].Action = func(v *Values, d Any) (Any, error) { return v.Token(), nil }
+	g["OPE"].Action = func(v *Values, d Any) (Any, error) { return v.Token(), nil }
+
+	val, err := parser.ParseAndGetValue("infix r 5 <>; a + b <> c <> d; infix n 2 ==; a == b + c;", nil)
+	assert(t, err == nil)
+	vals, ok := val.([]string)
+	assert(t, ok && len(vals) == 2)
+	assert(t, vals[0] == "(a + <>(b,<>(c,d)))")
+	assert(t, vals[1] == "(==(a,b) + c)")
+
+	// The operators are kept in the table
+	err = parser.Parse("a <> b == c;", nil)
+	assert(t, err == nil)
+	assert(t, parser.Parse("a == b == c;", nil) != nil)
+	assert(t, parser.OperatorTable("EXPR").Remove(ExprBinary, "<>"))
+	assert(t, parser.Parse("a <> b;", nil) != nil)
+	assert(t, parser.OperatorTable("PROGRAM") == nil)
+}
+
+func TestSetOperatorTable(t *testing.T) {
+	parser, err := NewParser(`
+		LIST <- ITEM (SEP ITEM)*
+		ITEM <- < [a-z]+ > / '(' LIST ')'
+		SEP  <- < [,;] >
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := NewOperatorTable()
+	assert(t, table.Add(Operator{Kind: ExprBinary, Token: ";", Assoc: AssocLeft, Level: 1}) == nil)
+	assert(t, table.Add(Operator{Kind: ExprBinary, Token: ",", Assoc: AssocRight, Level: 2}) == nil)
+	assert(t, parser.SetOperatorTable("LIST", table) == nil)
+	assert(t, parser.OperatorTable("LIST") == table)
+
+	parser.Grammar["LIST"].Action = func(v *Values, d Any) (Any, error) {
+		if len(v.Vs) == 1 {
+			return v.Vs[0], nil
+		}
+		return "(" + v.ToStr(0) + v.ToStr(1) + v.ToStr(2) + ")", nil
+	}
+	parser.Grammar["ITEM"].Action = func(v *Values, d Any) (Any, error) {
+		if v.Choice == 1 {
+			return v.Vs[0], nil
+		}
+		return v.Token(), nil
+	}
+	val, err := parser.ParseAndGetValue("a,b;c,d,e", nil)
+	assert(t, err == nil && val == "((a,b);(c,(d,e)))")
+
+	// The table can be replaced
+	assert(t, parser.SetOperatorTable("LIST", NewOperatorTable()) == nil)
+	assert(t, parser.Parse("a,b", nil) != nil)
+
+	err = parser.SetOperatorTable("NONE", table)
+	assert(t, err != nil && err.Error() == "peg: 'NONE' is not defined")
+	err = parser.SetOperatorTable("ITEM", table)
+	assert(t, err != nil && err.Error() == "peg: 'ITEM' must be in the form of 'ATOM (OPERATOR ATOM)*'")
+}
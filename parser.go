@@ -1,12 +1,34 @@
 package peg
 
-import "strings"
+import (
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
 
 const (
 	WhitespceRuleName = "%whitespace"
 	WordRuleName      = "%word"
+	CstTextName       = "%text"
 	OptExpressionRule = "%expr"
 	OptBinaryOperator = "%binop"
+	OptStartRule      = "%start"
+
+	OptPrefixOperator  = "%prefix"
+	OptPostfixOperator = "%postfix"
+	OptTernaryOperator = "%ternary"
+
+	OptAstKeep            = "%ast_keep"
+	OptAstDrop            = "%ast_drop"
+	OptAstFlatten         = "%ast_flatten"
+	OptAstRename          = "%ast_rename"
+	OptAstMerge           = "%ast_merge"
+	OptAstDropPunctuation = "%ast_drop_punctuation"
 )
 
 // PEG parser generator
@@ -15,46 +37,142 @@ type duplicate struct {
 	pos  int
 }
 
+type definition struct {
+	rule *Rule
+	end  int
+}
+
+// instruction is the block after a definition such as
+// '{ error_message "..."; precedence L + - }'.
+type instruction struct {
+	message    string
+	precedence []string
+}
+
+// grammarImport is a directive such as '%import common "common.peg"'. name
+// is empty if the namespace isn't given.
+type grammarImport struct {
+	name string
+	path string
+	pos  int
+	end  int
+}
+
+// namespace returns the namespace of the imported rules, which is the file
+// name without the extension unless it is given.
+func (imp grammarImport) namespace() string {
+	if len(imp.name) > 0 {
+		return imp.name
+	}
+	base := path.Base(imp.path)
+	return strings.TrimSuffix(base, path.Ext(base))
+}
+
+// matchNamespace matches an imported namespace and the dot such as 'common.'
+// in 'common.Identifier', so that 'A <- B.C' is still B, any character and C
+// unless B is imported.
+func matchNamespace(s string, p int, v *Values, d Any) int {
+	data, ok := d.(*data)
+	if !ok {
+		return -1
+	}
+	for _, imp := range data.imports {
+		if ns := imp.namespace() + "."; strings.HasPrefix(s[p:], ns) {
+			return len(ns)
+		}
+	}
+	return -1
+}
+
+type grammarOption struct {
+	name  string
+	value string
+	pos   int
+	end   int
+}
+
 type data struct {
-	grammar    map[string]*Rule
-	start      string
-	duplicates []duplicate
-	options    map[string][]string
+	grammar      map[string]*Rule
+	start        string
+	duplicates   []duplicate
+	options      map[string][]string
+	optionPos    map[string][]int
+	optionSS     map[string]string // Sources of the options from a base grammar
+	definitions  []definition
+	optionList   []grammarOption
+	separatorPos int
+	comments     map[int]string // Collected only when it isn't nil
+	positions    map[operator]int
+	imports      []grammarImport
 }
 
 func newData() *data {
 	return &data{
-		grammar: make(map[string]*Rule),
-		options: make(map[string][]string),
+		grammar:      make(map[string]*Rule),
+		options:      make(map[string][]string),
+		optionPos:    make(map[string][]int),
+		optionSS:     make(map[string]string),
+		separatorPos: -1,
+		positions:    make(map[operator]int),
 	}
 }
 
+// optionSource returns the grammar source with the option name, which is s
+// unless the option comes from a base grammar.
+func (d *data) optionSource(s string, name string) string {
+	if ss, ok := d.optionSS[name]; ok {
+		return ss
+	}
+	return s
+}
+
+// at records the position of an expression in the grammar.
+func (d *data) at(ope operator, pos int) operator {
+	d.positions[ope] = pos
+	return ope
+}
+
 var rStart, rDefinition, rExpression,
 	rSequence, rPrefix, rSuffix, rPrimary,
 	rIdentifier, rIdentCont, rIdentStart, rIdentRest,
-	rLiteral, rClass, rRange, rChar,
+	rLiteral, rClass, rRange, rChar, rProperty,
 	rLEFTARROW, rSLASH, rAND, rNOT, rQUESTION, rSTAR, rPLUS, rOPEN, rCLOSE, rDOT,
+	rRepetition,
 	rSpacing, rComment, rSpace, rEndOfLine, rEndOfFile, rBeginTok, rEndTok,
 	rIgnore, rIGNORE,
 	rParameters, rArguments, rCOMMA,
-	rOption, rOptionValue, rOptionComment, rASSIGN, rSEPARATOR Rule
+	rOption, rOptionValue, rOptionComment, rASSIGN, rSEPARATOR,
+	rInstruction, rInstructionItem, rErrorMessage, rPrecedence, rPrecedenceInfo, rPrecedenceOpe,
+	rSEMICOLON, rBeginBlk, rEndBlk,
+	rImport Rule
 
 func init() {
 	// Setup PEG syntax parser
 	rStart.Ope = Seq(
 		&rSpacing,
+		Zom(&rImport),
 		Oom(&rDefinition),
 		Opt(Seq(&rSEPARATOR, Oom(&rOption))),
 		&rEndOfFile)
 
+	rImport.Ope = Seq(Lit("%import"), Npd(&rIdentRest), Ign(&rSpacing), Opt(&rIdentifier), &rLiteral)
+
 	rDefinition.Ope = Cho(
-		Seq(&rIgnore, &rIdentCont, &rParameters, &rLEFTARROW, &rExpression),
-		Seq(&rIgnore, &rIdentifier, &rLEFTARROW, &rExpression))
+		Seq(&rIgnore, &rIdentCont, &rParameters, &rLEFTARROW, &rExpression, Opt(&rInstruction)),
+		Seq(&rIgnore, &rIdentifier, &rLEFTARROW, &rExpression, Opt(&rInstruction)))
 
 	rExpression.Ope = Seq(&rSequence, Zom(Seq(&rSLASH, &rSequence)))
 	rSequence.Ope = Zom(&rPrefix)
-	rPrefix.Ope = Seq(Opt(Cho(&rAND, &rNOT)), &rSuffix)
-	rSuffix.Ope = Seq(&rPrimary, Opt(Cho(&rQUESTION, &rSTAR, &rPLUS)))
+	rPrefix.Ope = Cho(
+		Seq(Cho(&rAND, &rNOT), &rBeginBlk, &rIdentifier, &rEndBlk),
+		Seq(Opt(Cho(&rAND, &rNOT)), &rSuffix))
+	rSuffix.Ope = Seq(&rPrimary, Opt(Cho(&rQUESTION, &rSTAR, &rPLUS, &rRepetition)))
+	rRepetition.Ope = Seq(
+		&rBeginBlk,
+		Cho(
+			Seq(Oom(Cls("0-9")), Ign(&rSpacing), Opt(Seq(&rCOMMA, Zom(Cls("0-9")), Ign(&rSpacing)))),
+			Seq(&rCOMMA, Oom(Cls("0-9")), Ign(&rSpacing))),
+		&rEndBlk)
 
 	rPrimary.Ope = Cho(
 		Seq(&rIgnore, &rIdentCont, &rArguments, Npd(&rLEFTARROW)),
@@ -63,10 +181,11 @@ func init() {
 		Seq(&rBeginTok, &rExpression, &rEndTok),
 		&rLiteral,
 		&rClass,
+		Seq(&rProperty, &rSpacing),
 		&rDOT)
 
 	rIdentifier.Ope = Seq(&rIdentCont, &rSpacing)
-	rIdentCont.Ope = Seq(&rIdentStart, Zom(&rIdentRest))
+	rIdentCont.Ope = Seq(Opt(Usr(matchNamespace)), &rIdentStart, Zom(&rIdentRest))
 	rIdentStart.Ope = Cls("a-zA-Z_\x80-\xff%")
 	rIdentRest.Ope = Cho(&rIdentStart, Cls("0-9"))
 
@@ -76,13 +195,16 @@ func init() {
 
 	rClass.Ope = Seq(Lit("["), Tok(Zom(Seq(Npd(Lit("]")), &rRange))), Lit("]"), &rSpacing)
 
-	rRange.Ope = Cho(Seq(&rChar, Lit("-"), &rChar), &rChar)
+	rRange.Ope = Cho(&rProperty, Seq(&rChar, Lit("-"), &rChar), &rChar)
 	rChar.Ope = Cho(
+		Seq(Lit("\\u{"), Rep(Cls("0-9a-fA-F"), 1, 6), Lit("}")),
+		Seq(Lit("\\u"), Rep(Cls("0-9a-fA-F"), 4, 4)),
 		Seq(Lit("\\"), Cls("nrtfv'\"[]\\")),
 		Seq(Lit("\\"), Cls("0-3"), Cls("0-7"), Cls("0-7")),
 		Seq(Lit("\\"), Cls("0-7"), Opt(Cls("0-7"))),
 		Seq(Lit("\\x"), Cls("0-9a-fA-F"), Opt(Cls("0-9a-fA-F"))),
 		Seq(Npd(Lit("\\")), Dot()))
+	rProperty.Ope = Seq(Lit("\\p{"), Tok(Oom(Cls("a-zA-Z_"))), Lit("}"))
 
 	rLEFTARROW.Ope = Seq(Cho(Lit("<-"), Lit("←")), &rSpacing)
 	rSLASH.Ope = Seq(Lit("/"), &rSpacing)
@@ -123,7 +245,24 @@ func init() {
 	rOptionComment.Ope = Seq(Zom(Cho(Lit(" "), Lit("\t"))), Cho(&rComment, &rEndOfLine))
 	rOptionValue.Ope = Seq(Tok(Zom(Seq(Npd(&rOptionComment), Dot()))), &rOptionComment, &rSpacing)
 	rASSIGN.Ope = Seq(Lit("="), &rSpacing)
-	rSEPARATOR.Ope = Seq(Lit("---"), &rSpacing)
+
+	rInstruction.Ope = Seq(&rBeginBlk, Opt(Seq(&rInstructionItem, Zom(Seq(&rSEMICOLON, &rInstructionItem)))), &rEndBlk)
+	rInstructionItem.Ope = Cho(&rErrorMessage, &rPrecedence)
+	rErrorMessage.Ope = Seq(Lit("error_message"), Ign(&rSpacing), &rLiteral)
+	rPrecedence.Ope = Seq(Lit("precedence"), Ign(&rSpacing), Oom(&rPrecedenceInfo))
+	rPrecedenceInfo.Ope = Seq(Tok(Cls("LRN")), Ign(&rSpacing), Oom(&rPrecedenceOpe))
+	rPrecedenceOpe.Ope = Seq(
+		Cho(
+			Seq(Lit("'"), Tok(Zom(Seq(Npd(Cls("'\r\n")), &rChar))), Lit("'")),
+			Seq(Lit("\""), Tok(Zom(Seq(Npd(Cls("\"\r\n")), &rChar))), Lit("\"")),
+			Seq(Npd(Seq(Lit("N"), Cls(" \t\r\n"))), Tok(Oom(Seq(Npd(Cls("LR} \t\r\n")), Dot()))))),
+		Ign(&rSpacing))
+	rSEMICOLON.Ope = Seq(Lit(";"), &rSpacing)
+	rSEMICOLON.Ignore = true
+	rBeginBlk.Ope = Seq(Lit("{"), &rSpacing)
+	rBeginBlk.Ignore = true
+	rEndBlk.Ope = Seq(Lit("}"), &rSpacing)
+	rEndBlk.Ignore = true
 
 	// Setup actions
 	rDefinition.Action = func(v *Values, d Any) (val Any, err error) {
@@ -131,6 +270,7 @@ func init() {
 		var name string
 		var params []string
 		var ope operator
+		var inst instruction
 
 		switch v.Choice {
 		case 0: // Macro
@@ -138,25 +278,36 @@ func init() {
 			name = v.ToStr(1)
 			params = v.Vs[2].([]string)
 			ope = v.ToOpe(4)
+			if len(v.Vs) > 5 {
+				inst = v.Vs[5].(instruction)
+			}
 		case 1: // Rule
 			ignore = v.ToBool(0)
 			name = v.ToStr(1)
 			ope = v.ToOpe(3)
+			if len(v.Vs) > 4 {
+				inst = v.Vs[4].(instruction)
+			}
 		}
 
 		data := d.(*data)
+		rule := &Rule{
+			Ope:          ope,
+			Name:         name,
+			SS:           v.SS,
+			Pos:          v.Pos,
+			Ignore:       ignore,
+			Parameters:   params,
+			ErrorMessage: inst.message,
+			precedence:   inst.precedence,
+		}
+		data.definitions = append(data.definitions, definition{rule, v.Pos + len(v.S)})
+
 		_, ok := data.grammar[name]
 		if ok {
 			data.duplicates = append(data.duplicates, duplicate{name, v.Pos})
 		} else {
-			data.grammar[name] = &Rule{
-				Ope:        ope,
-				Name:       name,
-				SS:         v.SS,
-				Pos:        v.Pos,
-				Ignore:     ignore,
-				Parameters: params,
-			}
+			data.grammar[name] = rule
 			if len(data.start) == 0 {
 				data.start = name
 			}
@@ -164,6 +315,17 @@ func init() {
 		return
 	}
 
+	rImport.Action = func(v *Values, d Any) (Any, error) {
+		imp := grammarImport{pos: v.Pos, end: v.Pos + len(v.S)}
+		if len(v.Vs) > 1 {
+			imp.name = v.ToStr(0)
+		}
+		imp.path = v.ToOpe(len(v.Vs) - 1).(*literalString).lit
+		data := d.(*data)
+		data.imports = append(data.imports, imp)
+		return nil, nil
+	}
+
 	rParameters.Action = func(v *Values, d Any) (val Any, err error) {
 		var params []string
 		for i := 0; i < len(v.Vs); i++ {
@@ -203,22 +365,26 @@ func init() {
 			for i := 0; i < len(v.Vs); i++ {
 				opes = append(opes, v.ToOpe(i))
 			}
-			val = Seq(opes...)
+			val = d.(*data).at(Seq(opes...), v.Pos)
 		}
 		return
 	}
 
 	rPrefix.Action = func(v *Values, d Any) (val Any, err error) {
-		if len(v.Vs) == 1 {
+		if v.Choice == 0 {
+			o := &semanticPredicate{name: v.ToStr(1), negated: v.ToStr(0) == "!"}
+			o.derived = o
+			val = d.(*data).at(o, v.Pos)
+		} else if len(v.Vs) == 1 {
 			val = v.ToOpe(0)
 		} else {
 			tok := v.ToStr(0)
 			ope := v.ToOpe(1)
 			switch tok {
 			case "&":
-				val = Apd(ope)
+				val = d.(*data).at(Apd(ope), v.Pos)
 			case "!":
-				val = Npd(ope)
+				val = d.(*data).at(Npd(ope), v.Pos)
 			}
 		}
 		return
@@ -228,15 +394,17 @@ func init() {
 		ope := v.ToOpe(0)
 		if len(v.Vs) == 1 {
 			val = ope
+		} else if rep, ok := v.Vs[1].([2]int); ok {
+			val = d.(*data).at(Rep(ope, rep[0], rep[1]), v.Pos)
 		} else {
 			tok := v.ToStr(1)
 			switch tok {
 			case "?":
-				val = Opt(ope)
+				val = d.(*data).at(Opt(ope), v.Pos)
 			case "*":
-				val = Zom(ope)
+				val = d.(*data).at(Zom(ope), v.Pos)
 			case "+":
-				val = Oom(ope)
+				val = d.(*data).at(Oom(ope), v.Pos)
 			}
 		}
 		return
@@ -265,9 +433,47 @@ func init() {
 		default:
 			val = v.ToOpe(0)
 		}
+		d.(*data).at(val.(operator), v.Pos)
 		return
 	}
 
+	rInstruction.Action = func(v *Values, d Any) (Any, error) {
+		var inst instruction
+		for _, item := range v.Vs {
+			switch item := item.(type) {
+			case string:
+				inst.message = item
+			case []string:
+				inst.precedence = item
+			}
+		}
+		return inst, nil
+	}
+
+	rErrorMessage.Action = func(v *Values, d Any) (Any, error) {
+		return v.ToOpe(0).(*literalString).lit, nil
+	}
+
+	rPrecedence.Action = func(v *Values, d Any) (Any, error) {
+		var levels []string
+		for i := range v.Vs {
+			levels = append(levels, v.ToStr(i))
+		}
+		return levels, nil
+	}
+
+	rPrecedenceInfo.Action = func(v *Values, d Any) (Any, error) {
+		fields := []string{v.Token()}
+		for i := range v.Vs {
+			fields = append(fields, quoteOperator(v.ToStr(i)))
+		}
+		return strings.Join(fields, " "), nil
+	}
+
+	rPrecedenceOpe.Action = func(v *Values, d Any) (Any, error) {
+		return resolveEscapeSequence(v.Token()), nil
+	}
+
 	rIdentCont.Action = func(v *Values, d Any) (Any, error) {
 		return v.S, nil
 	}
@@ -277,7 +483,46 @@ func init() {
 	}
 
 	rClass.Action = func(v *Values, d Any) (Any, error) {
-		return Cls(resolveEscapeSequence(v.Ts[0].S)), nil
+		return classOpe(v.Ts[0].S), nil
+	}
+
+	rChar.Action = func(v *Values, d Any) (Any, error) {
+		if strings.HasPrefix(v.S, `\u`) {
+			if ch, _, _ := escapeSequence(v.S, 0); ch > unicode.MaxRune || 0xd800 <= ch && ch <= 0xdfff {
+				return nil, errors.New("'" + v.S + "' is not a valid code point.")
+			}
+		}
+		return nil, nil
+	}
+
+	rProperty.Action = func(v *Values, d Any) (Any, error) {
+		t := unicodeTable(v.Token())
+		if t == nil {
+			return nil, errors.New("'" + v.S + "' is not a Unicode category or script.")
+		}
+		return newUnicodeClass(v.S, nil, []*unicode.RangeTable{t}), nil
+	}
+
+	rRepetition.Action = func(v *Values, d Any) (Any, error) {
+		// '{n}', '{n,}', '{,m}' or '{n,m}'
+		s := strings.Join(strings.Fields(strings.Trim(strings.TrimSpace(v.S), "{}")), "")
+		rep := [2]int{0, -1}
+		for i, fld := range strings.SplitN(s, ",", 2) {
+			if len(fld) > 0 {
+				n, err := strconv.Atoi(fld)
+				if err != nil {
+					return nil, errors.New("'{" + s + "}' has a count which is too large.")
+				}
+				rep[i] = n
+			}
+		}
+		if !strings.Contains(s, ",") {
+			rep[1] = rep[0]
+		}
+		if rep[1] != -1 && rep[1] < rep[0] {
+			return nil, errors.New("'{" + s + "}' has the maximum less than the minimum.")
+		}
+		return rep, nil
 	}
 
 	rAND.Action = func(v *Values, d Any) (Any, error) {
@@ -306,15 +551,30 @@ func init() {
 	}
 
 	rOption.Action = func(v *Values, d Any) (val Any, err error) {
-		options := d.(*data).options
+		data := d.(*data)
 		optName := v.ToStr(0)
 		optVal := v.ToStr(2)
-		options[optName] = append(options[optName], optVal)
+		data.options[optName] = append(data.options[optName], optVal)
+		data.optionPos[optName] = append(data.optionPos[optName], v.Pos)
+		data.optionList = append(data.optionList, grammarOption{optName, optVal, v.Pos, v.Pos + len(v.S)})
 		return
 	}
 	rOptionValue.Action = func(v *Values, d Any) (Any, error) {
 		return v.Token(), nil
 	}
+
+	rSEPARATOR.Action = func(v *Values, d Any) (val Any, err error) {
+		d.(*data).separatorPos = v.Pos
+		return
+	}
+
+	rComment.Action = func(v *Values, d Any) (val Any, err error) {
+		// A comment may be tried more than once through backtracking
+		if data := d.(*data); data.comments != nil {
+			data.comments[v.Pos] = strings.TrimRight(v.S, "\r\n")
+		}
+		return
+	}
 }
 
 func isHex(c byte) (v int, ok bool) {
@@ -339,9 +599,11 @@ func isDigit(c byte) (v int, ok bool) {
 	return
 }
 
+// parseHexNumber reads up to 2 digits as the grammar allows, so '\x414' is
+// "A4".
 func parseHexNumber(s string, i int) (byte, int) {
 	ret := 0
-	for i < len(s) {
+	for end := i + 2; i < len(s) && i < end; {
 		val, ok := isHex(s[i])
 		if !ok {
 			break
@@ -352,11 +614,18 @@ func parseHexNumber(s string, i int) (byte, int) {
 	return byte(ret), i
 }
 
+// parseOctNumber reads octal digits as the grammar allows, which are 3 digits
+// if the first is 0 to 3 and 2 otherwise, so '\1018' is "A8" and '\477' is
+// "'7".
 func parseOctNumber(s string, i int) (byte, int) {
 	ret := 0
-	for i < len(s) {
+	end := i + 2
+	if i < len(s) && s[i] <= '3' {
+		end++
+	}
+	for i < len(s) && i < end {
 		val, ok := isDigit(s[i])
-		if !ok {
+		if !ok || val > 7 {
 			break
 		}
 		ret = ret*8 + val
@@ -365,6 +634,58 @@ func parseOctNumber(s string, i int) (byte, int) {
 	return byte(ret), i
 }
 
+// parseUnicodeNumber reads the digits of '\u{XXXX}' or '\uXXXX'.
+func parseUnicodeNumber(s string, i int) (rune, int) {
+	end := i + 4
+	if i < len(s) && s[i] == '{' {
+		i++
+		end = len(s)
+	}
+	ret := rune(0)
+	for i < len(s) && i < end {
+		val, ok := isHex(s[i])
+		if !ok {
+			break
+		}
+		ret = ret*16 + rune(val)
+		i++
+	}
+	if i < len(s) && s[i] == '}' {
+		i++
+	}
+	return ret, i
+}
+
+// escapeSequence reads the escape sequence at s[i], which is '\'. A
+// character given with '\u' is a rune to be encoded in UTF-8, and the others
+// are bytes.
+func escapeSequence(s string, i int) (ch rune, isRune bool, next int) {
+	i++
+	switch s[i] {
+	case 'n':
+		return '\n', false, i + 1
+	case 'r':
+		return '\r', false, i + 1
+	case 't':
+		return '\t', false, i + 1
+	case 'f':
+		return '\f', false, i + 1
+	case 'v':
+		return '\v', false, i + 1
+	case '\'', '"', '[', ']', '\\':
+		return rune(s[i]), false, i + 1
+	case 'x':
+		b, next := parseHexNumber(s, i+1)
+		return rune(b), false, next
+	case 'u':
+		ch, next := parseUnicodeNumber(s, i+1)
+		return ch, true, next
+	default:
+		b, next := parseOctNumber(s, i)
+		return rune(b), false, next
+	}
+}
+
 func resolveEscapeSequence(s string) string {
 	n := len(s)
 	b := make([]byte, 0, n)
@@ -373,44 +694,13 @@ func resolveEscapeSequence(s string) string {
 	for i < n {
 		ch := s[i]
 		if ch == '\\' {
-			i++
-			switch s[i] {
-			case 'n':
-				b = append(b, '\n')
-				i++
-			case 'r':
-				b = append(b, '\r')
-				i++
-			case 't':
-				b = append(b, '\t')
-				i++
-			case 'f':
-				b = append(b, '\f')
-				i++
-			case 'v':
-				b = append(b, '\v')
-				i++
-			case '\'':
-				b = append(b, '\'')
-				i++
-			case '"':
-				b = append(b, '"')
-				i++
-			case '[':
-				b = append(b, '[')
-				i++
-			case ']':
-				b = append(b, ']')
-				i++
-			case '\\':
-				b = append(b, '\\')
-				i++
-			case 'x':
-				ch, i = parseHexNumber(s, i+1)
-				b = append(b, ch)
-			default:
-				ch, i = parseOctNumber(s, i)
-				b = append(b, ch)
+			var r rune
+			var isRune bool
+			r, isRune, i = escapeSequence(s, i)
+			if isRune {
+				b = utf8.AppendRune(b, r)
+			} else {
+				b = append(b, byte(r))
 			}
 		} else {
 			b = append(b, ch)
@@ -421,49 +711,284 @@ func resolveEscapeSequence(s string) string {
 	return string(b)
 }
 
-func getExpressionParsingOptions(options map[string][]string) (name string, info BinOpeInfo) {
-	name = ""
-	if vs, ok := options[OptExpressionRule]; ok {
-		name = vs[0]
-		// TODO: error handling
-	}
-
-	info = make(BinOpeInfo)
-	if vs, ok := options[OptBinaryOperator]; ok {
-		level := 1
-		for _, s := range vs {
-			flds := strings.Split(s, " ")
-			// TODO: error handling
-			assoc := assocNone
-			for i, fld := range flds {
-				switch i {
-				case 0:
-					switch fld {
-					case "L":
-						assoc = assocLeft
-					case "R":
-						assoc = assocRight
-					default:
-						// TODO: error handling
-					}
-				default:
-					info[fld] = struct {
-						level int
-						assoc int
-					}{level, assoc}
+// classOpe makes the operator for a class from the text between '[' and ']'.
+// A class of ASCII characters matches a byte. The others, with non-ASCII
+// characters, '\u' or '\p{...}', match a character in UTF-8.
+func classOpe(s string) operator {
+	var ranges [][2]rune
+	var tables []*unicode.RangeTable
+	ascii := true
+	char := func(i int) (rune, int) {
+		if s[i] == '\\' {
+			ch, isRune, next := escapeSequence(s, i)
+			ascii = ascii && !isRune
+			return ch, next
+		}
+		ch, n := utf8.DecodeRuneInString(s[i:])
+		ascii = ascii && ch < utf8.RuneSelf
+		return ch, i + n
+	}
+
+	for i := 0; i < len(s); {
+		if strings.HasPrefix(s[i:], `\p{`) {
+			end := i + strings.IndexByte(s[i:], '}')
+			tables = append(tables, unicodeTable(s[i+3:end]))
+			ascii = false
+			i = end + 1
+			continue
+		}
+		lo, next := char(i)
+		hi := lo
+		if next+1 < len(s) && s[next] == '-' && !strings.HasPrefix(s[next+1:], `\p{`) {
+			hi, next = char(next + 1)
+		}
+		ranges = append(ranges, [2]rune{lo, hi})
+		i = next
+	}
+
+	if ascii {
+		return Cls(resolveEscapeSequence(s))
+	}
+	return newUnicodeClass("["+s+"]", ranges, tables)
+}
+
+// unicodeTable returns the table of the Unicode general category or script
+// name, or nil if there is no such table.
+func unicodeTable(name string) *unicode.RangeTable {
+	if t, ok := unicode.Categories[name]; ok {
+		return t
+	}
+	return unicode.Scripts[name]
+}
+
+// expressionLevels returns the rule of '%expr' and the levels of '%binop',
+// '%prefix', '%postfix' and '%ternary' in the order of the options. The
+// levels of prefix, postfix and ternary operators begin with P, S and T.
+func expressionLevels(options []grammarOption) (name string, levels []string) {
+	for _, opt := range options {
+		switch opt.name {
+		case OptExpressionRule:
+			name = strings.TrimSpace(opt.value)
+		case OptBinaryOperator:
+			levels = append(levels, opt.value)
+		case OptPrefixOperator:
+			levels = append(levels, "P "+opt.value)
+		case OptPostfixOperator:
+			levels = append(levels, "S "+opt.value)
+		case OptTernaryOperator:
+			levels = append(levels, "T "+opt.value)
+		}
+	}
+	return
+}
+
+// getExpressionParsingOptions returns the tables of the operators for the
+// rules of '%expr' and the rules with precedence instructions.
+func getExpressionParsingOptions(s string, data *data) (tables map[*Rule]*OperatorTable, err error) {
+	addError := func(ss string, pos int, msg string) {
+		if err == nil {
+			err = &Error{}
+		}
+		ln, col := lineInfo(ss, pos)
+		err.(*Error).Details = append(err.(*Error).Details, ErrorDetail{ln, col, msg})
+	}
+	form := func(name string) string {
+		return "'" + name + "' must be in the form of 'ATOM (OPERATOR ATOM)*'."
+	}
+
+	tables = make(map[*Rule]*OperatorTable)
+	for _, def := range data.definitions {
+		r := def.rule
+		if len(r.precedence) == 0 {
+			continue
+		}
+		if _, _, ok := expressionOperands(r); !ok {
+			addError(r.SS, r.Pos, form(r.Name))
+			continue
+		}
+		tables[r] = newOperatorTable(r.precedence, data.grammar, func(i int, msg string) {
+			addError(r.SS, r.Pos, msg)
+		})
+	}
+
+	var expr *Rule
+	exprPos := -1
+	var levels []string
+	var levelPos []int
+	var levelNames []string
+	for _, opt := range data.optionList {
+		ss := data.optionSource(s, opt.name)
+		switch opt.name {
+		case OptExpressionRule:
+			names := strings.Fields(opt.value)
+			if exprPos != -1 {
+				addError(ss, opt.pos, "'"+OptExpressionRule+"' is already defined.")
+			} else if len(names) != 1 {
+				addError(ss, opt.pos, "'"+OptExpressionRule+"' needs a rule name.")
+			} else if r, ok := data.grammar[names[0]]; !ok {
+				addError(ss, opt.pos, "'"+names[0]+"' is not defined.")
+			} else if len(r.precedence) > 0 {
+				addError(ss, opt.pos, "'"+names[0]+"' already has a precedence instruction.")
+			} else if _, _, ok := expressionOperands(r); !ok {
+				addError(ss, opt.pos, form(names[0]))
+			} else {
+				expr = r
+			}
+			exprPos = opt.pos
+			continue
+		case OptBinaryOperator, OptPrefixOperator, OptPostfixOperator, OptTernaryOperator:
+		default:
+			continue
+		}
+
+		flds, ok := operatorFields(opt.value)
+		if !ok {
+			addError(ss, opt.pos, "'"+opt.name+"' has an operator without the closing quote.")
+			continue
+		}
+		level := opt.value
+		if opt.name == OptBinaryOperator {
+			if len(flds) > 0 && flds[0] != "L" && flds[0] != "R" && flds[0] != "N" {
+				addError(ss, opt.pos, "'"+opt.name+"' must begin with L, R or N.")
+				continue
+			}
+			if len(flds) > 0 {
+				flds = flds[1:]
+			}
+		} else if opt.name == OptPrefixOperator {
+			level = "P " + level
+		} else if opt.name == OptPostfixOperator {
+			level = "S " + level
+		} else {
+			level = "T " + level
+		}
+		if opt.name == OptTernaryOperator && len(flds) != 2 {
+			addError(ss, opt.pos, "'"+opt.name+"' needs two operators such as '? :'.")
+			continue
+		}
+		if len(flds) == 0 {
+			addError(ss, opt.pos, "'"+opt.name+"' needs operators.")
+			continue
+		}
+		levels = append(levels, level)
+		levelPos = append(levelPos, opt.pos)
+		levelNames = append(levelNames, opt.name)
+	}
+
+	if exprPos == -1 && len(levelPos) > 0 {
+		addError(data.optionSource(s, levelNames[0]), levelPos[0], "'"+levelNames[0]+"' needs '"+OptExpressionRule+"'.")
+	}
+	if expr != nil {
+		tables[expr] = newOperatorTable(levels, data.grammar, func(i int, msg string) {
+			addError(data.optionSource(s, levelNames[i]), levelPos[i], msg)
+		})
+	}
+	return
+}
+
+func getAstOptimizerOptions(s string, data *data) (opt *AstOptimizer, err error) {
+	opt = NewAstOptimizer(nil)
+
+	addError := func(name string, pos int, msg string) {
+		if err == nil {
+			err = &Error{}
+		}
+		ln, col := lineInfo(data.optionSource(s, name), pos)
+		err.(*Error).Details = append(err.(*Error).Details, ErrorDetail{ln, col, msg})
+	}
+
+	policies := []struct {
+		name   string
+		policy AstPolicy
+	}{
+		{OptAstKeep, AstKeep},
+		{OptAstDrop, AstDrop},
+		{OptAstFlatten, AstFlatten},
+		{OptAstMerge, AstDefault},
+		{OptAstRename, AstDefault},
+	}
+	for _, p := range policies {
+		for i, val := range data.options[p.name] {
+			pos := data.optionPos[p.name][i]
+			names := strings.Fields(val)
+			rules := names
+			if p.name == OptAstRename && len(names) > 0 {
+				rules = names[:1]
+			}
+			for _, name := range rules {
+				if _, ok := data.grammar[name]; !ok {
+					addError(p.name, pos, "'"+name+"' is not defined.")
+				}
+			}
+			switch p.name {
+			case OptAstMerge:
+				opt.MergeTokens(names...)
+			case OptAstRename:
+				if len(names) != 2 {
+					addError(p.name, pos, "'"+p.name+"' needs a rule name and a new name.")
+				} else {
+					opt.Rename(names[0], names[1])
 				}
+			default:
+				opt.SetPolicy(p.policy, names...)
 			}
-			level++
 		}
 	}
 
+	for i, val := range data.options[OptAstDropPunctuation] {
+		switch strings.TrimSpace(val) {
+		case "true":
+			opt.DropPunctuation(true)
+		case "false":
+			opt.DropPunctuation(false)
+		default:
+			addError(OptAstDropPunctuation, data.optionPos[OptAstDropPunctuation][i], "'"+OptAstDropPunctuation+"' must be 'true' or 'false'.")
+		}
+	}
+	return
+}
+
+// getStartRuleOption returns the rule named by the '%start' option, or the
+// first rule if there is no option.
+func getStartRuleOption(s string, data *data) (start string, err error) {
+	start = data.start
+	for i, val := range data.options[OptStartRule] {
+		pos := data.optionPos[OptStartRule][i]
+		names := strings.Fields(val)
+		msg := ""
+		if i > 0 {
+			msg = "'" + OptStartRule + "' is already defined."
+		} else if len(names) != 1 {
+			msg = "'" + OptStartRule + "' needs a rule name."
+		} else if r, ok := data.grammar[names[0]]; !ok {
+			msg = "'" + names[0] + "' is not defined."
+		} else if r.Parameters != nil {
+			msg = "'" + names[0] + "' is a macro, which can't be the start rule."
+		} else {
+			start = names[0]
+			continue
+		}
+		if err == nil {
+			err = &Error{}
+		}
+		ln, col := lineInfo(data.optionSource(s, OptStartRule), pos)
+		err.(*Error).Details = append(err.(*Error).Details, ErrorDetail{ln, col, msg})
+	}
 	return
 }
 
 // Parser
 type Parser struct {
 	Grammar     map[string]*Rule
+	source      string
+	predicates  map[string]Predicate
+	predNames   []string // Names of predicates, which are sorted
 	start       string
+	optimizer   *AstOptimizer
+	options     []grammarOption
+	positions   map[operator]int
+	whitespace  operator
+	word        operator
 	TracerEnter func(name string, s string, v *Values, d Any, p int)
 	TracerLeave func(name string, s string, v *Values, d Any, p int, l int)
 }
@@ -480,6 +1005,13 @@ func NewParserWithUserRules(s string, rules map[string]operator) (p *Parser, err
 		return nil, err
 	}
 
+	if len(data.imports) > 0 {
+		imp := data.imports[0]
+		ln, col := lineInfo(s, imp.pos)
+		msg := "'" + imp.path + "' can't be imported without a file system."
+		return nil, &Error{Details: []ErrorDetail{{ln, col, msg}}}
+	}
+
 	// User provided rules
 	for name, ope := range rules {
 		ignore := false
@@ -498,6 +1030,12 @@ func NewParserWithUserRules(s string, rules map[string]operator) (p *Parser, err
 		}
 	}
 
+	return newParserFromData(s, data)
+}
+
+// newParserFromData checks and links the grammar in data, which is made from
+// the grammar source s.
+func newParserFromData(s string, data *data) (p *Parser, err error) {
 	// Check duplicated definitions
 	if len(data.duplicates) > 0 {
 		err = &Error{}
@@ -509,6 +1047,7 @@ func NewParserWithUserRules(s string, rules map[string]operator) (p *Parser, err
 	}
 
 	// Check missing definitions
+	missing := false
 	for _, r := range data.grammar {
 		v := &referenceChecker{
 			grammar:  data.grammar,
@@ -521,21 +1060,25 @@ func NewParserWithUserRules(s string, rules map[string]operator) (p *Parser, err
 			if err == nil {
 				err = &Error{}
 			}
-			ln, col := lineInfo(s, pos)
+			ln, col := lineInfo(r.SS, pos)
 			msg := v.errorMsg[name]
 			err.(*Error).Details = append(err.(*Error).Details, ErrorDetail{ln, col, msg})
+			missing = true
 		}
 	}
 
-	if err != nil {
+	// The rest needs the references linked
+	if missing {
 		return nil, err
 	}
 
 	// Link references
+	predicates := make(map[string]Predicate)
 	for _, r := range data.grammar {
 		v := &linkReferences{
 			parameters: r.Parameters,
 			grammar:    data.grammar,
+			predicates: predicates,
 		}
 		r.accept(v)
 	}
@@ -554,47 +1097,173 @@ func NewParserWithUserRules(s string, rules map[string]operator) (p *Parser, err
 			if err == nil {
 				err = &Error{}
 			}
-			ln, col := lineInfo(s, v.pos)
+			ln, col := lineInfo(v.ss, v.pos)
 			msg := "'" + name + "' is left recursive."
 			err.(*Error).Details = append(err.(*Error).Details, ErrorDetail{ln, col, msg})
 		}
 	}
 
+	// Check repetitions of operators which never consume input
+	empty := emptyRules(data.grammar)
+	for name, r := range data.grammar {
+		v := &detectInfiniteLoop{empty: empty}
+		r.accept(v)
+		if v.loop != nil {
+			if err == nil {
+				err = &Error{}
+			}
+			pos, ok := data.positions[v.loop]
+			if !ok {
+				pos = r.Pos
+			}
+			ln, col := lineInfo(r.SS, pos)
+			msg := "infinite loop is detected in '" + name + "'."
+			err.(*Error).Details = append(err.(*Error).Details, ErrorDetail{ln, col, msg})
+		}
+	}
+
+	// AST optimizer options
+	optimizer, optErr := getAstOptimizerOptions(s, data)
+	if optErr != nil {
+		if err == nil {
+			err = &Error{}
+		}
+		err.(*Error).Details = append(err.(*Error).Details, optErr.(*Error).Details...)
+	}
+
+	// Expression parsing options
+	tables, exprErr := getExpressionParsingOptions(s, data)
+	if exprErr != nil {
+		if err == nil {
+			err = &Error{}
+		}
+		err.(*Error).Details = append(err.(*Error).Details, exprErr.(*Error).Details...)
+	}
+
+	// Start rule
+	start, startErr := getStartRuleOption(s, data)
+	if startErr != nil {
+		if err == nil {
+			err = &Error{}
+		}
+		err.(*Error).Details = append(err.(*Error).Details, startErr.(*Error).Details...)
+	}
+
 	if err != nil {
 		return nil, err
 	}
 
+	var predNames []string
+	for name := range predicates {
+		predNames = append(predNames, name)
+	}
+	sort.Strings(predNames)
+
+	p = &Parser{
+		Grammar:    data.grammar,
+		source:     s,
+		predicates: predicates,
+		predNames:  predNames,
+		start:      start,
+		optimizer:  optimizer,
+		options:    data.optionList,
+		positions:  data.positions,
+	}
+
 	// Automatic whitespace skipping
 	if r, ok := data.grammar[WhitespceRuleName]; ok {
-		data.grammar[data.start].WhitespaceOpe = Wsp(r)
+		p.whitespace = Wsp(r)
 	}
 
 	// Word expression
 	if r, ok := data.grammar[WordRuleName]; ok {
-		data.grammar[data.start].WordOpe = r
+		p.word = r
 	}
 
-	p = &Parser{
-		Grammar: data.grammar,
-		start:   data.start,
-	}
+	// The start rule can also be parsed with Rule.Parse
+	data.grammar[start].WhitespaceOpe = p.whitespace
+	data.grammar[start].WordOpe = p.word
 
 	// Setup expression parsing
-	name, info := getExpressionParsingOptions(data.options)
-	err = EnableExpressionParsing(p, name, info)
+	for r, t := range tables {
+		enableExpressionParsing(r, t)
+	}
 
 	return
 }
 
+// AstOptimizer returns an optimizer set up with the '%ast_*' options of the
+// grammar.
+func (p *Parser) AstOptimizer() *AstOptimizer {
+	if p.optimizer == nil {
+		return NewAstOptimizer(nil)
+	}
+	return p.optimizer.clone()
+}
+
 func (p *Parser) Parse(s string, d Any) (err error) {
 	_, err = p.ParseAndGetValue(s, d)
 	return
 }
 
 func (p *Parser) ParseAndGetValue(s string, d Any) (val Any, err error) {
-	r := p.Grammar[p.start]
-	r.TracerEnter = p.TracerEnter
-	r.TracerLeave = p.TracerLeave
-	_, val, err = r.Parse(s, d)
-	return
+	return p.ParseRule(p.start, s, d)
+}
+
+// ParseRule parses s from the rule name instead of the start rule, and
+// returns the semantic value. Whitespace and words are handled as with the
+// start rule.
+func (p *Parser) ParseRule(name string, s string, d Any) (val Any, err error) {
+	r, c, err := p.entry(name, false)
+	if err != nil {
+		return nil, err
+	}
+	l, v, err := r.parseWith(s, d, c)
+	return rootValue(l, v), err
+}
+
+// Predicate tells if parsing goes on at the position p for a semantic
+// predicate such as '&{isType}' in the grammar. v has the values of the rule
+// so far.
+type Predicate func(v *Values, p int, d Any) bool
+
+// SetPredicate sets the function for the semantic predicate name. All the
+// predicates in the grammar need to be set before parsing.
+func (p *Parser) SetPredicate(name string, fn Predicate) error {
+	if _, ok := p.predicates[name]; !ok {
+		return fmt.Errorf("peg: predicate '%s' is not used", name)
+	}
+	p.predicates[name] = fn
+	return nil
+}
+
+// Predicates returns the names of the semantic predicates in the grammar.
+func (p *Parser) Predicates() []string {
+	return append([]string(nil), p.predNames...)
+}
+
+// entry returns the rule name to start parsing from, and the context with the
+// settings of the parser such as the whitespace. The settings aren't put in
+// the rule, so parses from other rules or at the same time aren't affected.
+func (p *Parser) entry(name string, cst bool) (*Rule, *context, error) {
+	r, ok := p.Grammar[name]
+	if !ok {
+		return nil, nil, fmt.Errorf("peg: '%s' is not defined", name)
+	}
+	if r.Parameters != nil {
+		return nil, nil, fmt.Errorf("peg: '%s' is a macro", name)
+	}
+	for _, pred := range p.predNames {
+		if p.predicates[pred] == nil {
+			return nil, nil, fmt.Errorf("peg: predicate '%s' is not set", pred)
+		}
+	}
+	c := &context{
+		cst:           cst,
+		whitespaceOpe: p.whitespace,
+		wordOpe:       p.word,
+		tracerEnter:   p.TracerEnter,
+		tracerLeave:   p.TracerLeave,
+	}
+	return r, c, nil
 }
@@ -24,6 +24,19 @@ func TestEmptySyntax(t *testing.T) {
 	}
 }
 
+func TestDotBetweenIdentifiers(t *testing.T) {
+	parser, err := NewParser(`
+		A <- B.C
+		B <- 'b'
+		C <- 'c'
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, parser.Parse("bxc", nil) == nil)
+	assert(t, parser.Parse("bc", nil) != nil)
+}
+
 func assert(t *testing.T, ok bool) {
 	if ok == false {
 		t.Error("error...")
@@ -784,6 +797,56 @@ func TestLeftRecursiveWithEmptyString(t *testing.T) {
 	assert(t, err != nil)
 }
 
+func TestInfiniteLoop(t *testing.T) {
+	_, err := NewParser(`
+		A <- 'a' ('')*
+		B <- A (C / &'c' C)+
+		C <- &'c' / !'d'
+		D <- (E / 'd')* LIST('')
+		E <- 'e'*
+		LIST(X) <- X (',' X)*
+		F <- (G '')*
+		G <- &'g' / ''
+	`)
+
+	assert(t, err != nil)
+	details := err.(*Error).Details
+	msgs := make(map[string]ErrorDetail)
+	for _, d := range details {
+		msgs[d.Msg] = d
+	}
+	assert(t, len(details) == 3)
+	assert(t, msgs["infinite loop is detected in 'A'."] == ErrorDetail{2, 12, "infinite loop is detected in 'A'."})
+	assert(t, msgs["infinite loop is detected in 'B'."] == ErrorDetail{3, 10, "infinite loop is detected in 'B'."})
+	assert(t, msgs["infinite loop is detected in 'F'."] == ErrorDetail{8, 8, "infinite loop is detected in 'F'."})
+
+	// Repetitions which can match an empty string but can consume input are
+	// warned by Lint
+	parser, err := NewParser(`
+		A <- 'a' (B?)* LIST(C)
+		B <- 'b'
+		C <- 'c'*
+		LIST(X) <- X (',' X)*
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, parser.Parse("abb,cc", nil) == nil)
+	assert(t, len(parser.Lint()) == 1)
+}
+
+func TestInfiniteLoopWithUserRule(t *testing.T) {
+	rules := map[string]operator{
+		"EMPTY": Usr(func(s string, p int, sv *Values, d Any) int {
+			return 0
+		}),
+	}
+
+	parser, err := NewParserWithUserRules(" ROOT <- 'a' EMPTY* 'b' ", rules)
+	assert(t, err == nil)
+	assert(t, parser.Parse("ab", nil) == nil)
+}
+
 func TestUserRule(t *testing.T) {
 	syntax := " ROOT <- _ 'Hello' _ NAME '!' _ "
 
@@ -824,6 +887,98 @@ func TestSemanticPredicate(t *testing.T) {
 	assert(t, err != nil)
 }
 
+func TestRepetitionSyntax(t *testing.T) {
+	parser, err := NewParser(`
+		DATE  <- YEAR '-' MONTH '-' DAY
+		YEAR  <- < [0-9]{4} >
+		MONTH <- < [0-9]{ 1 , 2 } >
+		DAY   <- < [0-9]{2} > 'th'{,1} '!'{1,}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, parser.Parse("2024-1-15!", nil) == nil)
+	assert(t, parser.Parse("2024-12-15th!!", nil) == nil)
+	assert(t, parser.Parse("2024-123-15!", nil) != nil)
+	assert(t, parser.Parse("20245-12-15!", nil) != nil)
+	assert(t, parser.Parse("2024-12-15", nil) != nil)
+
+	s := NewGrammarPrinter().Print(parser)
+	assert(t, strings.Contains(s, "MONTH <- < [0-9]{1,2} >\n"))
+	assert(t, strings.Contains(s, "DAY   <- < [0-9]{2} > 'th'{,1} '!'{1,}\n"))
+
+	_, err = NewParser("A <- 'a'{3,2}")
+	assert(t, err != nil && err.Error() == "1:9 '{3,2}' has the maximum less than the minimum.")
+
+	_, err = NewParser("A <- 'a'?{2}")
+	assert(t, err != nil && err.Error() == "1:10 syntax error")
+
+	// Bounded repetitions of empty strings end
+	_, err = NewParser("A <- ('a'?){2} (&'b'){1,}")
+	assert(t, err != nil && err.Error() == "1:16 infinite loop is detected in 'A'.")
+	parser, err = NewParser("A <- ('a'?){2} ('b'?){1,}")
+	assert(t, err == nil && len(parser.Lint()) == 1)
+}
+
+func TestSemanticPredicateSyntax(t *testing.T) {
+	parser, err := NewParser(`
+		PROGRAM     <- STATEMENT*
+		STATEMENT   <- TYPEDEF / DECL / EXPR
+		TYPEDEF     <- 'typedef' NAME NAME ';'
+		DECL        <- TYPE '*' NAME ';'
+		EXPR        <- NAME '*' NAME ';'
+		TYPE        <- NAME &{isType}
+		NAME        <- !{isKeyword} < [a-z]+ >
+		%whitespace <- [ \t\n]*
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = parser.Parse("a * b;", nil)
+	assert(t, err != nil && err.Error() == "peg: predicate 'isKeyword' is not set")
+	assert(t, parser.SetPredicate("isNumber", nil) != nil)
+	assert(t, strings.Join(parser.Predicates(), " ") == "isKeyword isType")
+
+	types := make(map[string]bool)
+	parser.SetPredicate("isType", func(v *Values, p int, d Any) bool {
+		return types[v.ToStr(0)]
+	})
+	parser.SetPredicate("isKeyword", func(v *Values, p int, d Any) bool {
+		return strings.HasPrefix(v.SS[p:], "typedef")
+	})
+
+	g := parser.Grammar
+	g["NAME"].Action = func(v *Values, d Any) (Any, error) { return v.Token(), nil }
+	g["TYPEDEF"].Action = func(v *Values, d Any) (Any, error) {
+		types[v.ToStr(1)] = true
+		return "typedef", nil
+	}
+	g["DECL"].Action = func(v *Values, d Any) (Any, error) { return "decl", nil }
+	g["EXPR"].Action = func(v *Values, d Any) (Any, error) { return "expr", nil }
+	g["PROGRAM"].Action = func(v *Values, d Any) (Any, error) {
+		var kinds []string
+		for i := range v.Vs {
+			kinds = append(kinds, v.ToStr(i))
+		}
+		return strings.Join(kinds, " "), nil
+	}
+
+	val, err := parser.ParseAndGetValue("a * b; typedef int a; a * b;", nil)
+	assert(t, err == nil && val == "expr typedef decl")
+	assert(t, parser.Parse("typedef * b;", nil) != nil)
+
+	s := NewGrammarPrinter().Print(parser)
+	assert(t, strings.Contains(s, "TYPE        <- NAME &{isType}\n"))
+	assert(t, strings.Contains(s, "NAME        <- !{isKeyword} < [a-z]+ >\n"))
+
+	// A predicate doesn't consume input
+	_, err = NewParser("A <- &{p} A 'a' / 'b'")
+	assert(t, err != nil && err.Error() == "1:11 'A' is left recursive.")
+	_, err = NewParser("B <- (!{p})*")
+	assert(t, err != nil && err.Error() == "1:6 infinite loop is detected in 'B'.")
+}
+
 func TestJapaneseCharacter(t *testing.T) {
 	parser, _ := NewParser(`
         文 <- 修飾語? 主語 述語 '。'
@@ -839,6 +994,80 @@ func TestJapaneseCharacter(t *testing.T) {
 	assert(t, parser.Parse("サーバーを復旧します。", nil) == nil)
 }
 
+func TestUnicodeEscape(t *testing.T) {
+	parser, err := NewParser(`
+		ROOT <- '\u3042\u{1F600}' [\u{3041}-\u3093]+ '\x41'
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, parser.Parse("あ😀ぁんA", nil) == nil)
+	assert(t, parser.Parse("あ😀アA", nil) != nil)
+
+	_, err = NewParser(`A <- 'a\u{110000}'`)
+	assert(t, err != nil && err.Error() == "1:8 '\\u{110000}' is not a valid code point.")
+	_, err = NewParser(`A <- [\ud800]`)
+	assert(t, err != nil && err.Error() == "1:7 '\\ud800' is not a valid code point.")
+	_, err = NewParser(`A <- '\u12'`)
+	assert(t, err != nil)
+
+	// Hex and octal escapes end at the digits the grammar allows
+	parser, err = NewParser(`A <- '\x414' '\1018' [\x41-\x435]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, parser.Parse("A4A8C", nil) == nil)
+	assert(t, parser.Parse("A4A85", nil) == nil)
+	assert(t, parser.Parse("\x14A8C", nil) != nil)
+
+	// Three octal digits need the first to be 0 to 3
+	parser, err = NewParser(`A <- '\477'`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, parser.Parse("'7", nil) == nil)
+	assert(t, parser.Parse("?", nil) != nil)
+}
+
+func TestUnicodeClass(t *testing.T) {
+	parser, err := NewParser(`
+		IDENT <- [\p{L}_] [\p{L}\p{Nd}_]*
+		HAN   <- \p{Han}+
+		KANA  <- [ぁ-んー]+
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"abc", "_x1", "変数", "Ωmega٣"} {
+		_, err := parser.ParseRule("IDENT", s, nil)
+		assert(t, err == nil)
+	}
+	for _, s := range []string{"1abc", "a-b", "a\xff"} {
+		_, err := parser.ParseRule("IDENT", s, nil)
+		assert(t, err != nil)
+	}
+	_, err = parser.ParseRule("HAN", "漢字", nil)
+	assert(t, err == nil)
+	_, err = parser.ParseRule("HAN", "かな", nil)
+	assert(t, err != nil)
+	_, err = parser.ParseRule("KANA", "かなー", nil)
+	assert(t, err == nil)
+	_, err = parser.ParseRule("KANA", "\xe3\x81", nil)
+	assert(t, err != nil)
+
+	s := NewGrammarPrinter().Print(parser)
+	assert(t, strings.Contains(s, "IDENT <- [\\p{L}_] [\\p{L}\\p{Nd}_]*\n"))
+	assert(t, strings.Contains(s, "HAN   <- \\p{Han}+\n"))
+
+	_, err = NewParser(`A <- [a\p{Klingon}]`)
+	assert(t, err != nil && err.Error() == "1:8 '\\p{Klingon}' is not a Unicode category or script.")
+
+	// Classes of bytes are kept
+	parser, err = NewParser(`A <- [\xe3] [\x81-\x82]`)
+	assert(t, err == nil && parser.Parse("あ", nil) != nil && parser.Parse("\xe3\x81", nil) == nil)
+	assert(t, NewGrammarPrinter().Print(parser) == "A <- [\\xe3] [\\x81-\\x82]\n")
+}
+
 func TestLineInformation(t *testing.T) {
 	parser, err := NewParser(`
 		S    <- _ (WORD _)+
@@ -1060,6 +1289,11 @@ func TestPegDefinition(t *testing.T) {
 	match(t, &rDefinition, "Definition = a / (b c) / d ", false)
 	match(t, &rDefinition, "Macro(param) <- a ", true)
 	match(t, &rDefinition, "Macro (param) <- a ", false)
+	match(t, &rDefinition, "Definition <- a { error_message 'msg' } ", true)
+	match(t, &rDefinition, "Definition <- a { error_message } ", false)
+	match(t, &rDefinition, "Definition <- a { precedence L + - R '^' } ", true)
+	match(t, &rDefinition, "Definition <- a { error_message 'msg'; precedence L + } ", true)
+	match(t, &rDefinition, "Definition <- a { precedence } ", false)
 }
 
 func TestPegExpression(t *testing.T) {
@@ -1257,3 +1491,498 @@ func TestPegEndOfFile(t *testing.T) {
 	match(t, &rEndOfFile, "", true)
 	match(t, &rEndOfFile, " ", false)
 }
+
+func TestErrorMessageInstruction(t *testing.T) {
+	parser, err := NewParser(`
+		PROG   <- BLOCK+
+		BLOCK  <- '{' STMT* '}' { error_message "%r: expected '}' but found '%t'" }
+		STMT   <- < [a-z]+ > ';'
+		%whitespace <- [ \t\r\n]*
+	`)
+	assert(t, err == nil)
+
+	assert(t, parser.Parse("{ a; b; }", nil) == nil)
+
+	err = parser.Parse("{ a; b; c }", nil)
+	assert(t, err != nil)
+	d := err.(*Error).Details[0]
+	if d.Ln != 1 || d.Col != 9 || d.Msg != "BLOCK: expected '}' but found 'c'" {
+		t.Errorf("unexpected error: %v", d)
+	}
+
+	err = parser.Parse("{ a;\n  b;", nil)
+	assert(t, err != nil)
+	d = err.(*Error).Details[0]
+	if d.Ln != 2 || d.Col != 5 || d.Msg != "BLOCK: expected '}' but found 'end of input'" {
+		t.Errorf("unexpected error: %v", d)
+	}
+}
+
+func TestPrecedenceInstruction(t *testing.T) {
+	parser, err := NewParser(`
+		EXPR   <- ATOM (BINOP ATOM)* {
+		  precedence
+		    L + -
+		    L * /
+		    R '^'
+		}
+		ATOM   <- < [0-9]+ > / '(' EXPR ')'
+		BINOP  <- < [-+*/^] >
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parser.Grammar["EXPR"].Action = func(v *Values, d Any) (Any, error) {
+		if len(v.Vs) == 1 {
+			return v.Vs[0], nil
+		}
+		return "(" + v.ToStr(0) + v.ToStr(1) + v.ToStr(2) + ")", nil
+	}
+	parser.Grammar["ATOM"].Action = func(v *Values, d Any) (Any, error) {
+		if v.Choice == 0 {
+			return v.Token(), nil
+		}
+		return v.Vs[0], nil
+	}
+	parser.Grammar["BINOP"].Action = func(v *Values, d Any) (Any, error) {
+		return v.Token(), nil
+	}
+
+	val, err := parser.ParseAndGetValue("1+2*3^2^3-4", nil)
+	assert(t, err == nil && val == "((1+(2*(3^(2^3))))-4)")
+}
+
+func TestExpressionOperators(t *testing.T) {
+	parser, err := NewParser(`
+		EXPR    <- ATOM (OPE ATOM)*
+		ATOM    <- NUMBER / NAME / '(' EXPR ')'
+		OPE     <- 'is' 'not' / 'is' / 'and' / 'or' / 'not' / < [-+*!<=]+ >
+		NAME    <- !KEYWORD < [a-z]+ >
+		KEYWORD <- ('and' / 'or' / 'not' / 'is') ![a-z]
+		NUMBER  <- < [0-9]+ >
+		%whitespace <- [ \t]*
+		%word       <- [a-z]+
+		---
+		%expr    = EXPR
+		%binop   = L or
+		%binop   = L and
+		%prefix  = not
+		%binop   = N == < 'is not' is
+		%binop   = L + -
+		%binop   = L *
+		%prefix  = -
+		%postfix = !
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Prefix and postfix operators come with one operand
+	parser.Grammar["EXPR"].Action = func(v *Values, d Any) (Any, error) {
+		var flds []string
+		for i := range v.Vs {
+			flds = append(flds, v.ToStr(i))
+		}
+		if len(flds) == 1 {
+			return flds[0], nil
+		}
+		return "(" + strings.Join(flds, " ") + ")", nil
+	}
+	parser.Grammar["ATOM"].Action = func(v *Values, d Any) (Any, error) {
+		if v.Choice == 2 {
+			return v.Vs[0], nil
+		}
+		return strings.TrimSpace(v.S), nil
+	}
+	parser.Grammar["OPE"].Action = func(v *Values, d Any) (Any, error) {
+		return strings.Join(strings.Fields(v.S), " "), nil
+	}
+
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"1 + 2 * 3", "(1 + (2 * 3))"},
+		{"-2 * 3", "((- 2) * 3)"},
+		{"- 3 !", "(- (3 !))"},
+		{"2 * 3 ! !", "(2 * ((3 !) !))"},
+		{"1 - -2", "(1 - (- 2))"},
+		{"not a and b", "((not a) and b)"},
+		{"not a == b", "(not (a == b))"},
+		{"a is  not b or c", "((a is not b) or c)"},
+		{"a is nothing", "(a is nothing)"},
+		{"andy and b", "(andy and b)"},
+		{"a == b + 1 and 2 < c", "((a == (b + 1)) and (2 < c))"},
+	}
+	for _, test := range tests {
+		val, err := parser.ParseAndGetValue(test.in, nil)
+		if err != nil || val != test.want {
+			t.Errorf("%q: want %q, got %v (%v)", test.in, test.want, val, err)
+		}
+	}
+
+	// Non-associative operators
+	assert(t, parser.Parse("a == b == c", nil) != nil)
+	assert(t, parser.Parse("a < b is c", nil) != nil)
+	assert(t, parser.Parse("(a == b) == c", nil) == nil)
+}
+
+func TestExpressionForms(t *testing.T) {
+	parser, err := NewParser(`
+		EXPR    <- ATOM (OPE ATOM)*
+		ATOM    <- NAME / NUMBER / '(' EXPR ')'
+		OPE     <- < '?' / ':' / '=' / '||' / [-+*!] >
+		CALL    <- '(' (EXPR (',' EXPR)*)? ')'
+		INDEX   <- '[' EXPR ']'
+		NAME    <- < [a-z]+ >
+		NUMBER  <- < [0-9]+ >
+		%whitespace <- [ \t]*
+		---
+		%expr    = EXPR
+		%binop   = R =
+		%ternary = ? :
+		%binop   = L ||
+		%binop   = L + -
+		%binop   = L *
+		%prefix  = - !
+		%postfix = CALL INDEX
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, len(parser.Lint()) == 0)
+
+	g := parser.Grammar
+	g["EXPR"].Action = func(v *Values, d Any) (Any, error) {
+		if len(v.Vs) == 1 {
+			return v.Vs[0], nil
+		}
+		switch v.Form {
+		case ExprPrefix:
+			return "(" + v.ToStr(0) + " " + v.ToStr(1) + ")", nil
+		case ExprPostfix:
+			return v.ToStr(0) + v.ToStr(1), nil
+		case ExprTernary:
+			return "(" + v.ToStr(0) + " ? " + v.ToStr(2) + " : " + v.ToStr(4) + ")", nil
+		}
+		return "(" + v.ToStr(0) + " " + v.ToStr(1) + " " + v.ToStr(2) + ")", nil
+	}
+	g["ATOM"].Action = func(v *Values, d Any) (Any, error) {
+		if v.Choice == 2 {
+			return v.Vs[0], nil
+		}
+		return strings.TrimSpace(v.S), nil
+	}
+	g["OPE"].Action = func(v *Values, d Any) (Any, error) {
+		return v.Token(), nil
+	}
+	g["CALL"].Action = func(v *Values, d Any) (Any, error) {
+		var args []string
+		for i := range v.Vs {
+			args = append(args, v.ToStr(i))
+		}
+		return "(" + strings.Join(args, ",") + ")", nil
+	}
+	g["INDEX"].Action = func(v *Values, d Any) (Any, error) {
+		return "[" + v.ToStr(0) + "]", nil
+	}
+
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"a ? b : c ? d : e", "(a ? b : (c ? d : e))"},
+		{"x = a || b ? c = 1 : d", "(x = ((a || b) ? (c = 1) : d))"},
+		{"a ? b ? c : d : e + 1", "(a ? (b ? c : d) : (e + 1))"},
+		{"f(a, b + 1)[2] * -g()", "(f(a,(b + 1))[2] * (- g()))"},
+		{"-f(1)", "(- f(1))"},
+		{"!(a)[0]", "(! a[0])"},
+	}
+	for _, test := range tests {
+		val, err := parser.ParseAndGetValue(test.in, nil)
+		if err != nil || val != test.want {
+			t.Errorf("%q: want %q, got %v (%v)", test.in, test.want, val, err)
+		}
+	}
+	assert(t, parser.Parse("a ? b", nil) != nil)
+	assert(t, parser.Parse("a ? b :", nil) != nil)
+	assert(t, parser.Parse("f(a", nil) != nil)
+}
+
+func TestExpressionParsingOptionErrors(t *testing.T) {
+	grammar := `
+		EXPR <- ATOM (OPE ATOM)*
+		LIST <- ATOM (',' ATOM)*
+		ATOM <- < [0-9]+ >
+		OPE  <- < [-+!] >
+		---
+`
+	tests := []struct {
+		options string
+		want    []string
+	}{
+		{"%expr = NONE\n%expr = EXPR\n", []string{
+			"7:1 'NONE' is not defined.",
+			"8:1 '%expr' is already defined.",
+		}},
+		{"%expr = LIST\n", []string{"7:1 'LIST' must be in the form of 'ATOM (OPERATOR ATOM)*'."}},
+		{"%expr = EXPR LIST\n", []string{"7:1 '%expr' needs a rule name."}},
+		{"%binop = L + -\n", []string{"7:1 '%binop' needs '%expr'."}},
+		{"%expr = EXPR\n%binop = X + -\n%binop = L\n%prefix = '-\n", []string{
+			"8:1 '%binop' must begin with L, R or N.",
+			"9:1 '%binop' needs operators.",
+			"10:1 '%prefix' has an operator without the closing quote.",
+		}},
+		{"%expr = EXPR\n%binop = L + -\n%binop = R +\n%prefix = - -\n%postfix = ! -\n%binop = L ! ''\n", []string{
+			"9:1 '+' is already a binary operator.",
+			"10:1 '-' is already a prefix operator.",
+			"11:1 '-' is already a binary operator.",
+			"12:1 '!' is already a postfix operator.",
+			"12:1 '' can't be an operator.",
+		}},
+		{"%expr = EXPR\n%ternary = ?\n%binop = L :\n%ternary = + :\n%postfix = ATOM ATOM\n", []string{
+			"8:1 '%ternary' needs two operators such as '? :'.",
+			"10:1 ':' is already a binary operator.",
+			"11:1 'ATOM' is already an operator.",
+		}},
+	}
+	for _, test := range tests {
+		_, err := NewParser(grammar + test.options)
+		perr, ok := err.(*Error)
+		if !ok {
+			t.Errorf("%q: want errors, got %v", test.options, err)
+			continue
+		}
+		var got []string
+		for _, d := range perr.Details {
+			got = append(got, d.String())
+		}
+		if strings.Join(got, "\n") != strings.Join(test.want, "\n") {
+			t.Errorf("%q: want %q, got %q", test.options, test.want, got)
+		}
+	}
+
+	// Precedence instructions
+	_, err := NewParser("LIST <- A (',' A)* { precedence L , }\nA <- 'a'\n")
+	assert(t, err != nil && err.Error() == "1:1 'LIST' must be in the form of 'ATOM (OPERATOR ATOM)*'.")
+	_, err = NewParser("E <- A (O A)* { precedence L + R + }\nA <- 'a'\nO <- '+'\n")
+	assert(t, err != nil && err.Error() == "1:1 '+' is already a binary operator.")
+	_, err = NewParser("E <- A (O A)* { precedence L + }\nA <- 'a'\nO <- '+'\n---\n%expr = E\n")
+	assert(t, err != nil && err.Error() == "5:1 'E' already has a precedence instruction.")
+
+	// EnableExpressionParsing doesn't panic
+	parser, _ := NewParser("LIST <- A (',' A)*\nA <- 'a'\n")
+	err = EnableExpressionParsing(parser, "LIST", nil)
+	assert(t, err != nil && err.Error() == "1:1 'LIST' must be in the form of 'ATOM (OPERATOR ATOM)*'.")
+	err = EnableExpressionParsing(parser, "NONE", nil)
+	assert(t, err != nil && err.Error() == "peg: 'NONE' is not defined")
+}
+
+func TestTypedSemanticValues(t *testing.T) {
+	parser, _ := NewParser(`
+		ROOT    <- NUMBER (',' NUMBER)*
+		NUMBER  <- < [0-9]+ >
+	`)
+
+	g := parser.Grammar
+	g["ROOT"].Action = TypedAction(func(v *Values, d Any) (sum int, err error) {
+		for i := 0; i < v.Len(); i++ {
+			n, err := Get[int](v, i)
+			if err != nil {
+				return 0, err
+			}
+			sum += n
+		}
+		return
+	})
+	g["NUMBER"].Action = func(v *Values, d Any) (Any, error) {
+		return strconv.Atoi(v.Token())
+	}
+
+	val, err := parser.ParseAndGetValue("1,2,3", nil)
+	assert(t, err == nil)
+	assert(t, val == 6)
+
+	g["NUMBER"].Action = func(v *Values, d Any) (Any, error) {
+		return v.Token(), nil
+	}
+
+	_, err = parser.ParseAndGetValue("1,2,3", nil)
+	assert(t, err != nil)
+	assert(t, err.Error() == "1:1 'ROOT': semantic value 0 is string, not int.")
+
+	_, err = Get[string](&Values{}, 0)
+	assert(t, err != nil)
+}
+
+func TestTypeMismatchInAction(t *testing.T) {
+	parser, _ := NewParser(`
+		ROOT    <- 'x' NUMBER
+		NUMBER  <- < [0-9]+ >
+	`)
+
+	g := parser.Grammar
+	g["ROOT"].Action = TypedAction(func(v *Values, d Any) (int, error) {
+		return v.ToInt(0), nil
+	})
+	g["NUMBER"].Action = func(v *Values, d Any) (Any, error) {
+		return v.Token(), nil
+	}
+
+	_, err := parser.ParseAndGetValue("x1", nil)
+	assert(t, err != nil)
+	assert(t, strings.HasPrefix(err.Error(), "1:1 'ROOT': interface conversion"))
+}
+
+func TestAstOptimizerPolicies(t *testing.T) {
+	parser, err := NewParser(`
+		PROGRAM     <- (COMMENT / DECL)*
+		DECL        <- 'var' NAME ARGS? SEMI
+		ARGS        <- LPAREN NAME (COMMA NAME)* RPAREN
+		NAME        <- PART+
+		PART        <- < [a-z] >
+		COMMENT     <- < '#' [a-z ]* >
+		LPAREN      <- '('
+		RPAREN      <- ')'
+		SEMI        <- ';'
+		COMMA       <- ','
+		%whitespace <- [ \t\r\n]*
+		---
+		%ast_keep             = DECL NAME
+		%ast_drop             = COMMENT
+		%ast_flatten          = ARGS
+		%ast_rename           = DECL VAR
+		%ast_merge            = PART
+		%ast_drop_punctuation = true
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parser.EnableAst()
+
+	ast, err := parser.ParseAndGetAst("var ab (c, de); # comment\n var f;", nil)
+	assert(t, err == nil)
+
+	ast = parser.AstOptimizer().Optimize(ast, nil)
+	want := `+ PROGRAM
+  + VAR
+    + NAME
+      - PART ("ab")
+    + NAME
+      - PART ("c")
+    + NAME
+      - PART ("de")
+  + VAR
+    + NAME
+      - PART ("f")
+`
+	if ast.String() != want {
+		t.Errorf("unexpected ast:\n%s", ast)
+	}
+	assert(t, ast.Nodes[0].Nodes[2].Parent == ast.Nodes[0])
+
+	ast, _ = parser.ParseAndGetAst("var a;", nil)
+	ast = NewAstOptimizer(nil).SetPolicy(AstDrop, "SEMI").Optimize(ast, nil)
+	assert(t, ast.Name == "PART")
+}
+
+func TestAstOptimizerOptionErrors(t *testing.T) {
+	_, err := NewParser(`
+		ROOT <- 'a'
+		---
+		%ast_keep   = ROOT NONE
+		%ast_rename = ROOT
+		%ast_drop_punctuation = yes
+	`)
+	assert(t, err != nil)
+	details := err.(*Error).Details
+	assert(t, len(details) == 3)
+	assert(t, details[0].String() == "4:3 'NONE' is not defined.")
+	assert(t, details[1].String() == "5:3 '%ast_rename' needs a rule name and a new name.")
+	assert(t, details[2].String() == "6:3 '%ast_drop_punctuation' must be 'true' or 'false'.")
+}
+
+func TestStartRuleOption(t *testing.T) {
+	parser, err := NewParser(`
+		PROGRAM     <- STATEMENT*
+		STATEMENT   <- 'print' EXPR ';'
+		EXPR        <- NUMBER ('+' NUMBER)*
+		NUMBER      <- < [0-9]+ >
+		%whitespace <- [ \t\n]*
+		%word       <- [a-z]+
+		---
+		%start = STATEMENT
+	`)
+	assert(t, err == nil)
+
+	assert(t, parser.Parse(" print 1 + 2; ", nil) == nil)
+	assert(t, parser.Parse("print 1; print 2;", nil) != nil)
+	assert(t, parser.Parse("print1;", nil) == nil)
+	assert(t, parser.Parse("printx 1;", nil) != nil)
+}
+
+func TestParseRule(t *testing.T) {
+	parser, err := NewParser(`
+		PROGRAM     <- STATEMENT*
+		STATEMENT   <- 'print' EXPR ';'
+		EXPR        <- NUMBER ('+' NUMBER)*
+		NUMBER      <- < [0-9]+ >
+		LIST(X)     <- X (',' X)*
+		%whitespace <- [ \t\n]*
+		%word       <- [a-z]+
+	`)
+	assert(t, err == nil)
+	parser.EnableAst()
+
+	val, err := parser.ParseRule("EXPR", " 1 + 2 ", nil)
+	assert(t, err == nil)
+	ast := val.(*Ast)
+	assert(t, ast.Name == "EXPR" && len(ast.Nodes) == 2)
+
+	_, err = parser.ParseRule("STATEMENT", "printx 1;", nil)
+	assert(t, err != nil)
+	_, err = parser.ParseRule("STATEMENT", "print 1; print 2;", nil)
+	assert(t, err != nil)
+
+	// The start rule is still the first one
+	val, err = parser.ParseAndGetValue("print 1; print 2;", nil)
+	assert(t, err == nil && val.(*Ast).Name == "PROGRAM")
+
+	// The rule isn't changed by the settings of the parser
+	parser.TracerEnter = func(name string, s string, v *Values, d Any, p int) {}
+	_, err = parser.ParseRule("EXPR", " 1 + 2 ", nil)
+	assert(t, err == nil)
+	r := parser.Grammar["EXPR"]
+	assert(t, r.WhitespaceOpe == nil && r.WordOpe == nil && r.TracerEnter == nil)
+	_, _, err = r.Parse(" 1 + 2 ", nil)
+	assert(t, err != nil)
+
+	_, err = parser.ParseRule("NONE", "1", nil)
+	assert(t, err != nil && err.Error() == "peg: 'NONE' is not defined")
+	_, err = parser.ParseRule("LIST", "1", nil)
+	assert(t, err != nil && err.Error() == "peg: 'LIST' is a macro")
+}
+
+func TestStartRuleOptionErrors(t *testing.T) {
+	_, err := NewParser(`
+		ROOT    <- 'a'
+		LIST(X) <- X (',' X)*
+		---
+		%start = NONE
+		%start = ROOT
+	`)
+	assert(t, err != nil)
+	details := err.(*Error).Details
+	assert(t, len(details) == 2)
+	assert(t, details[0].String() == "5:3 'NONE' is not defined.")
+	assert(t, details[1].String() == "6:3 '%start' is already defined.")
+
+	_, err = NewParser(`
+		ROOT    <- 'a'
+		LIST(X) <- X (',' X)*
+		---
+		%start = LIST
+	`)
+	assert(t, err != nil && err.Error() == "5:3 'LIST' is a macro, which can't be the start rule.")
+}
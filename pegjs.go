@@ -0,0 +1,287 @@
+package peg
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+var (
+	pegjsParser     *Parser
+	pegjsParserOnce sync.Once
+	pegjsParserLock sync.Mutex
+)
+
+func setupPEGjsParser() {
+	pegjsParser, _ = NewParser(`
+		GRAMMAR     <- CODE* RULE+
+		RULE        <- IDENT STRING? ASSIGN CHOICE ';'?
+		CHOICE      <- ACTION ('/' ACTION)*
+		ACTION      <- SEQUENCE CODE?
+		SEQUENCE    <- LABELED*
+		LABELED     <- '@'? (IDENT ':')? PREFIXED
+		PREFIXED    <- PREDICATE / PREFIX? SUFFIXED
+		PREDICATE   <- < [&!] '#'? > CODE
+		PREFIX      <- < [$&!] >
+		SUFFIXED    <- PRIMARY SUFFIX?
+		SUFFIX      <- < [?*+] >
+		PRIMARY     <- IDENT !(STRING? ASSIGN) !':' / LITERAL / CLASS / '.' / '(' CHOICE ')' / STATE
+		STATE       <- '#' CODE
+		LITERAL     <- < STR 'i'? >
+		CLASS       <- < '[' '^'? ('\\' . / !']' .)* ']' 'i'? >
+		STRING      <- < STR >
+		IDENT       <- < [a-zA-Z_$] [a-zA-Z0-9_$]* >
+		~ASSIGN     <- '=' / '<-' / '←' / '⟵'
+		~CODE       <- '{' (CODE / STR / '` + "`" + `' (!'` + "`" + `' .)* '` + "`" + `' / !'}' .)* '}'
+		~STR        <- '"' ('\\' . / !'"' .)* '"' / "'" ('\\' . / !"'" .)* "'" / '` + "`" + `' (!'` + "`" + `' .)* '` + "`" + `'
+		%whitespace <- ([ \t\r\n] / '//' (![\r\n] .)* / '/*' (!'*/' .)* '*/')*
+	`)
+
+	g := pegjsParser.Grammar
+	g["RULE"].Action = func(v *Values, d Any) (Any, error) {
+		d.(*importer).define(v.ToStr(0), v.ToOpe(len(v.Vs)-1), v.Pos, v.SS, false)
+		return nil, nil
+	}
+	g["CHOICE"].Action = ebnfChoice
+	g["ACTION"].Action = func(v *Values, d Any) (Any, error) {
+		// Actions are code for JavaScript or Go
+		return v.ToOpe(0), nil
+	}
+	g["SEQUENCE"].Action = ebnfSequence
+	g["LABELED"].Action = func(v *Values, d Any) (Any, error) {
+		// Labels and '@' are for actions
+		return v.ToOpe(len(v.Vs) - 1), nil
+	}
+	g["PREFIXED"].Action = func(v *Values, d Any) (Any, error) {
+		if v.Choice == 0 || len(v.Vs) == 1 {
+			return v.ToOpe(0), nil
+		}
+		ope := v.ToOpe(1)
+		switch v.ToStr(0) {
+		case "$":
+			return Tok(ope), nil
+		case "&":
+			return Apd(ope), nil
+		}
+		return Npd(ope), nil
+	}
+	g["PREDICATE"].Action = func(v *Values, d Any) (Any, error) {
+		d.(*importer).diag(v.Pos, "code predicate '"+v.Token()+"{...}' has no equivalent in PEG.")
+		return Lit(""), nil
+	}
+	g["PREFIX"].Action = func(v *Values, d Any) (Any, error) {
+		return v.Token(), nil
+	}
+	g["SUFFIXED"].Action = func(v *Values, d Any) (Any, error) {
+		ope := v.ToOpe(0)
+		if len(v.Vs) > 1 {
+			switch v.ToStr(1) {
+			case "?":
+				ope = Opt(ope)
+			case "*":
+				ope = Zom(ope)
+			case "+":
+				ope = Oom(ope)
+			}
+		}
+		return ope, nil
+	}
+	g["SUFFIX"].Action = func(v *Values, d Any) (Any, error) {
+		return v.Token(), nil
+	}
+	g["PRIMARY"].Action = func(v *Values, d Any) (Any, error) {
+		switch v.Choice {
+		case 0:
+			return Ref(v.ToStr(0), nil, v.Pos), nil
+		case 3:
+			return anyRune(), nil
+		}
+		return v.ToOpe(0), nil
+	}
+	g["STATE"].Action = func(v *Values, d Any) (Any, error) {
+		d.(*importer).diag(v.Pos, "state block '#{...}' has no equivalent in PEG.")
+		return Lit(""), nil
+	}
+	g["LITERAL"].Action = func(v *Values, d Any) (Any, error) {
+		tok := v.Token()
+		fold := strings.HasSuffix(tok, "i")
+		if fold {
+			tok = tok[:len(tok)-1]
+		}
+		lit, ok := jsUnquote(tok)
+		if !ok {
+			d.(*importer).diag(v.Pos, "'"+tok+"' has an invalid escape sequence.")
+		}
+		if fold {
+			return pegjsFoldLit(lit), nil
+		}
+		return Lit(lit), nil
+	}
+	g["CLASS"].Action = func(v *Values, d Any) (Any, error) {
+		return pegjsClass(v.Token(), v.Pos, d.(*importer)), nil
+	}
+	g["STRING"].Action = func(v *Values, d Any) (Any, error) {
+		return v.Token(), nil
+	}
+	g["IDENT"].Action = func(v *Values, d Any) (Any, error) {
+		return v.Token(), nil
+	}
+}
+
+// NewParserFromPEGjs makes a parser from a grammar for PEG.js (and Peggy) or
+// pigeon. The first rule is the start rule. Code such as actions, labels and
+// initializers is dropped, display names are ignored, and '$e' becomes the
+// token boundary '< e >'. Code predicates and state blocks are reported as
+// errors.
+func NewParserFromPEGjs(s string) (*Parser, error) {
+	pegjsParserOnce.Do(setupPEGjsParser)
+
+	im := newImporter(false)
+	pegjsParserLock.Lock()
+	_, err := pegjsParser.ParseAndGetValue(s, im)
+	pegjsParserLock.Unlock()
+
+	if err != nil {
+		return nil, err
+	}
+	return im.parser(s, nil)
+}
+
+// jsUnquote resolves the escape sequences of a JavaScript or Go string.
+func jsUnquote(tok string) (string, bool) {
+	if tok[0] == '`' {
+		return tok[1 : len(tok)-1], true
+	}
+
+	s := tok[1 : len(tok)-1]
+	var b []byte
+	for len(s) > 0 {
+		if s[0] != '\\' || len(s) == 1 {
+			b = append(b, s[0])
+			s = s[1:]
+			continue
+		}
+
+		ch := s[1]
+		s = s[2:]
+		switch ch {
+		case 'n':
+			b = append(b, '\n')
+		case 'r':
+			b = append(b, '\r')
+		case 't':
+			b = append(b, '\t')
+		case 'b':
+			b = append(b, '\b')
+		case 'f':
+			b = append(b, '\f')
+		case 'v':
+			b = append(b, '\v')
+		case '0':
+			b = append(b, 0)
+		case '\n': // Line continuation
+		case 'x', 'u', 'U':
+			n := map[byte]int{'x': 2, 'u': 4, 'U': 8}[ch]
+			digits := s
+			if ch == 'u' && strings.HasPrefix(s, "{") {
+				end := strings.IndexByte(s, '}')
+				if end == -1 {
+					return "", false
+				}
+				digits, s = s[1:end], s[end+1:]
+			} else if len(s) >= n {
+				digits, s = s[:n], s[n:]
+			} else {
+				return "", false
+			}
+			r, err := strconv.ParseUint(digits, 16, 32)
+			if err != nil || !utf8.ValidRune(rune(r)) {
+				return "", false
+			}
+			b = utf8.AppendRune(b, rune(r))
+		default:
+			b = append(b, ch)
+		}
+	}
+	return string(b), true
+}
+
+// pegjsClass makes an operator for a class such as '[^a-z\]]i'.
+func pegjsClass(tok string, pos int, im *importer) operator {
+	fold := strings.HasSuffix(tok, "i")
+	if fold {
+		tok = tok[:len(tok)-1]
+	}
+	s := tok[1 : len(tok)-1]
+	negated := strings.HasPrefix(s, "^")
+	if negated {
+		s = s[1:]
+	}
+
+	next := func() (rune, bool) {
+		if s[0] == '\\' && len(s) > 1 {
+			// Take an escape sequence with as many characters as it has
+			for n := 2; n <= len(s); n++ {
+				if lit, ok := jsUnquote("\"" + s[:n] + "\""); ok && len(lit) > 0 {
+					r, size := utf8.DecodeRuneInString(lit)
+					if size == len(lit) {
+						s = s[n:]
+						return r, true
+					}
+				}
+			}
+			return 0, false
+		}
+		r, n := utf8.DecodeRuneInString(s)
+		s = s[n:]
+		return r, true
+	}
+
+	var ranges [][2]rune
+	for len(s) > 0 {
+		lo, ok := next()
+		hi := lo
+		if ok && len(s) > 1 && s[0] == '-' {
+			s = s[1:]
+			hi, ok = next()
+		}
+		if !ok {
+			im.diag(pos, "'"+tok+"' has an invalid escape sequence.")
+			return Lit("")
+		}
+		if lo > hi {
+			im.diag(pos, "'"+tok+"' has the upper bound less than the lower bound.")
+			return Lit("")
+		}
+		ranges = append(ranges, [2]rune{lo, hi})
+	}
+	if fold {
+		ranges = foldRanges(ranges)
+	}
+	return runeClass(ranges, negated)
+}
+
+// pegjsFoldLit matches s ignoring the case.
+func pegjsFoldLit(s string) operator {
+	var opes []operator
+	start := 0
+	for i := 0; i < len(s); {
+		r, n := utf8.DecodeRuneInString(s[i:])
+		if ranges := foldRanges([][2]rune{{r, r}}); len(ranges) > 1 {
+			if start < i {
+				opes = append(opes, Lit(s[start:i]))
+			}
+			opes = append(opes, runeClass(ranges, false))
+			start = i + n
+		}
+		i += n
+	}
+	if start < len(s) || len(opes) == 0 {
+		opes = append(opes, Lit(s[start:]))
+	}
+	if len(opes) == 1 {
+		return opes[0]
+	}
+	return SeqCore(opes)
+}
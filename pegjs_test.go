@@ -0,0 +1,104 @@
+package peg
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPEGjs(t *testing.T) {
+	parser, err := NewParserFromPEGjs(`{
+  function sum(a, b) { return a + b; }
+}
+
+// Simple arithmetics
+Expression "expression"
+  = head:Term tail:(_ ("+" / "-") _ Term)* {
+      return tail.reduce((r, e) => e[1] === "+" ? sum(r, e[3]) : r - e[3], head);
+    }
+
+Term = head:Factor tail:(_ ("*" / "/") _ Factor)* { return "}"; }
+
+Factor
+  = "(" _ @Expression _ ")"
+  / Integer
+
+Integer "integer" = _ digits:$[0-9]+ { return parseInt(digits, 10); }
+
+_ "whitespace" = [ \t\n\r]*
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert(t, parser.Parse("2 * (3 + 4)", nil) == nil)
+	assert(t, parser.Parse("2 * (3 + 4", nil) != nil)
+
+	parser.EnableAst()
+	ast, err := parser.ParseAndGetAst("12+3", nil)
+	assert(t, err == nil)
+	assert(t, ast.Nodes[0].Nodes[0].Nodes[0].Name == "Integer")
+	assert(t, ast.Nodes[0].Nodes[0].Nodes[0].Token == "12")
+}
+
+func TestPEGjsPigeon(t *testing.T) {
+	parser, err := NewParserFromPEGjs(`
+{
+package main
+}
+
+Input <- words:Word+ EOF {
+	return words, nil
+}
+
+Word ← w:[a-zé]i+ ' '? {
+	return string(c.text), nil
+}
+
+EOF <- !.
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert(t, parser.Parse("Hello wörld", nil) != nil)
+	assert(t, parser.Parse("Hello Éte ", nil) == nil)
+}
+
+func TestPEGjsLiterals(t *testing.T) {
+	parser, err := NewParserFromPEGjs(`
+start = "select"i ' ' [^\]\n!]+ "\x21☺" '\u{1F600}' ;
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert(t, parser.Parse("SeLeCt a]!☺😀", nil) != nil)
+	assert(t, parser.Parse("SeLeCt ab!☺😀", nil) == nil)
+	assert(t, parser.Parse("select é!☺😀", nil) == nil)
+
+	parser, err = NewParserFromPEGjs(`start = "café"i`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert(t, parser.Parse("CAFÉ", nil) == nil)
+	assert(t, parser.Parse("CAFE", nil) != nil)
+}
+
+func TestPEGjsDiagnostics(t *testing.T) {
+	_, err := NewParserFromPEGjs(`
+start = &{ return true; } "a" / b
+b <- #{ c.state["n"] = 1; return nil } "b" !{ return false } "c"
+`)
+	pe, ok := err.(*Error)
+	if !ok {
+		t.Fatal(err)
+	}
+	assert(t, len(pe.Details) == 3)
+	assert(t, pe.Details[0].Ln == 2 && pe.Details[0].Msg == "code predicate '&{...}' has no equivalent in PEG.")
+	assert(t, pe.Details[1].Ln == 3 && pe.Details[1].Msg == "state block '#{...}' has no equivalent in PEG.")
+	assert(t, pe.Details[2].Ln == 3 && strings.HasPrefix(pe.Details[2].Msg, "code predicate '!{...}'"))
+
+	_, err = NewParserFromPEGjs("start = 'a\\u12'\n")
+	assert(t, err != nil && err.Error() == "1:9 ''a\\u12'' has an invalid escape sequence.")
+}
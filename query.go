@@ -0,0 +1,192 @@
+package peg
+
+import (
+	"strings"
+	"sync"
+)
+
+// Ast query
+//
+// A query selects nodes in an Ast with CSS-like syntax:
+//
+//	FUNCTION > BLOCK CALL[Token="main"]
+//
+// 'A B' selects B nodes below A at any depth, 'A > B' selects B nodes
+// directly under A, and '*' matches any node name. A step can have any
+// number of predicates on Name or Token using '=', '!=', '^=' (prefix),
+// '$=' (suffix) or '*=' (substring).
+type AstQuery struct {
+	src   string
+	steps []queryStep
+}
+
+type queryStep struct {
+	name  string
+	child bool
+	preds []queryPredicate
+}
+
+type queryPredicate struct {
+	field string
+	op    string
+	value string
+}
+
+var (
+	queryParser     *Parser
+	queryParserOnce sync.Once
+	queryParserLock sync.Mutex
+)
+
+func setupQueryParser() {
+	queryParser, _ = NewParser(`
+		SELECTOR    <- STEP (AXIS STEP)*
+		AXIS        <- < '>'? >
+		STEP        <- NAME PREDICATE*
+		NAME        <- < '*' / (![ \t\r\n>[\]"'=!^$*] .)+ >
+		PREDICATE   <- '[' FIELD OPERATOR VALUE ']'
+		FIELD       <- < 'Name' / 'Token' >
+		OPERATOR    <- < '=' / '!=' / '^=' / '$=' / '*=' >
+		VALUE       <- < '"' (!'"' .)* '"' / "'" (!"'" .)* "'" >
+		%whitespace <- [ \t\r\n]*
+	`)
+
+	g := queryParser.Grammar
+	g["SELECTOR"].Action = func(v *Values, d Any) (Any, error) {
+		steps := []queryStep{v.Vs[0].(queryStep)}
+		for i := 1; i < len(v.Vs); i += 2 {
+			step := v.Vs[i+1].(queryStep)
+			step.child = v.ToStr(i) == ">"
+			steps = append(steps, step)
+		}
+		return steps, nil
+	}
+	g["STEP"].Action = func(v *Values, d Any) (Any, error) {
+		step := queryStep{name: v.ToStr(0)}
+		for _, pred := range v.Vs[1:] {
+			step.preds = append(step.preds, pred.(queryPredicate))
+		}
+		return step, nil
+	}
+	g["PREDICATE"].Action = func(v *Values, d Any) (Any, error) {
+		return queryPredicate{v.ToStr(0), v.ToStr(1), v.ToStr(2)}, nil
+	}
+	g["VALUE"].Action = func(v *Values, d Any) (Any, error) {
+		tok := v.Token()
+		return tok[1 : len(tok)-1], nil
+	}
+	for _, name := range []string{"AXIS", "NAME", "FIELD", "OPERATOR"} {
+		g[name].Action = func(v *Values, d Any) (Any, error) {
+			return v.Token(), nil
+		}
+	}
+}
+
+// CompileAstQuery parses a query. A syntax error is reported as *Error.
+func CompileAstQuery(s string) (*AstQuery, error) {
+	queryParserOnce.Do(setupQueryParser)
+
+	queryParserLock.Lock()
+	val, err := queryParser.ParseAndGetValue(s, nil)
+	queryParserLock.Unlock()
+
+	if err != nil {
+		return nil, err
+	}
+	return &AstQuery{src: s, steps: val.([]queryStep)}, nil
+}
+
+// MustCompileAstQuery is like CompileAstQuery but panics on a syntax error.
+func MustCompileAstQuery(s string) *AstQuery {
+	q, err := CompileAstQuery(s)
+	if err != nil {
+		panic("peg: CompileAstQuery(" + s + "): " + err.Error())
+	}
+	return q
+}
+
+func (q *AstQuery) String() string {
+	return q.src
+}
+
+// FindAll returns the nodes in ast, including ast itself, that match the
+// query in depth-first order.
+func (q *AstQuery) FindAll(ast *Ast) (nodes []*Ast) {
+	q.find(ast, nil, func(node *Ast) bool {
+		nodes = append(nodes, node)
+		return true
+	})
+	return
+}
+
+// FindFirst returns the first node that FindAll would return, or nil.
+func (q *AstQuery) FindFirst(ast *Ast) (node *Ast) {
+	q.find(ast, nil, func(n *Ast) bool {
+		node = n
+		return false
+	})
+	return
+}
+
+func (q *AstQuery) find(ast *Ast, path []*Ast, fn func(node *Ast) bool) bool {
+	path = append(path, ast)
+	if q.match(path, len(q.steps)-1) && !fn(ast) {
+		return false
+	}
+	for _, node := range ast.Nodes {
+		if !q.find(node, path, fn) {
+			return false
+		}
+	}
+	return true
+}
+
+// match checks that the last node in path matches steps[i], and the nodes
+// above it match the preceding steps.
+func (q *AstQuery) match(path []*Ast, i int) bool {
+	step := &q.steps[i]
+	if !step.match(path[len(path)-1]) {
+		return false
+	}
+	if i == 0 {
+		return true
+	}
+	if step.child {
+		return len(path) > 1 && q.match(path[:len(path)-1], i-1)
+	}
+	for j := len(path) - 1; j > 0; j-- {
+		if q.match(path[:j], i-1) {
+			return true
+		}
+	}
+	return false
+}
+
+func (step *queryStep) match(ast *Ast) bool {
+	if step.name != "*" && step.name != ast.Name {
+		return false
+	}
+	for _, pred := range step.preds {
+		s := ast.Token
+		if pred.field == "Name" {
+			s = ast.Name
+		}
+		var ok bool
+		switch pred.op {
+		case "=":
+			ok = s == pred.value
+		case "!=":
+			ok = s != pred.value
+		case "^=":
+			ok = strings.HasPrefix(s, pred.value)
+		case "$=":
+			ok = strings.HasSuffix(s, pred.value)
+		case "*=":
+			ok = strings.Contains(s, pred.value)
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,65 @@
+package peg
+
+import "testing"
+
+func TestAstQuery(t *testing.T) {
+	parser, err := NewParser(`
+		PROGRAM   <- FUNCTION*
+		FUNCTION  <- 'func' NAME BLOCK
+		BLOCK     <- '{' (BLOCK / CALL)* '}'
+		CALL      <- NAME '(' ')'
+		NAME      <- < [a-z]+ >
+		%whitespace <- [ \t\r\n]*
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parser.EnableAst()
+	ast, err := parser.ParseAndGetAst(`
+		func main { foo() { main() bar() } }
+		func sub { main() }
+	`, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		query string
+		want  int
+	}{
+		{`CALL`, 4},
+		{`FUNCTION > BLOCK > CALL`, 2},
+		{`FUNCTION BLOCK CALL`, 4},
+		{`BLOCK BLOCK CALL`, 2},
+		{`PROGRAM > CALL`, 0},
+		{`FUNCTION > *`, 4},
+		{`* > NAME[Token="main"]`, 3},
+		{`CALL > NAME[Token^='ma']`, 2},
+		{`CALL NAME[Token!="main"][Token*="a"]`, 1},
+		{`*[Name$="ION"]`, 2},
+		{`PROGRAM`, 1},
+	}
+	for _, cs := range cases {
+		q, err := CompileAstQuery(cs.query)
+		if err != nil {
+			t.Errorf("%q: %v", cs.query, err)
+			continue
+		}
+		if got := len(q.FindAll(ast)); got != cs.want {
+			t.Errorf("%q: want %d nodes, got %d", cs.query, cs.want, got)
+		}
+	}
+
+	q := MustCompileAstQuery(`BLOCK > CALL`)
+	first := q.FindFirst(ast)
+	assert(t, first != nil && first.Nodes[0].Token == "foo")
+	assert(t, MustCompileAstQuery(`NOTHING`).FindFirst(ast) == nil)
+}
+
+func TestAstQuerySyntaxError(t *testing.T) {
+	for _, s := range []string{``, `A >`, `A[Token]`, `A[Foo="x"]`, `A[Token="x]`} {
+		if _, err := CompileAstQuery(s); err == nil {
+			t.Errorf("%q: expected error", s)
+		}
+	}
+}
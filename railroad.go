@@ -0,0 +1,406 @@
+package peg
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// Railroad draws railroad diagrams of the rules of a parser as SVG, one
+// diagram per rule. References to rules are linked to their diagrams in the
+// HTML page.
+type Railroad struct {
+	grammar map[string]*Rule
+}
+
+func NewRailroad(p *Parser) *Railroad {
+	return &Railroad{grammar: p.Grammar}
+}
+
+// SVG returns the diagram of the rule.
+func (rr *Railroad) SVG(name string) (string, error) {
+	r, ok := rr.grammar[name]
+	if !ok {
+		return "", fmt.Errorf("peg: '%s' is not defined", name)
+	}
+	return railroadSVG(r), nil
+}
+
+// HTML returns a page with the diagrams of all rules in the order of
+// definition.
+func (rr *Railroad) HTML() string {
+	var rules []*Rule
+	for _, r := range rr.grammar {
+		rules = append(rules, r)
+	}
+	sort.Slice(rules, func(i, j int) bool {
+		// Rules given by the user come last
+		a, b := rules[i], rules[j]
+		if (len(a.SS) > 0) != (len(b.SS) > 0) {
+			return len(a.SS) > 0
+		}
+		if a.Pos != b.Pos {
+			return a.Pos < b.Pos
+		}
+		return a.Name < b.Name
+	})
+
+	var b strings.Builder
+	b.WriteString("<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n<title>Grammar</title>\n")
+	b.WriteString("<style>body { font-family: sans-serif; } h2 { font-size: 16px; }</style>\n")
+	b.WriteString("</head>\n<body>\n")
+	for _, r := range rules {
+		fmt.Fprintf(&b, "<section id=\"%s\">\n<h2>%s</h2>\n", railroadID(r.Name), xmlEscape(r.Name))
+		b.WriteString(railroadSVG(r))
+		b.WriteString("</section>\n")
+	}
+	b.WriteString("</body>\n</html>\n")
+	return b.String()
+}
+
+// Geometry of diagrams
+const (
+	rrCharWidth = 8
+	rrBoxHeight = 24
+	rrGap       = 10 // Horizontal space between nodes
+	rrVGap      = 8  // Vertical space between alternatives
+	rrRadius    = 10
+	rrMargin    = 20
+	rrLabel     = 14 // Height of labels of groups
+)
+
+const railroadStyle = `<style>
+path { stroke: #333; stroke-width: 2; fill: none; }
+rect { stroke: #333; stroke-width: 2; fill: #fff; }
+rect.terminal { fill: #ffc; }
+rect.nonterminal { fill: #def; }
+rect.group { stroke: #999; stroke-dasharray: 4 3; fill: none; }
+text { font-family: monospace; font-size: 13px; text-anchor: middle; }
+text.label { font-size: 11px; fill: #666; text-anchor: start; }
+a text { fill: #06c; }
+</style>
+`
+
+func railroadSVG(r *Rule) string {
+	ope := r.Ope
+	if ex, ok := ope.(*expression); ok {
+		ope = Seq(ex.atom, Zom(Seq(ex.binop, ex.atom)))
+	}
+	v := &railroadBuilder{}
+	ope.accept(v)
+	node := v.node
+
+	w, up, down := node.size()
+	width := w + 2*rrMargin + 2*rrGap
+	height := up + down + 2*rrMargin
+	x, y := rrMargin, rrMargin+up
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "<svg xmlns=\"http://www.w3.org/2000/svg\" width=\"%d\" height=\"%d\" viewBox=\"0 0 %d %d\">\n", width, height, width, height)
+	b.WriteString(railroadStyle)
+	fmt.Fprintf(&b, "<path d=\"M%d %d v20 M%d %d v20\"/>\n", x, y-10, x+4, y-10)
+	rrLine(&b, x, x+rrGap, y)
+	node.draw(&b, x+rrGap, y)
+	rrLine(&b, x+rrGap+w, x+2*rrGap+w, y)
+	x += 2*rrGap + w
+	fmt.Fprintf(&b, "<path d=\"M%d %d v20 M%d %d v20\"/>\n", x, y-10, x-4, y-10)
+	b.WriteString("</svg>\n")
+	return b.String()
+}
+
+// railroadNode is a part of a diagram. It enters on the left and leaves on
+// the right at the baseline, which is up below its top and down above its
+// bottom.
+type railroadNode interface {
+	size() (w, up, down int)
+	draw(b *strings.Builder, x, y int)
+}
+
+// railroadBox is a terminal or a nonterminal.
+type railroadBox struct {
+	text    string
+	class   string
+	href    string
+	rounded bool
+	wide    int
+}
+
+func newRailroadBox(text, class, href string, rounded bool) *railroadBox {
+	return &railroadBox{
+		text:    text,
+		class:   class,
+		href:    href,
+		rounded: rounded,
+		wide:    utf8.RuneCountInString(text)*rrCharWidth + 2*rrGap,
+	}
+}
+
+func (n *railroadBox) size() (int, int, int) {
+	return n.wide, rrBoxHeight / 2, rrBoxHeight / 2
+}
+
+func (n *railroadBox) draw(b *strings.Builder, x, y int) {
+	rx := 0
+	if n.rounded {
+		rx = rrBoxHeight / 2
+	}
+	fmt.Fprintf(b, "<rect class=\"%s\" x=\"%d\" y=\"%d\" width=\"%d\" height=\"%d\" rx=\"%d\"/>\n",
+		n.class, x, y-rrBoxHeight/2, n.wide, rrBoxHeight, rx)
+	text := fmt.Sprintf("<text x=\"%d\" y=\"%d\">%s</text>", x+n.wide/2, y+4, xmlEscape(n.text))
+	if len(n.href) > 0 {
+		text = fmt.Sprintf("<a href=\"%s\">%s</a>", n.href, text)
+	}
+	b.WriteString(text + "\n")
+}
+
+// railroadSequence
+type railroadSequence struct {
+	nodes []railroadNode
+}
+
+func (n *railroadSequence) size() (w, up, down int) {
+	for i, node := range n.nodes {
+		nw, nu, nd := node.size()
+		if i > 0 {
+			w += rrGap
+		}
+		w += nw
+		up = max(up, nu)
+		down = max(down, nd)
+	}
+	return
+}
+
+func (n *railroadSequence) draw(b *strings.Builder, x, y int) {
+	for i, node := range n.nodes {
+		if i > 0 {
+			rrLine(b, x, x+rrGap, y)
+			x += rrGap
+		}
+		node.draw(b, x, y)
+		w, _, _ := node.size()
+		x += w
+	}
+}
+
+// railroadChoice puts the first alternative on the baseline and the others
+// below it.
+type railroadChoice struct {
+	nodes []railroadNode
+}
+
+func (n *railroadChoice) size() (w, up, down int) {
+	for i, node := range n.nodes {
+		nw, nu, nd := node.size()
+		w = max(w, nw)
+		if i == 0 {
+			up, down = nu, nd
+		} else {
+			down += rrVGap + nu + nd
+		}
+	}
+	return w + 4*rrRadius, up, down
+}
+
+func (n *railroadChoice) draw(b *strings.Builder, x, y int) {
+	w, _, _ := n.size()
+	r := rrRadius
+	left, right := x+2*r, x+w-2*r
+
+	ny := y
+	for i, node := range n.nodes {
+		nw, nu, nd := node.size()
+		if i == 0 {
+			rrLine(b, x, left, y)
+		} else {
+			ny += nu
+			fmt.Fprintf(b, "<path d=\"M%d %d q%d 0 %d %d V%d q0 %d %d %d\"/>\n", x, y, r, r, r, ny-r, r, r, r)
+			fmt.Fprintf(b, "<path d=\"M%d %d q%d 0 %d %d V%d q0 %d %d %d\"/>\n", right, ny, r, r, -r, y+r, -r, r, -r)
+		}
+		node.draw(b, left, ny)
+		rrLine(b, left+nw, right, ny)
+		if i == 0 {
+			rrLine(b, right, x+w, y)
+		}
+		ny += nd + rrVGap
+	}
+}
+
+// railroadLoop repeats the node through a path below it.
+type railroadLoop struct {
+	node railroadNode
+}
+
+func (n *railroadLoop) size() (int, int, int) {
+	w, up, down := n.node.size()
+	return w + 4*rrRadius, up, down + rrVGap + rrRadius
+}
+
+func (n *railroadLoop) draw(b *strings.Builder, x, y int) {
+	w, _, down := n.node.size()
+	r := rrRadius
+	left, right := x+2*r, x+2*r+w
+	rrLine(b, x, left, y)
+	n.node.draw(b, left, y)
+	rrLine(b, right, right+2*r, y)
+
+	ly := y + down + rrVGap
+	fmt.Fprintf(b, "<path d=\"M%d %d q%d 0 %d %d V%d q0 %d %d %d H%d q%d 0 %d %d V%d q0 %d %d %d\"/>\n",
+		right, y, r, r, r, ly-r, r, -r, r, left, -r, -r, -r, y+r, -r, r, -r)
+}
+
+// railroadGroup frames the node with a label, e.g. for predicates.
+type railroadGroup struct {
+	label string
+	href  string
+	node  railroadNode
+}
+
+func (n *railroadGroup) size() (int, int, int) {
+	w, up, down := n.node.size()
+	lw := utf8.RuneCountInString(n.label)*7 + rrGap
+	return max(w, lw) + 2*rrGap, up + rrGap + rrLabel, down + rrGap
+}
+
+func (n *railroadGroup) draw(b *strings.Builder, x, y int) {
+	w, up, down := n.size()
+	nw, nu, _ := n.node.size()
+	top := y - nu - rrGap
+	fmt.Fprintf(b, "<rect class=\"group\" x=\"%d\" y=\"%d\" width=\"%d\" height=\"%d\" rx=\"4\"/>\n",
+		x, top, w, up+down-rrLabel)
+	label := fmt.Sprintf("<text class=\"label\" x=\"%d\" y=\"%d\">%s</text>", x+4, top-4, xmlEscape(n.label))
+	if len(n.href) > 0 {
+		label = fmt.Sprintf("<a href=\"%s\">%s</a>", n.href, label)
+	}
+	b.WriteString(label + "\n")
+	rrLine(b, x, x+rrGap, y)
+	n.node.draw(b, x+rrGap, y)
+	rrLine(b, x+rrGap+nw, x+w, y)
+}
+
+func rrLine(b *strings.Builder, x1, x2, y int) {
+	if x1 < x2 {
+		fmt.Fprintf(b, "<path d=\"M%d %d H%d\"/>\n", x1, y, x2)
+	}
+}
+
+// railroadBuilder
+type railroadBuilder struct {
+	*visitorBase
+	node railroadNode
+}
+
+func (v *railroadBuilder) build(ope operator) railroadNode {
+	chv := &railroadBuilder{}
+	ope.accept(chv)
+	return chv.node
+}
+
+func (v *railroadBuilder) visitSequence(ope *sequence) {
+	n := &railroadSequence{}
+	for _, o := range ope.opes {
+		n.nodes = append(n.nodes, v.build(o))
+	}
+	v.node = n
+}
+func (v *railroadBuilder) visitPrioritizedChoice(ope *prioritizedChoice) {
+	n := &railroadChoice{}
+	for _, o := range ope.opes {
+		n.nodes = append(n.nodes, v.build(o))
+	}
+	v.node = n
+}
+func (v *railroadBuilder) visitZeroOrMore(ope *zeroOrMore) {
+	v.node = &railroadChoice{[]railroadNode{&railroadSequence{}, &railroadLoop{v.build(ope.ope)}}}
+}
+func (v *railroadBuilder) visitOneOrMore(ope *oneOrMore) {
+	v.node = &railroadLoop{v.build(ope.ope)}
+}
+func (v *railroadBuilder) visitRepetition(ope *repetition) {
+	v.node = &railroadGroup{label: repetitionToS(ope.min, ope.max), node: v.build(ope.ope)}
+}
+func (v *railroadBuilder) visitOption(ope *option) {
+	v.node = &railroadChoice{[]railroadNode{&railroadSequence{}, v.build(ope.ope)}}
+}
+func (v *railroadBuilder) visitAndPredicate(ope *andPredicate) {
+	v.node = &railroadGroup{label: "&", node: v.build(ope.ope)}
+}
+func (v *railroadBuilder) visitNotPredicate(ope *notPredicate) {
+	v.node = &railroadGroup{label: "!", node: v.build(ope.ope)}
+}
+func (v *railroadBuilder) visitLiteralString(ope *literalString) {
+	v.node = newRailroadBox(quoteLiteral(ope.lit), "terminal", "", true)
+}
+func (v *railroadBuilder) visitCharacterClass(ope *characterClass) {
+	v.node = newRailroadBox("["+escapeGrammarText(ope.chars, ']')+"]", "terminal", "", true)
+}
+func (v *railroadBuilder) visitUnicodeClass(ope *unicodeClass) {
+	v.node = newRailroadBox(ope.text, "terminal", "", true)
+}
+func (v *railroadBuilder) visitAnyCharacter(ope *anyCharacter) {
+	v.node = newRailroadBox(".", "terminal", "", true)
+}
+func (v *railroadBuilder) visitTokenBoundary(ope *tokenBoundary) {
+	v.node = &railroadGroup{label: "token", node: v.build(ope.ope)}
+}
+func (v *railroadBuilder) visitIgnore(ope *ignore) {
+	v.node = &railroadGroup{label: "~", node: v.build(ope.ope)}
+}
+func (v *railroadBuilder) visitUser(ope *user) {
+	v.node = newRailroadBox("<user>", "terminal", "", true)
+}
+func (v *railroadBuilder) visitSemanticPredicate(ope *semanticPredicate) {
+	v.node = newRailroadBox(predicateToS(ope), "terminal", "", true)
+}
+func (v *railroadBuilder) visitReference(ope *reference) {
+	// Parameter of a macro
+	if ope.rule == nil {
+		v.node = newRailroadBox(ope.name, "nonterminal", "", false)
+		return
+	}
+
+	href := "#" + railroadID(ope.name)
+	if ope.args == nil {
+		v.node = newRailroadBox(ope.name, "nonterminal", href, false)
+		return
+	}
+
+	// Macro reference
+	n := &railroadSequence{}
+	for i, arg := range ope.args {
+		if i > 0 {
+			n.nodes = append(n.nodes, newRailroadBox(",", "terminal", "", true))
+		}
+		n.nodes = append(n.nodes, v.build(arg))
+	}
+	v.node = &railroadGroup{label: ope.name, href: href, node: n}
+}
+func (v *railroadBuilder) visitRule(ope *Rule) {
+	v.node = newRailroadBox(ope.Name, "nonterminal", "#"+railroadID(ope.Name), false)
+}
+func (v *railroadBuilder) visitWhitespace(ope *whitespace) {
+	ope.ope.accept(v)
+}
+func (v *railroadBuilder) visitExpression(ope *expression) {
+	Seq(ope.atom, Zom(Seq(ope.binop, ope.atom))).accept(v)
+}
+
+// railroadID makes an HTML id for a rule, e.g. '%whitespace'.
+func railroadID(name string) string {
+	var b strings.Builder
+	b.WriteString("rule-")
+	for i := 0; i < len(name); i++ {
+		ch := name[i]
+		if ch == '_' || ('0' <= ch && ch <= '9') || ('a' <= ch && ch <= 'z') || ('A' <= ch && ch <= 'Z') {
+			b.WriteByte(ch)
+		} else {
+			fmt.Fprintf(&b, "-%02x", ch)
+		}
+	}
+	return b.String()
+}
+
+func xmlEscape(s string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", "\"", "&quot;").Replace(s)
+}
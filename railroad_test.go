@@ -0,0 +1,61 @@
+package peg
+
+import (
+	"encoding/xml"
+	"strings"
+	"testing"
+)
+
+func TestRailroadSVG(t *testing.T) {
+	parser, err := NewParser(`
+		ROOT        <- LIST(ITEM)?
+		ITEM        <- < [a-z]+ > / &'#' !'##' '#' .
+		LIST(X)     <- X (',' X)*
+		%whitespace <- [ \t]*
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := NewRailroad(parser)
+
+	svg, err := rr.SVG("ITEM")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, xml.Unmarshal([]byte(svg), new(interface{})) == nil)
+	for _, s := range []string{">[a-z]<", ">token<", ">&amp;<", ">!<", ">'##'<", ">.<"} {
+		if !strings.Contains(svg, s) {
+			t.Errorf("%q is missing in:\n%s", s, svg)
+		}
+	}
+
+	svg, _ = rr.SVG("ROOT")
+	assert(t, strings.Contains(svg, `<a href="#rule-LIST">`))
+	assert(t, strings.Contains(svg, `<a href="#rule-ITEM">`))
+
+	svg, _ = rr.SVG("LIST")
+	assert(t, strings.Contains(svg, ">X<"))
+	assert(t, !strings.Contains(svg, `href="#rule-X"`))
+
+	_, err = rr.SVG("UNDEFINED")
+	assert(t, err != nil)
+}
+
+func TestRailroadHTML(t *testing.T) {
+	parser, err := NewParser(`
+		ROOT        <- LIST(ITEM)?
+		ITEM        <- < [a-z]+ > / &'#' !'##' '#' .
+		LIST(X)     <- X (',' X)*
+		%whitespace <- [ \t]*
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	html := NewRailroad(parser).HTML()
+
+	var ids []string
+	for _, s := range strings.Split(html, "<section id=\"")[1:] {
+		ids = append(ids, s[:strings.Index(s, "\"")])
+	}
+	assert(t, strings.Join(ids, " ") == "rule-ROOT rule-ITEM rule-LIST rule--25whitespace")
+}
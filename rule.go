@@ -1,6 +1,11 @@
 package peg
 
-import "fmt"
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
 
 // Error detail
 type ErrorDetail struct {
@@ -36,6 +41,7 @@ type Rule struct {
 	Enter         func(d Any)
 	Leave         func(d Any)
 	Message       func() (message string)
+	ErrorMessage  string
 	Ignore        bool
 	WhitespaceOpe operator
 	WordOpe       operator
@@ -47,31 +53,48 @@ type Rule struct {
 
 	tokenChecker  *tokenChecker
 	disableAction bool
+	precedence    []string // Levels of '{ precedence ... }' such as "L + -"
 }
 
 func (r *Rule) Parse(s string, d Any) (l int, val Any, err error) {
-	v := &Values{}
+	l, v, err := r.parseRoot(s, d, false)
+	return l, rootValue(l, v), err
+}
+
+// rootValue returns the semantic value of the parse of the length l.
+func rootValue(l int, v *Values) Any {
+	if success(l) && len(v.Vs) > 0 && v.Vs[0] != nil {
+		return v.Vs[0]
+	}
+	return nil
+}
+
+func (r *Rule) parseRoot(s string, d Any, cst bool) (l int, v *Values, err error) {
 	c := &context{
-		s:             s,
-		errorPos:      -1,
-		messagePos:    -1,
+		cst:           cst,
 		whitespaceOpe: r.WhitespaceOpe,
 		wordOpe:       r.WordOpe,
 		tracerEnter:   r.TracerEnter,
 		tracerLeave:   r.TracerLeave,
 	}
+	return r.parseWith(s, d, c)
+}
+
+// parseWith parses s from the rule with the settings in c such as the
+// whitespace, so that the rule itself isn't changed.
+func (r *Rule) parseWith(s string, d Any, c *context) (l int, v *Values, err error) {
+	v = &Values{}
+	c.s = s
+	c.errorPos = -1
+	c.messagePos = -1
 
 	var ope operator = r
-	if r.WhitespaceOpe != nil {
-		ope = Seq(r.WhitespaceOpe, r) // Skip whitespace at beginning
+	if c.whitespaceOpe != nil {
+		ope = Seq(c.whitespaceOpe, r) // Skip whitespace at beginning
 	}
 
 	l = ope.parse(s, 0, v, c, d)
 
-	if success(l) && len(v.Vs) > 0 && v.Vs[0] != nil {
-		val = v.Vs[0]
-	}
-
 	if fail(l) || l != len(s) {
 		var pos int
 		var msg string
@@ -114,6 +137,7 @@ func (r *Rule) parseCore(s string, p int, v *Values, c *context, d Any) int {
 	}
 
 	chv := c.push()
+	chv.name = r.Name
 
 	l := r.Ope.parse(s, p, chv, c, d)
 
@@ -142,12 +166,24 @@ func (r *Rule) parseCore(s string, p int, v *Values, c *context, d Any) int {
 		if r.Ignore == false {
 			v.Vs = append(v.Vs, val)
 		}
+		if c.cst {
+			v.cs = append(v.cs, newCstNode(r.Name, s, p, l, chv.cs))
+		}
 	} else {
 		if r.Message != nil {
 			if c.messagePos < p {
 				c.messagePos = p
 				c.message = r.Message()
 			}
+		} else if len(r.ErrorMessage) > 0 {
+			pos := c.errorPos
+			if pos < p {
+				pos = p
+			}
+			if c.messagePos < pos {
+				c.messagePos = pos
+				c.message = r.formatErrorMessage(s, pos, c)
+			}
 		}
 	}
 
@@ -172,6 +208,38 @@ func (r *Rule) isToken() bool {
 	return r.tokenChecker.isToken()
 }
 
+// formatErrorMessage expands '%r' to the rule name and '%t' to the token
+// found at the error position in the error_message template.
+func (r *Rule) formatErrorMessage(s string, pos int, c *context) string {
+	rep := strings.NewReplacer("%%", "%", "%r", r.Name, "%t", foundToken(s, pos, c))
+	return rep.Replace(r.ErrorMessage)
+}
+
+// foundToken returns the token found at pos for '%t' in error messages: the
+// word at pos if the grammar has '%word', or the text up to the next space,
+// or "end of input". The error state of c is kept as it is.
+func foundToken(s string, pos int, c *context) string {
+	if pos >= len(s) {
+		return "end of input"
+	}
+	if c.wordOpe != nil {
+		saveErrorPos, saveMessagePos, saveMessage := c.errorPos, c.messagePos, c.message
+		l := c.wordOpe.parse(s, pos, c.push(), c, nil)
+		c.pop()
+		c.errorPos, c.messagePos, c.message = saveErrorPos, saveMessagePos, saveMessage
+		if l > 0 {
+			return s[pos : pos+l]
+		}
+	}
+	l := strings.IndexFunc(s[pos:], unicode.IsSpace)
+	if l == -1 {
+		l = len(s) - pos
+	} else if l == 0 {
+		_, l = utf8.DecodeRuneInString(s[pos:])
+	}
+	return s[pos : pos+l]
+}
+
 // lineInfo
 func lineInfo(s string, curPos int) (ln int, col int) {
 	pos := 0
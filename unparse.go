@@ -0,0 +1,363 @@
+package peg
+
+import (
+	"strings"
+	"unicode"
+)
+
+// Unparse token
+type UnparseToken struct {
+	Text  string
+	Node  *Ast // Node which the token belongs to
+	Space bool // %whitespace would be skipped after the token
+}
+
+// Unparser regenerates source text from an Ast made by EnableAst, without
+// optimization, by walking the definition of each rule alongside its node.
+// Literals are written as they are, and token rules write the token of the
+// node. Where the grammar has to choose without a node to tell, such as
+// '+' / '-' or [0-9], the first alternative is taken.
+type Unparser struct {
+	// Separator is written where %whitespace would be skipped.
+	Separator string
+	// Layout, if set, returns the text written between two tokens instead.
+	Layout func(prev *UnparseToken, next *UnparseToken) string
+
+	grammar    map[string]*Rule
+	whitespace bool
+}
+
+func NewUnparser(p *Parser) *Unparser {
+	_, ws := p.Grammar[WhitespceRuleName]
+	return &Unparser{
+		Separator:  " ",
+		grammar:    p.Grammar,
+		whitespace: ws,
+	}
+}
+
+// Tokens returns the tokens for ast before the layout is applied.
+func (u *Unparser) Tokens(ast *Ast) ([]UnparseToken, error) {
+	r, ok := u.grammar[ast.Name]
+	if !ok {
+		return nil, unparseError(ast, "'"+ast.Name+"' is not defined.")
+	}
+
+	g := &unparser{u: u, exprs: make(map[*expression]operator)}
+	if !g.genRule(r, ast, func() bool { return true }) {
+		return nil, unparseError(g.failNode, g.failMsg)
+	}
+	return g.toks, nil
+}
+
+// unparseError makes the error at the node.
+func unparseError(ast *Ast, msg string) error {
+	return &Error{Details: []ErrorDetail{{ast.Ln, ast.Col, msg}}}
+}
+
+func (u *Unparser) Unparse(ast *Ast) (string, error) {
+	toks, err := u.Tokens(ast)
+	if err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	for i := range toks {
+		if i > 0 {
+			prev, next := &toks[i-1], &toks[i]
+			if u.Layout != nil {
+				b.WriteString(u.Layout(prev, next))
+			} else if prev.Space {
+				b.WriteString(u.Separator)
+			}
+		}
+		b.WriteString(toks[i].Text)
+	}
+	return b.String(), nil
+}
+
+// unparser
+type unparser struct {
+	u        *Unparser
+	toks     []UnparseToken
+	args     [][]operator
+	exprs    map[*expression]operator
+	failNode *Ast
+	failMsg  string
+}
+
+func (g *unparser) emit(text string, node *Ast, space bool) {
+	if len(text) > 0 {
+		g.toks = append(g.toks, UnparseToken{text, node, space})
+	}
+}
+
+// gen generates an operator against v.node.Nodes[idx:] and calls k with the
+// index of the first node it didn't consume. Tokens are rolled back if k
+// fails.
+func (g *unparser) gen(v *unparseOpe, ope operator, idx int, k func(idx int) bool) bool {
+	chv := *v
+	chv.idx = idx
+	chv.k = k
+	chv.ok = false
+
+	n := len(g.toks)
+	ope.accept(&chv)
+	if !chv.ok {
+		g.toks = g.toks[:n]
+	}
+	return chv.ok
+}
+
+// fail records the furthest node that didn't fit the grammar.
+func (g *unparser) fail(parent *Ast, idx int) {
+	node, msg := parent, "'"+parent.Name+"' lacks a node."
+	if idx < len(parent.Nodes) {
+		node = parent.Nodes[idx]
+		msg = "'" + node.Name + "' is unexpected in '" + parent.Name + "'."
+	}
+	if g.failNode == nil || node.Ln > g.failNode.Ln ||
+		(node.Ln == g.failNode.Ln && node.Col >= g.failNode.Col) {
+		g.failNode = node
+		g.failMsg = msg
+	}
+}
+
+func (g *unparser) genRule(r *Rule, node *Ast, k func() bool) bool {
+	v := &unparseOpe{g: g, rule: r, node: node, owner: node}
+
+	var ok bool
+	if r.isToken() {
+		v.tok = node
+		if r.tokenChecker.hasTokenBoundary {
+			ok = g.gen(v, r.Ope, 0, func(int) bool { return k() })
+		} else {
+			// The token has the whitespace skipped after it, if any
+			tok := node.Token
+			if g.u.whitespace {
+				tok = strings.TrimRightFunc(tok, unicode.IsSpace)
+			}
+			n := len(g.toks)
+			g.emit(tok, node, len(tok) < len(node.Token))
+			if ok = k(); !ok {
+				g.toks = g.toks[:n]
+			}
+		}
+	} else {
+		ok = g.gen(v, r.Ope, 0, func(idx int) bool {
+			if idx < len(node.Nodes) {
+				g.fail(node, idx)
+				return false
+			}
+			return k()
+		})
+	}
+	return ok
+}
+
+// unparseOpe
+type unparseOpe struct {
+	*visitorBase
+	g       *unparser
+	rule    *Rule
+	node    *Ast // nil in rules without a node, such as ignored ones
+	owner   *Ast // nearest node for the tokens
+	tok     *Ast // node of the token rule
+	inToken bool
+	idx     int
+	k       func(idx int) bool
+	ok      bool
+}
+
+func (v *unparseOpe) visitSequence(ope *sequence) {
+	var step func(i int, idx int) bool
+	step = func(i int, idx int) bool {
+		if i == len(ope.opes) {
+			return v.k(idx)
+		}
+		return v.g.gen(v, ope.opes[i], idx, func(idx int) bool {
+			return step(i+1, idx)
+		})
+	}
+	v.ok = step(0, v.idx)
+}
+func (v *unparseOpe) visitPrioritizedChoice(ope *prioritizedChoice) {
+	for _, o := range ope.opes {
+		if v.g.gen(v, o, v.idx, v.k) {
+			v.ok = true
+			return
+		}
+	}
+}
+func (v *unparseOpe) visitZeroOrMore(ope *zeroOrMore) {
+	v.ok = v.loop(ope.ope, v.idx)
+}
+func (v *unparseOpe) visitOneOrMore(ope *oneOrMore) {
+	v.ok = v.g.gen(v, ope.ope, v.idx, func(idx int) bool {
+		return v.loop(ope.ope, idx)
+	})
+}
+func (v *unparseOpe) visitRepetition(ope *repetition) {
+	v.ok = v.repeat(ope, 0, v.idx)
+}
+func (v *unparseOpe) visitOption(ope *option) {
+	// Take the option only if it accounts for some nodes
+	v.ok = v.g.gen(v, ope.ope, v.idx, func(idx int) bool {
+		return idx > v.idx && v.k(idx)
+	}) || v.k(v.idx)
+}
+func (v *unparseOpe) visitAndPredicate(ope *andPredicate) { v.ok = v.k(v.idx) }
+func (v *unparseOpe) visitNotPredicate(ope *notPredicate) { v.ok = v.k(v.idx) }
+func (v *unparseOpe) visitSemanticPredicate(ope *semanticPredicate) {
+	v.ok = v.k(v.idx)
+}
+func (v *unparseOpe) visitLiteralString(ope *literalString) {
+	if !v.inToken {
+		v.g.emit(ope.lit, v.owner, v.g.u.whitespace)
+	}
+	v.ok = v.k(v.idx)
+}
+func (v *unparseOpe) visitCharacterClass(ope *characterClass) {
+	if !v.inToken {
+		if len(ope.chars) == 0 {
+			return
+		}
+		v.g.emit(ope.chars[:1], v.owner, false)
+	}
+	v.ok = v.k(v.idx)
+}
+func (v *unparseOpe) visitUnicodeClass(ope *unicodeClass) {
+	if !v.inToken {
+		ranges := ope.allRanges()
+		if len(ranges) == 0 {
+			return
+		}
+		v.g.emit(string(ranges[0][0]), v.owner, false)
+	}
+	v.ok = v.k(v.idx)
+}
+func (v *unparseOpe) visitAnyCharacter(ope *anyCharacter) {
+	if v.inToken {
+		v.ok = v.k(v.idx)
+	}
+}
+func (v *unparseOpe) visitTokenBoundary(ope *tokenBoundary) {
+	// Tokens of rules without a node, e.g. ignored comments, are left out
+	if v.tok != nil && !v.inToken {
+		v.g.emit(v.tok.Token, v.tok, v.g.u.whitespace)
+	}
+	chv := *v
+	chv.inToken = true
+	v.ok = v.g.gen(&chv, ope.ope, v.idx, v.k)
+}
+func (v *unparseOpe) visitIgnore(ope *ignore) {
+	chv := *v
+	chv.node = nil
+	v.ok = v.g.gen(&chv, ope.ope, 0, func(int) bool { return v.k(v.idx) })
+}
+func (v *unparseOpe) visitReference(ope *reference) {
+	if ope.rule != nil {
+		v.genRef(ope.rule, ope.args)
+		return
+	}
+
+	// Parameter of a macro
+	if n := len(v.g.args); n > 0 {
+		v.ok = v.g.gen(v, v.g.args[n-1][ope.iarg], v.idx, v.k)
+	}
+}
+func (v *unparseOpe) visitRule(ope *Rule)             { v.genRef(ope, nil) }
+func (v *unparseOpe) visitWhitespace(ope *whitespace) { v.ok = v.k(v.idx) }
+func (v *unparseOpe) visitExpression(ope *expression) {
+	ex, ok := v.g.exprs[ope]
+	if !ok {
+		self := Ref(v.rule.Name, nil, -1)
+		self.(*reference).rule = v.rule
+		operand := Cho(self, ope.atom)
+		ex = Seq(operand, Zom(Seq(ope.binop, operand)))
+		prefix, postfix := []operator{ope.binop}, []operator{ope.binop}
+		for _, o := range ope.table.prefixOpes {
+			prefix = append(prefix, o.Ope)
+		}
+		for _, o := range ope.table.postfixOpes {
+			postfix = append(postfix, o.Ope)
+		}
+		if len(prefix) > 1 || len(postfix) > 1 || len(ope.table.prefix) > 0 || len(ope.table.postfix) > 0 {
+			// Nodes of prefix and postfix operators
+			ex = Cho(ex, Seq(Cho(prefix...), operand), Seq(operand, Cho(postfix...)))
+		}
+		v.g.exprs[ope] = ex
+	}
+	v.ok = v.g.gen(v, ex, v.idx, v.k)
+}
+
+func (v *unparseOpe) loop(ope operator, idx int) bool {
+	ok := v.g.gen(v, ope, idx, func(i int) bool {
+		return i > idx && v.loop(ope, i)
+	})
+	return ok || v.k(idx)
+}
+
+// repeat generates the repetition from the n-th time at idx. After the
+// minimum times, it repeats only while the expression accounts for some
+// nodes, as loop does.
+func (v *unparseOpe) repeat(ope *repetition, n int, idx int) bool {
+	if ope.max == -1 || n < ope.max {
+		ok := v.g.gen(v, ope.ope, idx, func(i int) bool {
+			return (n < ope.min || i > idx) && v.repeat(ope, n+1, i)
+		})
+		if ok {
+			return true
+		}
+	}
+	return n >= ope.min && v.k(idx)
+}
+
+func (v *unparseOpe) genRef(r *Rule, argOpes []operator) {
+	// Macro
+	if r.Parameters != nil {
+		var args []operator
+		vis := &findReference{params: r.Parameters}
+		if n := len(v.g.args); n > 0 {
+			vis.args = v.g.args[n-1]
+		}
+		for _, arg := range argOpes {
+			arg.accept(vis)
+			args = append(args, vis.ope)
+		}
+
+		v.g.args = append(v.g.args, args)
+		v.ok = v.g.gen(v, r.Ope, v.idx, func(idx int) bool {
+			v.g.args = v.g.args[:len(v.g.args)-1]
+			defer func() { v.g.args = append(v.g.args, args) }()
+			return v.k(idx)
+		})
+		v.g.args = v.g.args[:len(v.g.args)-1]
+		return
+	}
+
+	// Rule without a node
+	if v.node == nil || v.tok != nil || r.Ignore {
+		chv := *v
+		chv.rule = r
+		chv.node = nil
+		chv.tok = nil
+		v.ok = v.g.gen(&chv, r.Ope, 0, func(int) bool { return v.k(v.idx) })
+		return
+	}
+
+	if v.idx >= len(v.node.Nodes) {
+		v.g.fail(v.node, v.idx)
+		return
+	}
+	node := v.node.Nodes[v.idx]
+	if node.Name != r.Name {
+		v.g.fail(v.node, v.idx)
+		// An expression without operators is reduced to the atom
+		if ex, ok := r.Ope.(*expression); ok {
+			v.ok = v.g.gen(v, ex.atom, v.idx, v.k)
+		}
+		return
+	}
+	v.ok = v.g.genRule(r, node, func() bool { return v.k(v.idx + 1) })
+}
@@ -0,0 +1,136 @@
+package peg
+
+import "testing"
+
+func TestUnparse(t *testing.T) {
+	parser, err := NewParser(`
+		PROGRAM     <- STATEMENT*
+		STATEMENT   <- LET NAME '=' EXPR ~SEMI / CALL ~SEMI
+		CALL        <- NAME '(' List(EXPR, ',')? ')'
+		EXPR        <- ATOM (BINOP ATOM)*
+		ATOM        <- NUMBER / STRING / CALL / NAME / '(' EXPR ')'
+		BINOP       <- < [-+*/] >
+		NAME        <- < [a-z]+ >
+		NUMBER      <- < [0-9]+ >
+		STRING      <- < '"' (!'"' .)* '"' >
+		LET         <- 'let'
+		SEMI        <- ';'
+		List(I, D)  <- I (D I)*
+		%whitespace <- [ \t\r\n]*
+		---
+		%expr  = EXPR
+		%binop = L + -
+		%binop = L * /
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parser.EnableAst()
+
+	ast, err := parser.ParseAndGetAst(`let x=1+2*(3-4) ;  print("a b",x,f());`, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u := NewUnparser(parser)
+	s, err := u.Unparse(ast)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `let x = 1 + 2 * ( 3 - 4 ) ; print ( "a b" , x , f ( ) ) ;`
+	if s != want {
+		t.Errorf("want %q, got %q", want, s)
+	}
+
+	// Unparsed text parses to the same AST
+	ast2, err := parser.ParseAndGetAst(s, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s2, _ := u.Unparse(ast2)
+	assert(t, s2 == s)
+
+	u.Layout = func(prev *UnparseToken, next *UnparseToken) string {
+		switch {
+		case prev.Text == ";":
+			return "\n"
+		case prev.Text == "(" || next.Text == ")" || next.Text == "," || next.Text == ";":
+			return ""
+		case next.Text == "(" && prev.Node.Name == "NAME":
+			return ""
+		case prev.Node.Name == "STRING" || next.Node.Name == "STRING":
+			return ""
+		}
+		return " "
+	}
+	s, _ = u.Unparse(ast)
+	want = "let x = 1 + 2 * (3 - 4);\nprint(\"a b\", x, f());"
+	if s != want {
+		t.Errorf("want %q, got %q", want, s)
+	}
+}
+
+func TestUnparseUnaryOperators(t *testing.T) {
+	parser, err := NewParser(`
+		EXPR        <- ATOM (BINOP ATOM)*
+		ATOM        <- NUMBER / '(' EXPR ')'
+		BINOP       <- < [-+*/!] >
+		NUMBER      <- < [0-9]+ >
+		INDEX       <- '[' EXPR ']'
+		%whitespace <- [ \t\r\n]*
+		---
+		%expr    = EXPR
+		%binop   = L + -
+		%binop   = L * /
+		%prefix  = -
+		%postfix = ! INDEX
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parser.EnableAst()
+
+	ast, err := parser.ParseAndGetAst("-1+2*-(3-4)![0]", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewUnparser(parser).Unparse(ast)
+	assert(t, err == nil && s == "- 1 + 2 * - ( 3 - 4 ) ! [ 0 ]")
+}
+
+func TestUnparseRepetition(t *testing.T) {
+	parser, _ := NewParser(`
+		LIST  <- ITEM{2,100000} '.'{2}
+		ITEM  <- < [a-z]+ >
+		%whitespace <- [ \t]*
+	`)
+	parser.EnableAst()
+	ast, err := parser.ParseAndGetAst("a b c ..", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewUnparser(parser).Unparse(ast)
+	assert(t, err == nil && s == "a b c . .")
+
+	ast.Nodes = ast.Nodes[:1]
+	_, err = NewUnparser(parser).Unparse(ast)
+	assert(t, err != nil)
+}
+
+func TestUnparseMismatch(t *testing.T) {
+	parser, _ := NewParser(`
+		LIST  <- '[' ITEM* ']'
+		ITEM  <- < [a-z]+ >
+	`)
+	parser.EnableAst()
+	ast, _ := parser.ParseAndGetAst("[ab]", nil)
+
+	ast.Nodes = append(ast.Nodes, &Ast{Ln: 1, Col: 4, Name: "LIST"})
+	_, err := NewUnparser(parser).Unparse(ast)
+	assert(t, err != nil)
+	assert(t, err.Error() == "1:4 'LIST' is unexpected in 'LIST'.")
+
+	ast.Nodes = nil
+	_, err = NewUnparser(parser).Unparse(ast)
+	assert(t, err == nil)
+}
@@ -6,15 +6,18 @@ type visitor interface {
 	visitPrioritizedChoice(ope *prioritizedChoice)
 	visitZeroOrMore(ope *zeroOrMore)
 	visitOneOrMore(ope *oneOrMore)
+	visitRepetition(ope *repetition)
 	visitOption(ope *option)
 	visitAndPredicate(ope *andPredicate)
 	visitNotPredicate(ope *notPredicate)
 	visitLiteralString(ope *literalString)
 	visitCharacterClass(ope *characterClass)
+	visitUnicodeClass(ope *unicodeClass)
 	visitAnyCharacter(ope *anyCharacter)
 	visitTokenBoundary(ope *tokenBoundary)
 	visitIgnore(ope *ignore)
 	visitUser(ope *user)
+	visitSemanticPredicate(ope *semanticPredicate)
 	visitReference(ope *reference)
 	visitRule(ope *Rule)
 	visitWhitespace(ope *whitespace)
@@ -29,15 +32,18 @@ func (v *visitorBase) visitSequence(ope *sequence)                   {}
 func (v *visitorBase) visitPrioritizedChoice(ope *prioritizedChoice) {}
 func (v *visitorBase) visitZeroOrMore(ope *zeroOrMore)               {}
 func (v *visitorBase) visitOneOrMore(ope *oneOrMore)                 {}
+func (v *visitorBase) visitRepetition(ope *repetition)               {}
 func (v *visitorBase) visitOption(ope *option)                       {}
 func (v *visitorBase) visitAndPredicate(ope *andPredicate)           {}
 func (v *visitorBase) visitNotPredicate(ope *notPredicate)           {}
 func (v *visitorBase) visitLiteralString(ope *literalString)         {}
 func (v *visitorBase) visitCharacterClass(ope *characterClass)       {}
+func (v *visitorBase) visitUnicodeClass(ope *unicodeClass)           {}
 func (v *visitorBase) visitAnyCharacter(ope *anyCharacter)           {}
 func (v *visitorBase) visitTokenBoundary(ope *tokenBoundary)         {}
 func (v *visitorBase) visitIgnore(ope *ignore)                       {}
 func (v *visitorBase) visitUser(ope *user)                           {}
+func (v *visitorBase) visitSemanticPredicate(ope *semanticPredicate) {}
 func (v *visitorBase) visitReference(ope *reference)                 {}
 func (v *visitorBase) visitRule(ope *Rule)                           {}
 func (v *visitorBase) visitWhitespace(ope *whitespace)               {}
@@ -62,6 +68,7 @@ func (v *tokenChecker) visitPrioritizedChoice(ope *prioritizedChoice) {
 }
 func (v *tokenChecker) visitZeroOrMore(ope *zeroOrMore)       { ope.ope.accept(v) }
 func (v *tokenChecker) visitOneOrMore(ope *oneOrMore)         { ope.ope.accept(v) }
+func (v *tokenChecker) visitRepetition(ope *repetition)       { ope.ope.accept(v) }
 func (v *tokenChecker) visitOption(ope *option)               { ope.ope.accept(v) }
 func (v *tokenChecker) visitTokenBoundary(ope *tokenBoundary) { v.hasTokenBoundary = true }
 func (v *tokenChecker) visitIgnore(ope *ignore)               { ope.ope.accept(v) }
@@ -86,6 +93,8 @@ func (v *tokenChecker) isToken() bool {
 type detectLeftRecursion struct {
 	*visitorBase
 	pos    int
+	ss     string // Source of the rule with pos
+	src    string // Source of the rule being visited
 	name   string
 	params []string
 	refs   map[string]bool
@@ -119,12 +128,21 @@ func (v *detectLeftRecursion) visitAndPredicate(ope *andPredicate)     { ope.ope
 func (v *detectLeftRecursion) visitNotPredicate(ope *notPredicate)     { ope.ope.accept(v); v.done = false }
 func (v *detectLeftRecursion) visitLiteralString(ope *literalString)   { v.done = len(ope.lit) > 0 }
 func (v *detectLeftRecursion) visitCharacterClass(ope *characterClass) { v.done = true }
+func (v *detectLeftRecursion) visitUnicodeClass(ope *unicodeClass)     { v.done = true }
 func (v *detectLeftRecursion) visitAnyCharacter(ope *anyCharacter)     { v.done = true }
 func (v *detectLeftRecursion) visitTokenBoundary(ope *tokenBoundary)   { ope.ope.accept(v) }
 func (v *detectLeftRecursion) visitIgnore(ope *ignore)                 { ope.ope.accept(v) }
+func (v *detectLeftRecursion) visitSemanticPredicate(ope *semanticPredicate) {
+	v.done = false
+}
+func (v *detectLeftRecursion) visitRepetition(ope *repetition) {
+	ope.ope.accept(v)
+	v.done = ope.min > 0
+}
 func (v *detectLeftRecursion) visitReference(ope *reference) {
 	if ope.name == v.name {
 		v.pos = ope.pos
+		v.ss = v.src
 	} else if _, ok := v.refs[ope.name]; !ok {
 		v.refs[ope.name] = true
 		if ope.rule != nil {
@@ -136,10 +154,142 @@ func (v *detectLeftRecursion) visitReference(ope *reference) {
 	}
 	v.done = true
 }
-func (v *detectLeftRecursion) visitRule(ope *Rule)             { ope.Ope.accept(v) }
+func (v *detectLeftRecursion) visitRule(ope *Rule) {
+	src := v.src
+	v.src = ope.SS
+	ope.Ope.accept(v)
+	v.src = src
+}
 func (v *detectLeftRecursion) visitWhitespace(ope *whitespace) { ope.ope.accept(v) }
 func (v *detectLeftRecursion) visitExpression(ope *expression) { ope.atom.accept(v) }
 
+// emptyChecker tells if an operator never consumes input, so that a
+// repetition of it would match nothing forever. rules are the rules known to
+// never consume input. User operators and arguments of macros are taken as
+// consuming input, so the check is sound for them.
+type emptyChecker struct {
+	*visitorBase
+	rules map[*Rule]bool
+	empty bool
+}
+
+func (v *emptyChecker) visitSequence(ope *sequence) {
+	for _, o := range ope.opes {
+		if o.accept(v); !v.empty {
+			return
+		}
+	}
+	v.empty = true
+}
+func (v *emptyChecker) visitPrioritizedChoice(ope *prioritizedChoice) {
+	for _, o := range ope.opes {
+		if o.accept(v); !v.empty {
+			return
+		}
+	}
+	v.empty = true
+}
+func (v *emptyChecker) visitZeroOrMore(ope *zeroOrMore)         { ope.ope.accept(v) }
+func (v *emptyChecker) visitOneOrMore(ope *oneOrMore)           { ope.ope.accept(v) }
+func (v *emptyChecker) visitRepetition(ope *repetition)         { ope.ope.accept(v) }
+func (v *emptyChecker) visitOption(ope *option)                 { ope.ope.accept(v) }
+func (v *emptyChecker) visitAndPredicate(ope *andPredicate)     { v.empty = true }
+func (v *emptyChecker) visitNotPredicate(ope *notPredicate)     { v.empty = true }
+func (v *emptyChecker) visitLiteralString(ope *literalString)   { v.empty = len(ope.lit) == 0 }
+func (v *emptyChecker) visitCharacterClass(ope *characterClass) { v.empty = false }
+func (v *emptyChecker) visitUnicodeClass(ope *unicodeClass)     { v.empty = false }
+func (v *emptyChecker) visitAnyCharacter(ope *anyCharacter)     { v.empty = false }
+func (v *emptyChecker) visitTokenBoundary(ope *tokenBoundary)   { ope.ope.accept(v) }
+func (v *emptyChecker) visitIgnore(ope *ignore)                 { ope.ope.accept(v) }
+func (v *emptyChecker) visitUser(ope *user)                     { v.empty = false }
+func (v *emptyChecker) visitSemanticPredicate(ope *semanticPredicate) {
+	v.empty = true
+}
+func (v *emptyChecker) visitReference(ope *reference) {
+	v.empty = ope.rule != nil && ope.args == nil && v.rules[ope.rule]
+}
+func (v *emptyChecker) visitRule(ope *Rule)             { ope.Ope.accept(v) }
+func (v *emptyChecker) visitWhitespace(ope *whitespace) { ope.ope.accept(v) }
+func (v *emptyChecker) visitExpression(ope *expression) {
+	if ope.atom.accept(v); v.empty {
+		ope.binop.accept(v)
+	}
+}
+
+// detectInfiniteLoop finds a repetition of an operator which never consumes
+// input. Repetitions of operators which only can match an empty string are
+// warned by Lint.
+type detectInfiniteLoop struct {
+	*visitorBase
+	empty map[*Rule]bool
+	loop  operator
+}
+
+func (v *detectInfiniteLoop) visitSequence(ope *sequence) {
+	for _, o := range ope.opes {
+		o.accept(v)
+	}
+}
+func (v *detectInfiniteLoop) visitPrioritizedChoice(ope *prioritizedChoice) {
+	for _, o := range ope.opes {
+		o.accept(v)
+	}
+}
+func (v *detectInfiniteLoop) visitZeroOrMore(ope *zeroOrMore)       { v.check(ope, ope.ope) }
+func (v *detectInfiniteLoop) visitOneOrMore(ope *oneOrMore)         { v.check(ope, ope.ope) }
+func (v *detectInfiniteLoop) visitOption(ope *option)               { ope.ope.accept(v) }
+func (v *detectInfiniteLoop) visitAndPredicate(ope *andPredicate)   { ope.ope.accept(v) }
+func (v *detectInfiniteLoop) visitNotPredicate(ope *notPredicate)   { ope.ope.accept(v) }
+func (v *detectInfiniteLoop) visitTokenBoundary(ope *tokenBoundary) { ope.ope.accept(v) }
+func (v *detectInfiniteLoop) visitIgnore(ope *ignore)               { ope.ope.accept(v) }
+func (v *detectInfiniteLoop) visitRepetition(ope *repetition) {
+	if ope.max == -1 {
+		v.check(ope, ope.ope)
+	} else {
+		ope.ope.accept(v)
+	}
+}
+func (v *detectInfiniteLoop) visitReference(ope *reference) {
+	for _, arg := range ope.args {
+		arg.accept(v)
+	}
+}
+func (v *detectInfiniteLoop) visitRule(ope *Rule)             { ope.Ope.accept(v) }
+func (v *detectInfiniteLoop) visitWhitespace(ope *whitespace) { ope.ope.accept(v) }
+func (v *detectInfiniteLoop) visitExpression(ope *expression) { ope.atom.accept(v) }
+
+func (v *detectInfiniteLoop) check(loop, ope operator) {
+	n := &emptyChecker{rules: v.empty}
+	if ope.accept(n); n.empty && v.loop == nil {
+		v.loop = loop
+	}
+	ope.accept(v)
+}
+
+// emptyRules returns the rules which never consume input. A rule consumes
+// input if an operator in it does, so the rules are taken as empty until
+// they are known to consume input.
+func emptyRules(grammar map[string]*Rule) map[*Rule]bool {
+	rules := make(map[*Rule]bool)
+	for _, r := range grammar {
+		if r.Parameters == nil {
+			rules[r] = true
+		}
+	}
+	for changed := true; changed; {
+		changed = false
+		for r := range rules {
+			v := &emptyChecker{rules: rules}
+			r.Ope.accept(v)
+			if !v.empty {
+				delete(rules, r)
+				changed = true
+			}
+		}
+	}
+	return rules
+}
+
 // referenceChecker
 type referenceChecker struct {
 	*visitorBase
@@ -161,6 +311,7 @@ func (v *referenceChecker) visitPrioritizedChoice(ope *prioritizedChoice) {
 }
 func (v *referenceChecker) visitZeroOrMore(ope *zeroOrMore)       { ope.ope.accept(v) }
 func (v *referenceChecker) visitOneOrMore(ope *oneOrMore)         { ope.ope.accept(v) }
+func (v *referenceChecker) visitRepetition(ope *repetition)       { ope.ope.accept(v) }
 func (v *referenceChecker) visitOption(ope *option)               { ope.ope.accept(v) }
 func (v *referenceChecker) visitAndPredicate(ope *andPredicate)   { ope.ope.accept(v) }
 func (v *referenceChecker) visitNotPredicate(ope *notPredicate)   { ope.ope.accept(v) }
@@ -197,6 +348,7 @@ type linkReferences struct {
 	*visitorBase
 	parameters []string
 	grammar    map[string]*Rule
+	predicates map[string]Predicate
 }
 
 func (v *linkReferences) visitSequence(ope *sequence) {
@@ -211,6 +363,7 @@ func (v *linkReferences) visitPrioritizedChoice(ope *prioritizedChoice) {
 }
 func (v *linkReferences) visitZeroOrMore(ope *zeroOrMore)       { ope.ope.accept(v) }
 func (v *linkReferences) visitOneOrMore(ope *oneOrMore)         { ope.ope.accept(v) }
+func (v *linkReferences) visitRepetition(ope *repetition)       { ope.ope.accept(v) }
 func (v *linkReferences) visitOption(ope *option)               { ope.ope.accept(v) }
 func (v *linkReferences) visitAndPredicate(ope *andPredicate)   { ope.ope.accept(v) }
 func (v *linkReferences) visitNotPredicate(ope *notPredicate)   { ope.ope.accept(v) }
@@ -231,6 +384,12 @@ func (v *linkReferences) visitReference(ope *reference) {
 		arg.accept(v)
 	}
 }
+func (v *linkReferences) visitSemanticPredicate(ope *semanticPredicate) {
+	if _, ok := v.predicates[ope.name]; !ok {
+		v.predicates[ope.name] = nil
+	}
+	ope.predicates = v.predicates
+}
 func (v *linkReferences) visitRule(ope *Rule)             { ope.Ope.accept(v) }
 func (v *linkReferences) visitWhitespace(ope *whitespace) { ope.ope.accept(v) }
 func (v *linkReferences) visitExpression(ope *expression) { ope.atom.accept(v) }
@@ -267,6 +426,10 @@ func (v *findReference) visitOneOrMore(ope *oneOrMore) {
 	ope.ope.accept(v)
 	v.ope = Oom(v.ope)
 }
+func (v *findReference) visitRepetition(ope *repetition) {
+	ope.ope.accept(v)
+	v.ope = Rep(v.ope, ope.min, ope.max)
+}
 func (v *findReference) visitOption(ope *option) {
 	ope.ope.accept(v)
 	v.ope = Opt(v.ope)
@@ -285,6 +448,9 @@ func (v *findReference) visitLiteralString(ope *literalString) {
 func (v *findReference) visitCharacterClass(ope *characterClass) {
 	v.ope = ope
 }
+func (v *findReference) visitUnicodeClass(ope *unicodeClass) {
+	v.ope = ope
+}
 func (v *findReference) visitAnyCharacter(ope *anyCharacter) {
 	v.ope = ope
 }
@@ -299,6 +465,9 @@ func (v *findReference) visitIgnore(ope *ignore) {
 func (v *findReference) visitUser(ope *user) {
 	v.ope = ope
 }
+func (v *findReference) visitSemanticPredicate(ope *semanticPredicate) {
+	v.ope = ope
+}
 func (v *findReference) visitReference(ope *reference) {
 	for i, arg := range v.args {
 		name := v.params[i]
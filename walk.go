@@ -0,0 +1,180 @@
+package peg
+
+// Walk control
+type WalkAction int
+
+const (
+	WalkContinue     WalkAction = iota // Visit children and siblings
+	WalkSkipChildren                   // Don't visit children of the node
+	WalkStop                           // Stop the walk
+)
+
+// WalkAst traverses ast in depth-first order. pre is called before the
+// children of a node are visited and post after them. Either may be nil.
+// It returns WalkStop if a hook stopped the walk.
+func WalkAst(ast *Ast, pre, post func(ast *Ast) WalkAction) WalkAction {
+	if pre != nil {
+		switch pre(ast) {
+		case WalkStop:
+			return WalkStop
+		case WalkSkipChildren:
+			return WalkContinue
+		}
+	}
+	for _, node := range ast.Nodes {
+		if WalkAst(node, pre, post) == WalkStop {
+			return WalkStop
+		}
+	}
+	if post != nil && post(ast) == WalkStop {
+		return WalkStop
+	}
+	return WalkContinue
+}
+
+// InspectAst traverses ast in depth-first order, calling fn for each node.
+// If fn returns false, the children of the node are not visited.
+func InspectAst(ast *Ast, fn func(ast *Ast) bool) {
+	WalkAst(ast, func(ast *Ast) WalkAction {
+		if fn(ast) {
+			return WalkContinue
+		}
+		return WalkSkipChildren
+	}, nil)
+}
+
+// AstCursor describes the node being visited by RewriteAst and allows it to
+// be replaced or deleted, or siblings to be inserted next to it. Parent is
+// set for nodes put into the tree and for all nodes below them.
+type AstCursor struct {
+	parent  *Ast
+	index   int
+	node    *Ast
+	deleted bool
+	after   int
+}
+
+// Node returns the current node.
+func (c *AstCursor) Node() *Ast {
+	return c.node
+}
+
+// Parent returns the parent of the current node, or nil at the root.
+func (c *AstCursor) Parent() *Ast {
+	return c.parent
+}
+
+// Index returns the index of the current node in Parent().Nodes, or -1 at
+// the root.
+func (c *AstCursor) Index() int {
+	return c.index
+}
+
+// Replace replaces the current node with node. When called from pre, the
+// children of node are visited instead of those of the old one.
+func (c *AstCursor) Replace(node *Ast) {
+	if c.deleted {
+		panic("peg: Replace of a deleted node")
+	}
+	node.Parent = c.parent
+	linkAstParents(node)
+	if c.parent != nil {
+		c.parent.Nodes[c.index] = node
+	}
+	c.node = node
+}
+
+// Delete removes the current node from its parent. It panics at the root.
+func (c *AstCursor) Delete() {
+	if c.parent == nil {
+		panic("peg: Delete of the root node")
+	}
+	if c.deleted {
+		panic("peg: Delete of a deleted node")
+	}
+	nodes := c.parent.Nodes
+	c.parent.Nodes = append(nodes[:c.index], nodes[c.index+1:]...)
+	c.node.Parent = nil
+	c.deleted = true
+	c.index--
+}
+
+// InsertBefore inserts node before the current node. The node is not
+// visited. It panics at the root.
+func (c *AstCursor) InsertBefore(node *Ast) {
+	if c.parent == nil {
+		panic("peg: InsertBefore at the root node")
+	}
+	pos := c.index
+	if c.deleted {
+		pos++
+	}
+	c.insert(pos, node)
+	c.index++
+}
+
+// InsertAfter inserts node after the current node. The node is not
+// visited. It panics at the root.
+func (c *AstCursor) InsertAfter(node *Ast) {
+	if c.parent == nil {
+		panic("peg: InsertAfter at the root node")
+	}
+	c.insert(c.index+1, node)
+	c.after++
+}
+
+func (c *AstCursor) insert(pos int, node *Ast) {
+	nodes := append(c.parent.Nodes, nil)
+	copy(nodes[pos+1:], nodes[pos:])
+	nodes[pos] = node
+	c.parent.Nodes = nodes
+	node.Parent = c.parent
+	linkAstParents(node)
+}
+
+func linkAstParents(ast *Ast) {
+	for _, node := range ast.Nodes {
+		node.Parent = ast
+		linkAstParents(node)
+	}
+}
+
+// RewriteAst traverses ast like WalkAst, but the hooks get a cursor through
+// which they can change the tree. It returns the root, which differs from
+// ast if the root was replaced.
+func RewriteAst(ast *Ast, pre, post func(c *AstCursor) WalkAction) *Ast {
+	parent := ast.Parent
+	c := &AstCursor{index: -1, node: ast}
+	rewriteAst(c, pre, post)
+	c.node.Parent = parent
+	return c.node
+}
+
+func rewriteAst(c *AstCursor, pre, post func(c *AstCursor) WalkAction) WalkAction {
+	if pre != nil {
+		switch pre(c) {
+		case WalkStop:
+			return WalkStop
+		case WalkSkipChildren:
+			return WalkContinue
+		}
+		if c.deleted {
+			return WalkContinue
+		}
+	}
+
+	ast := c.node
+	for i := 0; i < len(ast.Nodes); i++ {
+		chc := &AstCursor{parent: ast, index: i, node: ast.Nodes[i]}
+		ret := rewriteAst(chc, pre, post)
+		i = chc.index + chc.after
+		if ret == WalkStop {
+			return WalkStop
+		}
+	}
+
+	if post != nil && post(c) == WalkStop {
+		return WalkStop
+	}
+	return WalkContinue
+}
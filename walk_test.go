@@ -0,0 +1,114 @@
+package peg
+
+import (
+	"strings"
+	"testing"
+)
+
+func walkTokens(ast *Ast) string {
+	var toks []string
+	InspectAst(ast, func(ast *Ast) bool {
+		if len(ast.Token) > 0 {
+			toks = append(toks, ast.Token)
+		}
+		return true
+	})
+	return strings.Join(toks, " ")
+}
+
+func checkParents(t *testing.T, ast *Ast) {
+	InspectAst(ast, func(ast *Ast) bool {
+		for _, node := range ast.Nodes {
+			if node.Parent != ast {
+				t.Errorf("inconsistent parent of %s %q", node.Name, node.Token)
+			}
+		}
+		return true
+	})
+}
+
+func TestWalkAst(t *testing.T) {
+	parser, err := NewParser(`
+		LIST   <- '(' (ITEM / LIST)* ')'
+		ITEM   <- < [a-z0-9]+ >
+		%whitespace <- [ \t\r\n]*
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parser.EnableAst()
+	ast, err := parser.ParseAndGetAst("(a (b c) d (e))", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var order []string
+	ret := WalkAst(ast, func(ast *Ast) WalkAction {
+		order = append(order, "+"+ast.Name+ast.Token)
+		if len(ast.Nodes) == 1 {
+			return WalkSkipChildren
+		}
+		return WalkContinue
+	}, func(ast *Ast) WalkAction {
+		order = append(order, "-"+ast.Name+ast.Token)
+		if ast.Token == "d" {
+			return WalkStop
+		}
+		return WalkContinue
+	})
+
+	assert(t, ret == WalkStop)
+	want := "+LIST +ITEMa -ITEMa +LIST +ITEMb -ITEMb +ITEMc -ITEMc -LIST +ITEMd -ITEMd"
+	if got := strings.Join(order, " "); got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+
+	assert(t, walkTokens(ast) == "a b c d e")
+}
+
+func TestRewriteAst(t *testing.T) {
+	parser, err := NewParser(`
+		LIST   <- '(' (ITEM / LIST)* ')'
+		ITEM   <- < [a-z0-9]+ >
+		%whitespace <- [ \t\r\n]*
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parser.EnableAst()
+	ast, err := parser.ParseAndGetAst("(a (b c) d (e))", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ast = RewriteAst(ast, func(c *AstCursor) WalkAction {
+		switch c.Node().Token {
+		case "a":
+			c.InsertBefore(&Ast{Name: "ITEM", Token: "z"})
+		case "b":
+			c.Delete()
+		case "c":
+			c.Replace(&Ast{Name: "ITEM", Token: "C"})
+			c.InsertAfter(&Ast{Name: "ITEM", Token: "c2"})
+		case "e":
+			c.Replace(&Ast{Name: "LIST", Nodes: []*Ast{{Name: "ITEM", Token: "E"}}})
+		}
+		return WalkContinue
+	}, func(c *AstCursor) WalkAction {
+		if c.Node().Token == "d" {
+			c.InsertAfter(&Ast{Name: "ITEM", Token: "d2"})
+		}
+		return WalkContinue
+	})
+
+	if got := walkTokens(ast); got != "z a C c2 d d2 E" {
+		t.Errorf("unexpected tokens: %q", got)
+	}
+	checkParents(t, ast)
+
+	root := RewriteAst(ast, func(c *AstCursor) WalkAction {
+		c.Replace(c.Node().Nodes[0])
+		return WalkStop
+	}, nil)
+	assert(t, root.Token == "z" && root.Parent == nil)
+}